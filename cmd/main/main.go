@@ -8,9 +8,11 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 	"tunny/monitor"
+	"tunny/tun"
 	"tunny/webmonitor"
 )
 
@@ -20,11 +22,282 @@ func getStdLogger() (w io.Writer, err error) {
 	return
 }
 
+/*
+Check everything the targets need without starting anything, print what was found and
+exit non-zero when something's wrong.
+*/
+func doctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	filename := flags.String("filename", "tunny.json", "The filename to load tunnel targets from")
+	flags.Parse(args)
+
+	if oLog, err := getStdLogger(); err == nil {
+		defer oLog.(io.Closer).Close()
+		log.SetOutput(monitor.RedactingWriter(oLog))
+	}
+
+	checks := webmonitor.Preflight()
+
+	targets, err := monitor.GetTunnelTargets(*filename)
+	checks = append(checks, monitor.DoctorCheck{
+		Name: "config " + *filename,
+		Err:  err,
+		Hint: "Fix the problems listed (tunny validate lists them too), or pass -filename",
+	})
+	if err == nil {
+		checks = append(checks, monitor.RunDoctor(context.Background(), targets, &monitor.CliMonitor{})...)
+	}
+
+	if failed := monitor.WriteDoctorReport(os.Stdout, checks); failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+/*
+Check the config file without starting anything, exit non-zero when it has problems. The targets
+are printed the way they end up, with their templates and defaults expanded.
+*/
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	filename := flags.String("filename", "tunny.json", "The filename to load tunnel targets from")
+	flags.Parse(args)
+
+	loaded, err := monitor.LoadConfig(*filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := loaded.WriteExpanded(os.Stdout, monitor.ConfigFormatOf(*filename)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d targets, no problems found\n", *filename, len(loaded.Targets))
+	return 0
+}
+
+// Show the config as it ends up after layering, and which file each setting is from
+func config(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	filename := flags.String("filename", "tunny.json", "The project config, layered over the user's config")
+	flags.Parse(args)
+
+	loaded, err := monitor.LoadConfig(*filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := loaded.WriteSources(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+/*
+Print each target's local port as a shell export, e.g. for eval "$(tunny env)". Targets that
+leave their port to tunny get the one it picked for them.
+*/
+func env(args []string) int {
+	flags := flag.NewFlagSet("env", flag.ExitOnError)
+	filename := flags.String("filename", "tunny.json", "The filename to load tunnel targets from")
+	flags.Parse(args)
+
+	targets, err := monitor.GetTunnelTargets(*filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, export := range monitor.PortExports(targets) {
+		fmt.Println(export)
+	}
+	return 0
+}
+
+/*
+Convert a config file to another format, picked by the extensions (tunny convert tunny.json tunny.yaml),
+or with -to write it to stdout instead.
+*/
+func convert(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := flags.String("to", "", "Write it to stdout in this format (json, yaml or toml) instead of to a file")
+	force := flags.Bool("force", false, "Overwrite the file being converted to if it's already there")
+	flags.Parse(args)
+
+	if !(flags.NArg() == 1 && *to != "") && !(flags.NArg() == 2 && *to == "") {
+		fmt.Fprintln(os.Stderr, "Usage: tunny convert [-force] from.json to.yaml, or tunny convert -to toml from.json")
+		return 2
+	}
+
+	from := flags.Arg(0)
+	contents, err := os.ReadFile(from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	format := *to
+	if flags.NArg() == 2 {
+		format = monitor.ConfigFormatOf(flags.Arg(1))
+	}
+	converted, err := monitor.ConvertConfig(from, contents, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if flags.NArg() == 1 {
+		os.Stdout.Write(converted)
+		return 0
+	}
+
+	dest := flags.Arg(1)
+	if _, err := os.Stat(dest); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s is already there, pass -force to overwrite it\n", dest)
+		return 1
+	}
+	if err := os.WriteFile(dest, converted, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Converted %s to %s\n", from, dest)
+	return 0
+}
+
+/*
+Kill what tunnys that crashed or were killed left running, the aws cli and session-manager-plugin
+holding ports and so on, and say what was done. Returns how many were cleaned up and how many
+couldn't be.
+*/
+func cleanupProcesses(w io.Writer) (cleaned int, failed int) {
+	cleanups, err := tun.CleanupProcesses()
+	if err != nil {
+		fmt.Fprintf(w, "Error cleaning up after earlier runs: %s\n", err)
+		failed++
+	}
+	for _, cleanup := range cleanups {
+		switch {
+		case cleanup.Err != nil:
+			fmt.Fprintf(w, "Error cleaning up %s: %s\n", cleanup.Process, cleanup.Err)
+			failed++
+		case len(cleanup.Killed) > 0:
+			fmt.Fprintf(w, "Killed %s and what it started (pids %v), an earlier tunny left it running\n", cleanup.Process, cleanup.Killed)
+			cleaned++
+		}
+	}
+	return cleaned, failed
+}
+
+// Clean up after tunnys that crashed or were killed, the same as tunny does when it starts
+func cleanup(args []string) int {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	flags.Parse(args)
+
+	cleaned, failed := cleanupProcesses(os.Stdout)
+	if failed > 0 {
+		return 1
+	}
+	if cleaned == 0 {
+		fmt.Println("Nothing was left running by earlier runs")
+	}
+	return 0
+}
+
+/*
+Check the ports the selected targets and the web monitor need before starting anything, rather
+than have them fail to listen. A tunny or session-manager-plugin left over from an earlier run can
+be killed there and then. False when a port is still taken.
+*/
+func checkPorts(targets []monitor.TunnelTarget, selection monitor.TargetSelection, reader *bufio.Reader) bool {
+	selected := []monitor.TunnelTarget{}
+	for _, target := range targets {
+		if selection.Matches(target) {
+			selected = append(selected, target)
+		}
+	}
+	uses := append([]monitor.PortUse{webmonitor.WebMonitorPortUse()}, monitor.TargetPortUses(selected)...)
+
+	taken := 0
+	for _, use := range uses {
+		// Checked one at a time, killing a leftover can free several
+		conflicts := monitor.FindPortConflicts([]monitor.PortUse{use})
+		if len(conflicts) == 0 {
+			continue
+		}
+		conflict := conflicts[0]
+
+		if conflict.Owner != nil && conflict.Owner.IsLeftover() {
+			fmt.Printf("%s, kill it? [y/N] ", conflict)
+			answer, _ := reader.ReadString('\n')
+			if strings.EqualFold(strings.TrimSpace(answer), "y") {
+				if err := conflict.Owner.Kill(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error killing %s: %s\n", conflict.Owner, err)
+				} else if len(monitor.FindPortConflicts([]monitor.PortUse{use})) == 0 {
+					fmt.Printf("Killed %s\n", conflict.Owner)
+					continue
+				}
+			}
+		}
+
+		log.Printf("%s", conflict)
+		fmt.Fprintf(os.Stderr, "%s\n", conflict)
+		taken++
+	}
+
+	if taken > 0 {
+		fmt.Fprintf(os.Stderr, "Not starting anything until the ports are free, or pick other local_ports\n")
+		return false
+	}
+	return true
+}
+
+// A flag that can be given more than once, e.g. -group staging -group shared
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	// Running tunny with no command is tunny up
+	args := os.Args[1:]
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "up":
+			args = os.Args[2:]
+		case "doctor":
+			os.Exit(doctor(os.Args[2:]))
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "convert":
+			os.Exit(convert(os.Args[2:]))
+		case "config":
+			os.Exit(config(os.Args[2:]))
+		case "env":
+			os.Exit(env(os.Args[2:]))
+		case "cleanup":
+			os.Exit(cleanup(os.Args[2:]))
+		}
+	}
 
-	filename := flag.String("filename", "tunny.json", "The filename to load tunnel targets from")
+	filename := flag.String("filename", "tunny.json", "The filename to load tunnel targets from (json, yaml or toml)")
+	groups := listFlag{}
+	flag.Var(&groups, "group", "Only start the targets in this group, can be given more than once")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: tunny [up] [-filename tunny.json] [-group name]... [target]...\n"+
+			"Starts the named targets and the ones in the groups, or all of them if none are given.\n"+
+			"Other commands: tunny doctor, validate, convert, config, env and cleanup\n")
+		flag.PrintDefaults()
+	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+	selection := monitor.TargetSelection{Names: flag.Args(), Groups: groups}
 
 	oLog, err := getStdLogger()
 	defer oLog.(io.Closer).Close()
@@ -33,27 +306,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	log.SetOutput(oLog)
+	log.SetOutput(monitor.RedactingWriter(oLog))
 
-	targets, err := monitor.GetTunnelTargets(*filename)
+	loaded, err := monitor.LoadConfig(*filename)
+	var assignments []monitor.PortAssignment
+	if err == nil {
+		assignments, err = loaded.AssignPorts()
+	}
 	exitCode := 0
 
 	topCtx, cancelFunc := context.WithCancel(context.Background())
 
-	// Handle the 'q' quit command
-	go func() {
-		read, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
-		if err != nil {
-			log.Printf("Error reading from stdin: %s", err)
-			exitCode = 1
-			cancelFunc()
-		} else if read[0] == 'q' {
-			log.Printf("Received quit command, shutting down\n")
-			cancelFunc()
-
-		}
-	}()
-
 	defer func() {
 		cancelFunc()
 		// Give enough time to hopefully let the process exit, a hack for sure
@@ -68,10 +331,26 @@ func main() {
 
 	if err != nil {
 		log.Printf("Error getting tunnel targets: %s", err)
+		fmt.Fprintf(os.Stderr, "Error getting tunnel targets:\n%s\n", err)
 		exitCode = 1
 
 		return
 	}
+	targets := loaded.Targets
+	if _, err := selection.Pick(targets); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		exitCode = 2
+		return
+	}
+
+	// What an earlier tunny left running would have the ports
+	cleanupProcesses(os.Stderr)
+
+	reader := bufio.NewReader(os.Stdin)
+	if !checkPorts(targets, selection, reader) {
+		exitCode = 1
+		return
+	}
 
 	waiter := &sync.WaitGroup{}
 
@@ -83,14 +362,48 @@ func main() {
 		return
 	}
 
-	for _, target := range targets {
-		waiter.Add(1)
-		monitor.MakeTargetIntoSomething(topCtx, target, mon, waiter)
+	// Handle the 'q' quit command, anything else answers a waiting prompt
+	go func() {
+		for {
+			read, err := reader.ReadString('\n')
+			if err != nil {
+				log.Printf("Error reading from stdin: %s", err)
+				exitCode = 1
+				cancelFunc()
+				return
+			}
 
-	}
+			line := strings.TrimSpace(read)
+			if line == "q" {
+				log.Printf("Received quit command, shutting down\n")
+				cancelFunc()
+				return
+			}
+
+			if !mon.AnswerOldestPrompt(line) {
+				mon.ReportGeneralMessage("Nothing is waiting for input, type q and enter to quit")
+			}
+		}
+	}()
+
+	monitor.ReportNewPorts(mon, assignments)
+
+	set := monitor.NewTargetSet(topCtx, mon, waiter)
+	set.Select(selection)
+	set.Apply(targets)
+	mon.ControlTargets(set)
 
 	mon.ReportGeneralMessage("All proxies started")
 
+	// Keep going while the config is watched, so fixing it brings targets back
+	waiter.Add(1)
+	go func() {
+		defer waiter.Done()
+		if err := monitor.WatchConfig(topCtx, *filename, set, mon); err != nil {
+			mon.ReportGeneralMessage("Not watching %s for changes: %s", *filename, err)
+		}
+	}()
+
 	// Wait for all the goroutines to finish
 	waiter.Wait()
 
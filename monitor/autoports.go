@@ -0,0 +1,304 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"tunny/tun"
+)
+
+// Where auto local ports are picked from when the config doesn't say
+const defaultAutoPortRange = "42000-42999"
+
+// A local_port that tunny picks, leaving it out does the same
+const autoPort = "auto"
+
+// The first and last port of a range like 42000-42999
+func parsePortRange(portRange string) (int, int, error) {
+	first, last, ok := strings.Cut(portRange, "-")
+	if !ok || !validPort(strings.TrimSpace(first)) || !validPort(strings.TrimSpace(last)) {
+		return 0, 0, fmt.Errorf("%q isn't a range of ports like %s", portRange, defaultAutoPortRange)
+	}
+	from, _ := strconv.Atoi(strings.TrimSpace(first))
+	to, _ := strconv.Atoi(strings.TrimSpace(last))
+	if from > to {
+		return 0, 0, fmt.Errorf("%q starts after it ends", portRange)
+	}
+	return from, to, nil
+}
+
+// Whether the target's first transport leaves its local port to tunny, and has somewhere to forward it to
+func (t TunnelTarget) wantsAutoPort() bool {
+	transports := t.transports()
+	if len(transports) == 0 || !transports[0].forwardsLocalPort() {
+		return false
+	}
+	port := transports[0].localPort()
+	return port == "" || port == autoPort
+}
+
+// A copy of the target with its first transport on port, the others set to auto share it
+func (t TunnelTarget) withAutoPort(port string) TunnelTarget {
+	transports := make([]NamedTransport, len(t.Transports))
+	for i, transport := range t.Transports {
+		if transport.localPort() == autoPort {
+			transport.Transport = transport.withLocalPort("")
+		}
+		transports[i] = transport
+	}
+
+	if t.Transport.kind() != "" {
+		t.Transport = t.Transport.withLocalPort(port)
+	} else if len(transports) > 0 {
+		transports[0].Transport = transports[0].withLocalPort(port)
+	}
+	if t.Transports != nil {
+		t.Transports = transports
+	}
+	return t
+}
+
+/*
+Where the auto ports are remembered: $XDG_STATE_HOME/tunny/ports.json, or
+~/.local/state/tunny/ports.json.
+*/
+func PortStatePath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "tunny", "ports.json")
+}
+
+// The auto ports that have been given out, by project config (its absolute path) and target name
+type portState struct {
+	Projects map[string]map[string]string `json:"projects"`
+}
+
+func readPortState(filename string) (*portState, error) {
+	state := &portState{Projects: make(map[string]map[string]string)}
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if state.Projects == nil {
+		state.Projects = make(map[string]map[string]string)
+	}
+	return state, nil
+}
+
+func (s *portState) write(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tun.WriteFileAtomically(filename, contents, 0644)
+}
+
+// A port tunny picked for a target
+type PortAssignment struct {
+	Target string
+	Port   string
+	// Whether it was picked just now rather than remembered
+	New bool
+}
+
+/*
+AssignPorts gives the targets that leave out their local_port (or set it to auto) a port from
+the config's auto_port_range, and remembers it in the state file (see PortStatePath) so they
+get the same one every time. New ones are picked from the ports that aren't in the config, given
+to another target of any project, or in use right now. The state file is locked while they're
+picked, other tunnys wait their turn.
+*/
+func (c *LoadedConfig) AssignPorts() ([]PortAssignment, error) {
+	wanting := []int{}
+	for i, target := range c.Targets {
+		if target.wantsAutoPort() {
+			wanting = append(wanting, i)
+		}
+	}
+	if len(wanting) == 0 {
+		return nil, nil
+	}
+
+	portRange := c.AutoPortRange
+	if portRange == "" {
+		portRange = defaultAutoPortRange
+	}
+	first, last, err := parsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+
+	stateFile := PortStatePath()
+	unlock, err := lockPortState(stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error locking the auto ports: %w", err)
+	}
+	defer unlock()
+	state, err := readPortState(stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the auto ports: %w", err)
+	}
+	project, err := filepath.Abs(c.filename)
+	if err != nil {
+		return nil, err
+	}
+	assigned := state.Projects[project]
+	if assigned == nil {
+		assigned = make(map[string]string)
+		state.Projects[project] = assigned
+	}
+
+	// The config's own ports win over remembered ones
+	taken := make(map[string]bool)
+	for _, target := range c.Targets {
+		for _, transport := range target.transports() {
+			for _, port := range target.via(transport).localPorts() {
+				taken[port] = true
+			}
+		}
+	}
+	for otherProject, ports := range state.Projects {
+		for name, port := range ports {
+			if otherProject != project {
+				taken[port] = true
+			} else if !c.wantsAutoPort(name) {
+				// The target has its own port now, its old one can go to another
+				delete(ports, name)
+			}
+		}
+	}
+
+	assignments := []PortAssignment{}
+	changed := false
+	targets := append([]TunnelTarget{}, c.Targets...)
+	for _, i := range wanting {
+		name := targets[i].Name
+		port, ok := assigned[name]
+		if ok && taken[port] {
+			ok = false
+		}
+		if !ok {
+			port, err = pickFreePort(first, last, taken, assigned)
+			if err != nil {
+				return nil, fmt.Errorf("Error picking a local port for %s: %w", name, err)
+			}
+			assigned[name] = port
+			changed = true
+		}
+		taken[port] = true
+		targets[i] = targets[i].withAutoPort(port)
+		assignments = append(assignments, PortAssignment{Target: name, Port: port, New: !ok})
+	}
+
+	if changed {
+		if err := state.write(stateFile); err != nil {
+			return nil, fmt.Errorf("Error remembering the auto ports: %w", err)
+		}
+	}
+	c.Targets = targets
+	return assignments, nil
+}
+
+func (c *LoadedConfig) wantsAutoPort(name string) bool {
+	for _, target := range c.Targets {
+		if target.Name == name {
+			return target.wantsAutoPort()
+		}
+	}
+	// Not in the config any more, it's remembered in case it comes back
+	return true
+}
+
+// The first port in the range nothing has and that can be listened on
+func pickFreePort(first int, last int, taken map[string]bool, assigned map[string]string) (string, error) {
+	ours := make(map[string]bool, len(assigned))
+	for _, port := range assigned {
+		ours[port] = true
+	}
+	for number := first; number <= last; number++ {
+		port := strconv.Itoa(number)
+		if taken[port] || ours[port] {
+			continue
+		}
+		if tun.CheckLocalPort(port) == nil {
+			return port, nil
+		}
+	}
+	return "", fmt.Errorf("every port from %d to %d is taken, set a bigger auto_port_range", first, last)
+}
+
+// Tell the user about the ports picked just now, the remembered ones they've seen before
+func ReportNewPorts(mon MonitoringInteractor, assignments []PortAssignment) {
+	for _, assignment := range assignments {
+		if assignment.New {
+			mon.ReportInfo(assignment.Target, "Picked local port %s for %s, it'll keep it", assignment.Port, assignment.Target)
+		}
+	}
+}
+
+/*
+The targets' local ports as shell exports, e.g. export TUNNY_DB_MAIN_PORT=42001. An ssh target's
+forwards and SOCKS proxy are exported too, as e.g. TUNNY_BASTION_FORWARD_1_PORT (the first of its
+forwards) and TUNNY_BASTION_SOCKS_PORT.
+*/
+func PortExports(targets []TunnelTarget) []string {
+	exports := []string{}
+	export := func(target TunnelTarget, what string, port string) {
+		if port != "" {
+			exports = append(exports, fmt.Sprintf("export %s=%s", portVariable(target.Name, what), port))
+		}
+	}
+	for _, target := range targets {
+		transports := target.transports()
+		if len(transports) == 0 {
+			continue
+		}
+		first := transports[0]
+		export(target, "", first.localPort())
+		if first.SshConfig != nil {
+			for i, forward := range first.SshConfig.Forwards {
+				export(target, fmt.Sprintf("FORWARD_%d", i+1), forward.LocalPort)
+			}
+			export(target, "SOCKS", first.SshConfig.SocksPort)
+		}
+	}
+	sort.Strings(exports)
+	return exports
+}
+
+// The name of the variable a target's port is exported as, what says which of its ports it is
+func portVariable(name string, what string) string {
+	if what != "" {
+		name += "_" + what
+	}
+	variable := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		default:
+			return '_'
+		}
+	}, name)
+	return "TUNNY_" + variable + "_PORT"
+}
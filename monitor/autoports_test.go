@@ -0,0 +1,261 @@
+package monitor
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadWithPorts(t *testing.T, filename string) (*LoadedConfig, []PortAssignment) {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("Error loading %s: %s", filename, err)
+	}
+	assignments, err := config.AssignPorts()
+	if err != nil {
+		t.Fatalf("Error assigning ports for %s: %s", filename, err)
+	}
+	return config, assignments
+}
+
+func targetPorts(config *LoadedConfig) map[string]string {
+	ports := make(map[string]string)
+	for _, target := range config.Targets {
+		ports[target.Name] = target.transports()[0].localPort()
+	}
+	return ports
+}
+
+func TestAssignPortsRemembersThem(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+
+	project := filepath.Join(dir, "tunny.yaml")
+	writeConfigFile(t, project, `
+auto_port_range: 43100-43199
+tunnels:
+  - name: db
+    k8s_config: {local_port: auto, remote_port: 5432, service: db}
+  - name: api
+    k8s_config: {remote_port: http, service: api}
+  - name: cache
+    k8s_config: {local_port: 43100, remote_port: 6379, service: cache}
+`)
+
+	config, assignments := loadWithPorts(t, project)
+	ports := targetPorts(config)
+	if ports["cache"] != "43100" {
+		t.Errorf("Expected cache to keep its own port, got %s", ports["cache"])
+	}
+	if ports["db"] != "43101" || ports["api"] != "43102" {
+		t.Errorf("Expected db and api to get the first free ports after cache's, got %v", ports)
+	}
+	if len(assignments) != 2 || !assignments[0].New || !assignments[1].New {
+		t.Errorf("Expected two new assignments, got %+v", assignments)
+	}
+
+	// The api moves before db, they each keep their port
+	writeConfigFile(t, project, `
+auto_port_range: 43100-43199
+tunnels:
+  - name: api
+    k8s_config: {remote_port: http, service: api}
+  - name: db
+    k8s_config: {local_port: auto, remote_port: 5432, service: db}
+`)
+	config, assignments = loadWithPorts(t, project)
+	again := targetPorts(config)
+	if again["db"] != ports["db"] || again["api"] != ports["api"] {
+		t.Errorf("Expected the same ports as before %v, got %v", ports, again)
+	}
+	for _, assignment := range assignments {
+		if assignment.New {
+			t.Errorf("Expected %s's port to be remembered, it was picked again", assignment.Target)
+		}
+	}
+
+	// A port written into the config wins over a remembered one
+	writeConfigFile(t, project, `
+auto_port_range: 43100-43199
+tunnels:
+  - name: api
+    k8s_config: {remote_port: http, service: api}
+  - name: db
+    k8s_config: {local_port: `+ports["api"]+`, remote_port: 5432, service: db}
+`)
+	config, assignments = loadWithPorts(t, project)
+	moved := targetPorts(config)
+	if moved["db"] != ports["api"] || moved["api"] == ports["api"] {
+		t.Errorf("Expected api to move off the port db has now, got %v", moved)
+	}
+	if len(assignments) != 1 || !assignments[0].New {
+		t.Errorf("Expected api to get a new port, got %+v", assignments)
+	}
+}
+
+func TestAssignPortsAcrossProjects(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	config := `
+auto_port_range: 43200-43299
+tunnels:
+  - name: db
+    k8s_config: {remote_port: 5432, service: db}
+`
+	first := filepath.Join(t.TempDir(), "tunny.yaml")
+	second := filepath.Join(t.TempDir(), "tunny.yaml")
+	writeConfigFile(t, first, config)
+	writeConfigFile(t, second, config)
+
+	firstPorts := targetPorts(must(loadWithPorts(t, first)))
+	secondPorts := targetPorts(must(loadWithPorts(t, second)))
+	if firstPorts["db"] == secondPorts["db"] {
+		t.Errorf("Expected the projects' db targets to get different ports, both got %s", firstPorts["db"])
+	}
+}
+
+func TestAssignPortsWaitsForTheLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The auto ports aren't locked on windows")
+	}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	project := filepath.Join(t.TempDir(), "tunny.yaml")
+	writeConfigFile(t, project, `
+auto_port_range: 43500-43599
+tunnels:
+  - name: db
+    k8s_config: {remote_port: 5432, service: db}
+`)
+	config, err := LoadConfig(project)
+	if err != nil {
+		t.Fatalf("Error loading the config: %s", err)
+	}
+
+	// Another tunny picking its ports
+	unlock, err := lockPortState(PortStatePath())
+	if err != nil {
+		t.Fatalf("Error locking the auto ports: %s", err)
+	}
+
+	assigned := make(chan error)
+	go func() {
+		_, err := config.AssignPorts()
+		assigned <- err
+	}()
+	select {
+	case <-assigned:
+		t.Fatalf("Expected the ports to wait until the other tunny's done")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case err := <-assigned:
+		if err != nil {
+			t.Fatalf("Error assigning ports: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the ports to be assigned once the lock's released")
+	}
+	if targetPorts(config)["db"] != "43500" {
+		t.Errorf("Expected db to get the first port, got %v", targetPorts(config))
+	}
+}
+
+func must(config *LoadedConfig, _ []PortAssignment) *LoadedConfig {
+	return config
+}
+
+func TestAssignPortsWithTransports(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	project := filepath.Join(t.TempDir(), "tunny.yaml")
+	writeConfigFile(t, project, `
+auto_port_range: 43300-43399
+tunnels:
+  - name: db
+    transports:
+      - k8s_config: {local_port: auto, remote_port: 5432, service: db}
+      - k8s_config: {local_port: auto, remote_port: 5432, service: db-replica}
+`)
+	config, _ := loadWithPorts(t, project)
+	for _, transport := range config.Targets[0].transports() {
+		if transport.localPort() != "43300" {
+			t.Errorf("Expected every transport on 43300, %s is on %s", transport.Name, transport.localPort())
+		}
+	}
+}
+
+func TestAssignPortsOnlyForwardingTargets(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	project := filepath.Join(t.TempDir(), "tunny.yaml")
+	writeConfigFile(t, project, `
+auto_port_range: 43400-43499
+tunnels:
+  - name: bastion
+    ssh_config: {host: "bastion:22", socks_port: 1080, forwards: [{local_port: 5433, remote_port: 5432}]}
+  - name: db
+    ssh_config: {host: "bastion:22", remote_host: db.internal, remote_port: 5432}
+`)
+	config, assignments := loadWithPorts(t, project)
+	ports := targetPorts(config)
+	if ports["bastion"] != "" {
+		t.Errorf("Expected bastion, with nothing of its own to forward, to get no port, got %s", ports["bastion"])
+	}
+	if ports["db"] != "43400" || len(assignments) != 1 {
+		t.Errorf("Expected only db to get a port, got %v %+v", ports, assignments)
+	}
+}
+
+func TestAutoPortRangeProblems(t *testing.T) {
+	for _, portRange := range []string{"42000", "42000-", "43000-42000", "0-10", "a-b"} {
+		if _, _, err := parsePortRange(portRange); err == nil {
+			t.Errorf("Expected %q to be rejected", portRange)
+		}
+	}
+	if first, last, err := parsePortRange("42000 - 42999"); err != nil || first != 42000 || last != 42999 {
+		t.Errorf("Expected 42000 - 42999 to parse, got %d %d %v", first, last, err)
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	project := filepath.Join(t.TempDir(), "tunny.yaml")
+	writeConfigFile(t, project, `
+auto_port_range: lots
+tunnels:
+  - name: db
+    k8s_config: {remote_port: 5432, service: db}
+`)
+	_, err := LoadConfig(project)
+	if err == nil || !strings.Contains(err.Error(), "auto_port_range") {
+		t.Errorf("Expected a problem with auto_port_range, got %v", err)
+	}
+}
+
+func TestPortExports(t *testing.T) {
+	targets := []TunnelTarget{
+		{Name: "db-main", Transport: Transport{K8sConfig: &K8sConfig{LocalPort: "42001"}}},
+		{Name: "api", Transport: Transport{K8sConfig: &K8sConfig{LocalPort: "8080"}}},
+		{Name: "bastion", Transport: Transport{SshConfig: &SshConfig{SocksPort: "1080",
+			Forwards: []RemoteSpec{{LocalPort: "5433"}, {LocalPort: "6380"}}}}},
+	}
+	exports := PortExports(targets)
+	expected := []string{
+		"export TUNNY_API_PORT=8080",
+		"export TUNNY_BASTION_FORWARD_1_PORT=5433",
+		"export TUNNY_BASTION_FORWARD_2_PORT=6380",
+		"export TUNNY_BASTION_SOCKS_PORT=1080",
+		"export TUNNY_DB_MAIN_PORT=42001",
+	}
+	if strings.Join(exports, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, exports)
+	}
+}
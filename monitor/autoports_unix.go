@@ -0,0 +1,31 @@
+//go:build !windows
+
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+Hold a lock on the state file (a .lock next to it) until the returned func is called, so two
+tunnys starting at once don't lose each other's ports or pick the same one.
+*/
+func lockPortState(filename string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package monitor
+
+// Not locked here, two tunnys starting at the same moment can pick the same port
+func lockPortState(filename string) (func(), error) {
+	return func() {}, nil
+}
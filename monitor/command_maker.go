@@ -0,0 +1,143 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"tunny/tun"
+)
+
+// Turns off the port probe of a command target
+const noProbe = "none"
+
+// What the templates of a command target can use
+type commandTemplateData struct {
+	Name       string
+	LocalPort  string
+	RemoteHost string
+	RemotePort string
+}
+
+// Fill in one template of a command target, anything it doesn't know about is an error
+func renderCommandTemplate(what string, text string, data commandTemplateData) (string, error) {
+	tmpl, err := template.New(what).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("bad template in %s: %w", what, err)
+	}
+
+	out := &strings.Builder{}
+	if err := tmpl.Execute(out, data); err != nil {
+		return "", fmt.Errorf("error filling in %s: %w", what, err)
+	}
+	return out.String(), nil
+}
+
+// Build the tunnel for a command target, everything but the callbacks
+func commandTunnel(target TunnelTarget) (tun.CommandTunnel, error) {
+	commandConfig := target.CommandConfig
+	tunnel := tun.CommandTunnel{Dir: commandConfig.Dir}
+
+	if len(commandConfig.Command) == 0 {
+		return tunnel, fmt.Errorf("command_config needs a command")
+	}
+
+	data := commandTemplateData{
+		Name:       target.Name,
+		LocalPort:  commandConfig.LocalPort,
+		RemoteHost: commandConfig.RemoteHost,
+		RemotePort: commandConfig.RemotePort,
+	}
+
+	for i, arg := range commandConfig.Command {
+		rendered, err := renderCommandTemplate(fmt.Sprintf("command[%d]", i), arg, data)
+		if err != nil {
+			return tunnel, err
+		}
+		tunnel.Args = append(tunnel.Args, rendered)
+	}
+
+	// Sorted so the environment comes out the same every time
+	names := make([]string, 0, len(commandConfig.Env))
+	for name := range commandConfig.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rendered, err := renderCommandTemplate("env "+name, commandConfig.Env[name], data)
+		if err != nil {
+			return tunnel, err
+		}
+		tunnel.Env = append(tunnel.Env, name+"="+rendered)
+	}
+
+	if commandConfig.ReadyPattern != "" {
+		pattern, err := regexp.Compile(commandConfig.ReadyPattern)
+		if err != nil {
+			return tunnel, fmt.Errorf("bad ready_pattern %q: %w", commandConfig.ReadyPattern, err)
+		}
+		tunnel.Readiness.OutputPattern = pattern
+	}
+
+	switch {
+	case commandConfig.ProbeAddress == noProbe:
+	case commandConfig.ProbeAddress != "":
+		tunnel.Readiness.ProbeAddress = commandConfig.ProbeAddress
+	case commandConfig.ReadyPattern == "" && commandConfig.LocalPort != "":
+		tunnel.Readiness.ProbeAddress = net.JoinHostPort("localhost", commandConfig.LocalPort)
+	}
+	tunnel.KeepaliveAddress = tunnel.Readiness.ProbeAddress
+	if tunnel.KeepaliveAddress == "" && commandConfig.LocalPort != "" {
+		tunnel.KeepaliveAddress = net.JoinHostPort("localhost", commandConfig.LocalPort)
+	}
+
+	if commandConfig.StartupTimeout != "" {
+		timeout, err := time.ParseDuration(commandConfig.StartupTimeout)
+		if err != nil {
+			return tunnel, fmt.Errorf("bad startup_timeout %q: %w", commandConfig.StartupTimeout, err)
+		}
+		tunnel.Readiness.Timeout = timeout
+	}
+
+	if commandConfig.KeepaliveInterval != "" {
+		interval, err := time.ParseDuration(commandConfig.KeepaliveInterval)
+		if err != nil {
+			return tunnel, fmt.Errorf("bad keepalive_interval %q: %w", commandConfig.KeepaliveInterval, err)
+		}
+		tunnel.KeepaliveInterval = interval
+	}
+
+	return tunnel, nil
+}
+
+// Run the command of a command target, readiness and output are reported straight to the monitor
+func startCommandTarget(
+	topCtx context.Context,
+	target TunnelTarget,
+	mon MonitoringInteractor,
+	onReady func()) (<-chan error, error) {
+	tunnel, err := commandTunnel(target)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel.OnReady = func() {
+		mon.ReportInfo(target.Name, "Tunnel is ready")
+		onReady()
+	}
+	tunnel.OnOutput = func(stream tun.OutputStream, line string) {
+		reportOutputLine(target.Name, mon, stream, line)
+	}
+
+	eventual, err := tun.StartCommandTunnel(topCtx, tunnel)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting %s: %w", tunnel.Args[0], err)
+	}
+
+	mon.ReportInfo(target.Name, "Started %s", tunnel.Args[0])
+	return eventual, nil
+}
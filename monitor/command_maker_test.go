@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandTunnelTemplates(t *testing.T) {
+	target := TunnelTarget{
+		Name: "warehouse",
+		Transport: Transport{CommandConfig: &CommandConfig{
+			RemoteSpec: RemoteSpec{LocalPort: "5439", RemoteHost: "warehouse-vm", RemotePort: "5432"},
+			Command: []string{
+				"gcloud", "compute", "start-iap-tunnel", "{{.RemoteHost}}", "{{.RemotePort}}",
+				"--local-host-port=localhost:{{.LocalPort}}",
+			},
+			Env: map[string]string{"TUNNEL_NAME": "{{.Name}}", "CLOUDSDK_CORE_PROJECT": "data"},
+		}},
+	}
+
+	tunnel, err := commandTunnel(target)
+	if err != nil {
+		t.Fatalf("Error building tunnel: %s", err)
+	}
+
+	expectedArgs := []string{
+		"gcloud", "compute", "start-iap-tunnel", "warehouse-vm", "5432",
+		"--local-host-port=localhost:5439",
+	}
+	if !reflect.DeepEqual(tunnel.Args, expectedArgs) {
+		t.Errorf("Expected args %q, got %q", expectedArgs, tunnel.Args)
+	}
+
+	expectedEnv := []string{"CLOUDSDK_CORE_PROJECT=data", "TUNNEL_NAME=warehouse"}
+	if !reflect.DeepEqual(tunnel.Env, expectedEnv) {
+		t.Errorf("Expected env %q, got %q", expectedEnv, tunnel.Env)
+	}
+
+	// No ready_pattern means probing the local port
+	if tunnel.Readiness.ProbeAddress != "localhost:5439" {
+		t.Errorf("Expected the local port to be probed, got %q", tunnel.Readiness.ProbeAddress)
+	}
+}
+
+func TestCommandTunnelReadiness(t *testing.T) {
+	target := TunnelTarget{
+		Name: "vendor",
+		Transport: Transport{CommandConfig: &CommandConfig{
+			RemoteSpec:   RemoteSpec{LocalPort: "8443"},
+			Command:      []string{"vendor-cli", "tunnel"},
+			ReadyPattern: `Tunnel (up|established)`,
+			ProbeAddress: noProbe,
+		}},
+	}
+
+	tunnel, err := commandTunnel(target)
+	if err != nil {
+		t.Fatalf("Error building tunnel: %s", err)
+	}
+	if tunnel.Readiness.OutputPattern == nil || !tunnel.Readiness.OutputPattern.MatchString("Tunnel established") {
+		t.Errorf("Expected the ready pattern to be used, got %v", tunnel.Readiness.OutputPattern)
+	}
+	if tunnel.Readiness.ProbeAddress != "" {
+		t.Errorf("Expected no probe, got %q", tunnel.Readiness.ProbeAddress)
+	}
+}
+
+func TestCommandTunnelBadTemplate(t *testing.T) {
+	target := TunnelTarget{
+		Name: "typo",
+		Transport: Transport{CommandConfig: &CommandConfig{
+			Command: []string{"cloudflared", "access", "tcp", "--url", "localhost:{{.LocalPrt}}"},
+		}},
+	}
+
+	_, err := commandTunnel(target)
+	if err == nil || !strings.Contains(err.Error(), "command[4]") {
+		t.Errorf("Expected an error pointing at command[4], got %v", err)
+	}
+}
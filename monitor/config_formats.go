@@ -0,0 +1,79 @@
+package monitor
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The formats a config file can be in
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// The format of a config file by its extension, json for anything that isn't yaml or toml
+func ConfigFormatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	default:
+		return ConfigFormatJSON
+	}
+}
+
+func readConfig(format string, filename string, contents []byte) (*configNode, error) {
+	var root *configNode
+	var err error
+	switch format {
+	case ConfigFormatYAML:
+		root, err = readYAMLConfig(filename, contents)
+	case ConfigFormatTOML:
+		root, err = readTOMLConfig(filename, contents)
+	default:
+		root, err = readJSONConfig(filename, contents)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	root.setFilename(filename)
+	return root, nil
+}
+
+func writeConfig(format string, node *configNode) ([]byte, error) {
+	switch format {
+	case ConfigFormatJSON:
+		return writeJSONConfig(node)
+	case ConfigFormatYAML:
+		return writeYAMLConfig(node)
+	case ConfigFormatTOML:
+		return writeTOMLConfig(node)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, expected %s, %s or %s", format, ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML)
+	}
+}
+
+/*
+ConvertConfig turns a config file (in the format its name says) into another format. Its fields
+have to be ones tunny knows, and come out the way tunny reads them, e.g. a yaml local_port: 5432
+is written as the string it's read as. The targets don't have to be complete, it could be a file
+that's layered over another. Comments aren't carried over.
+*/
+func ConvertConfig(filename string, contents []byte, format string) ([]byte, error) {
+	sourceFormat := ConfigFormatOf(filename)
+	root, err := readConfig(sourceFormat, filename, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := newConfigChecker(sourceFormat)
+	checker.check(root, tunnelsFileType, "")
+	if len(checker.errs) > 0 {
+		return nil, checker.errs
+	}
+	return writeConfig(format, root)
+}
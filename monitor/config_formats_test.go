@@ -0,0 +1,146 @@
+package monitor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const formatsJSON = `{
+	"tunnels": [
+		{
+			"name": "orders-db",
+			"ssm_config": {"local_port": "5432", "remote_host": "orders.cluster.internal", "remote_port": "5432", "instance_name": "bastion"},
+			"transports": [
+				{"name": "vpn", "ssh_config": {"remote_host": "orders.cluster.internal", "remote_port": "5432", "host": "bastion:22", "username": "ec2-user"}}
+			]
+		},
+		{
+			"name": "tunnel-cli",
+			"command_config": {"local_port": "8080", "command": ["cloudflared", "access", "tcp", "--url", "localhost:{{.LocalPort}}"], "env": {"TZ": "UTC"}}
+		}
+	]
+}`
+
+const formatsYAML = `
+# The prod databases
+tunnels:
+  - name: orders-db # prod orders, not the replica
+    ssm_config: &bastion
+      local_port: 5432
+      remote_host: orders.cluster.internal
+      remote_port: 5432
+      instance_name: bastion
+    transports:
+      - name: vpn
+        ssh_config:
+          remote_host: orders.cluster.internal
+          remote_port: "5432"
+          host: bastion:22
+          username: ec2-user
+  - name: tunnel-cli
+    command_config:
+      local_port: 8080
+      command: [cloudflared, access, tcp, --url, "localhost:{{.LocalPort}}"]
+      env:
+        TZ: UTC
+`
+
+const formatsTOML = `
+# The prod databases
+[[tunnels]]
+name = "orders-db" # prod orders, not the replica
+
+[tunnels.ssm_config]
+local_port = 5432
+remote_host = "orders.cluster.internal"
+remote_port = 5_432
+instance_name = 'bastion'
+
+[[tunnels.transports]]
+name = "vpn"
+ssh_config = { remote_host = "orders.cluster.internal", remote_port = "5432", host = "bastion:22", username = "ec2-user" }
+
+[[tunnels]]
+name = "tunnel-cli"
+command_config.local_port = "8080"
+command_config.command = ["cloudflared", "access", "tcp", "--url", "localhost:{{.LocalPort}}"]
+command_config.env.TZ = "UTC"
+`
+
+func TestConfigFormatsReadTheSame(t *testing.T) {
+	expected, err := ParseTunnelTargets("tunny.json", []byte(formatsJSON))
+	if err != nil {
+		t.Fatalf("Error parsing json: %s", err)
+	}
+
+	for filename, contents := range map[string]string{"tunny.yaml": formatsYAML, "tunny.yml": formatsYAML, "tunny.toml": formatsTOML} {
+		targets, err := ParseTunnelTargets(filename, []byte(contents))
+		if err != nil {
+			t.Errorf("Error parsing %s: %s", filename, err)
+			continue
+		}
+		if !reflect.DeepEqual(targets, expected) {
+			t.Errorf("%s doesn't match the json:\n%+v\n%+v", filename, targets, expected)
+		}
+	}
+}
+
+func TestConfigFormatsReportWhere(t *testing.T) {
+	cases := []struct {
+		filename string
+		contents string
+		expected string
+	}{
+		{"tunny.yaml", "tunnels:\n  - name: db\n    ssm_config:\n      local_port: 5432\n      instance: bastion\n",
+			"tunny.yaml:5:7: tunnels[0].ssm_config.instance: unknown field"},
+		{"tunny.yaml", "tunnels:\n  - name: db\n    ssm_config:\n      local_port: 99999\n",
+			`tunny.yaml:4:19: tunnels[0].ssm_config.local_port: "99999" isn't a port number`},
+		{"tunny.yaml", "tunnels:\n  - name: db\n\tssm_config: {}\n",
+			"tunny.yaml:2:1: found a tab character"},
+		{"tunny.toml", "[[tunnels]]\nname = \"db\"\n\n[tunnels.ssm_config]\nlocal_port = 5432\ninstance = \"bastion\"\n",
+			"tunny.toml:6:1: tunnels[0].ssm_config.instance: unknown field"},
+		{"tunny.toml", "[[tunnels]]\nname = \"db\"\nssm_config = { local_port = [5432] }\n",
+			"tunny.toml:3:16: tunnels[0].ssm_config.local_port: expected string, got array"},
+		{"tunny.toml", "[[tunnels]]\nname = = \"db\"\n",
+			"tunny.toml:2:8: "},
+	}
+
+	for _, c := range cases {
+		_, err := ParseTunnelTargets(c.filename, []byte(c.contents))
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected an error like %q, got %v", c.expected, err)
+		}
+	}
+}
+
+func TestConvertConfigRoundTrips(t *testing.T) {
+	expected, err := ParseTunnelTargets("tunny.yaml", []byte(formatsYAML))
+	if err != nil {
+		t.Fatalf("Error parsing yaml: %s", err)
+	}
+
+	filename, contents := "tunny.yaml", []byte(formatsYAML)
+	for _, format := range []string{ConfigFormatTOML, ConfigFormatJSON, ConfigFormatYAML, ConfigFormatJSON} {
+		converted, err := ConvertConfig(filename, contents, format)
+		if err != nil {
+			t.Fatalf("Error converting %s to %s: %s", filename, format, err)
+		}
+
+		filename, contents = "tunny."+format, converted
+		targets, err := ParseTunnelTargets(filename, contents)
+		if err != nil {
+			t.Fatalf("Error parsing the converted %s: %s\n%s", format, err, contents)
+		}
+		if !reflect.DeepEqual(targets, expected) {
+			t.Errorf("The converted %s doesn't match:\n%s", format, contents)
+		}
+	}
+
+	if _, err := ConvertConfig("tunny.json", []byte(`{"tunnels": [{"name": "x", "bogus": true}]}`), ConfigFormatYAML); err == nil {
+		t.Errorf("Expected a config with unknown fields not to convert")
+	}
+	if _, err := ConvertConfig("tunny.json", []byte(`{"tunnels": [{"name": "x"}]}`), ConfigFormatYAML); err != nil {
+		t.Errorf("Expected a layer with an incomplete target to convert, got %s", err)
+	}
+}
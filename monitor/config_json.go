@@ -0,0 +1,187 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Reads a json config into nodes, keeping where everything is
+type jsonConfigReader struct {
+	contents []byte
+	dec      *json.Decoder
+}
+
+func readJSONConfig(filename string, contents []byte) (*configNode, error) {
+	r := &jsonConfigReader{contents: contents, dec: json.NewDecoder(bytes.NewReader(contents))}
+	r.dec.UseNumber()
+
+	root, err := r.value()
+	if err == nil {
+		if _, extra := r.dec.Token(); extra != io.EOF {
+			err = fmt.Errorf("more than one json value in the file")
+		}
+	}
+	if err != nil {
+		offset := int64(len(contents))
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			offset = syntaxErr.Offset
+		}
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		line, column := r.position(offset)
+		return nil, ConfigErrors{{Filename: filename, Line: line, Column: column, Message: err.Error()}}
+	}
+	return root, nil
+}
+
+// The line and column of an offset into the file
+func (r *jsonConfigReader) position(offset int64) (int, int) {
+	if offset > int64(len(r.contents)) {
+		offset = int64(len(r.contents))
+	}
+	before := r.contents[:offset]
+	return bytes.Count(before, []byte("\n")) + 1, int(offset) - bytes.LastIndexByte(before, '\n')
+}
+
+// Where the next token starts, past the whitespace and separators the decoder hasn't read yet
+func (r *jsonConfigReader) next() (int, int) {
+	offset := r.dec.InputOffset()
+	for offset < int64(len(r.contents)) && strings.IndexByte(" \t\r\n,:", r.contents[offset]) >= 0 {
+		offset++
+	}
+	return r.position(offset)
+}
+
+func (r *jsonConfigReader) value() (*configNode, error) {
+	node := &configNode{}
+	node.line, node.column = r.next()
+
+	token, err := r.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token := token.(type) {
+	case json.Delim:
+		if token == '{' {
+			node.kind = objectNode
+			for r.dec.More() {
+				line, column := r.next()
+				key, err := r.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := r.value()
+				if err != nil {
+					return nil, err
+				}
+				node.fields = append(node.fields, configField{name: key.(string), line: line, column: column, value: value})
+			}
+		} else {
+			node.kind = arrayNode
+			for r.dec.More() {
+				item, err := r.value()
+				if err != nil {
+					return nil, err
+				}
+				node.items = append(node.items, item)
+			}
+		}
+		// The closing } or ]
+		if _, err := r.dec.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.kind = stringNode
+		node.text = token
+	case json.Number:
+		node.kind = numberNode
+		node.text = token.String()
+	case bool:
+		node.kind = boolNode
+		node.text = fmt.Sprint(token)
+	default:
+		node.kind = nullNode
+	}
+
+	return node, nil
+}
+
+// The node as indented json
+func writeJSONConfig(node *configNode) ([]byte, error) {
+	out := &bytes.Buffer{}
+	if err := writeJSONNode(out, node, ""); err != nil {
+		return nil, err
+	}
+	out.WriteString("\n")
+	return out.Bytes(), nil
+}
+
+func writeJSONNode(out *bytes.Buffer, node *configNode, indent string) error {
+	switch node.kind {
+	case objectNode:
+		if len(node.fields) == 0 {
+			out.WriteString("{}")
+			return nil
+		}
+		out.WriteString("{\n")
+		for i, field := range node.fields {
+			out.WriteString(indent + "  ")
+			writeJSONString(out, field.name)
+			out.WriteString(": ")
+			if err := writeJSONNode(out, field.value, indent+"  "); err != nil {
+				return err
+			}
+			if i < len(node.fields)-1 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(indent + "}")
+	case arrayNode:
+		if len(node.items) == 0 {
+			out.WriteString("[]")
+			return nil
+		}
+		out.WriteString("[\n")
+		for i, item := range node.items {
+			out.WriteString(indent + "  ")
+			if err := writeJSONNode(out, item, indent+"  "); err != nil {
+				return err
+			}
+			if i < len(node.items)-1 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(indent + "]")
+	case stringNode:
+		writeJSONString(out, node.text)
+	case numberNode:
+		number, err := numberText(node.text)
+		if err != nil {
+			return err
+		}
+		out.WriteString(number)
+	case boolNode:
+		out.WriteString(node.text)
+	default:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+// A json string, without escaping the <, > and & that shell commands are full of
+func writeJSONString(out *bytes.Buffer, value string) {
+	encoded := &bytes.Buffer{}
+	enc := json.NewEncoder(encoded)
+	enc.SetEscapeHTML(false)
+	enc.Encode(value)
+	out.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
+}
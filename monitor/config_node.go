@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The kinds of value in a config file, whatever format it's in
+type configNodeKind int
+
+const (
+	objectNode configNodeKind = iota
+	arrayNode
+	stringNode
+	numberNode
+	boolNode
+	nullNode
+)
+
+func (k configNodeKind) String() string {
+	switch k {
+	case objectNode:
+		return "object"
+	case arrayNode:
+		return "array"
+	case stringNode:
+		return "string"
+	case numberNode:
+		return "number"
+	case boolNode:
+		return "bool"
+	default:
+		return "null"
+	}
+}
+
+/*
+A value from a config file and where it is in the file. Every format is read into these so
+they're all checked against TunnelTarget the same way, with errors pointing into the file.
+*/
+type configNode struct {
+	kind configNodeKind
+	// Where it's from, several files can go into one config
+	filename string
+	line     int
+	column   int
+
+	// An object's fields, in the order they're written
+	fields []configField
+	// An array's items
+	items []*configNode
+	// A scalar as written: the string itself, or the number or bool's text
+	text string
+}
+
+// A field of an object, where its key is
+type configField struct {
+	name   string
+	line   int
+	column int
+	value  *configNode
+}
+
+// The last field with the name, nil if there isn't one
+func (n *configNode) field(name string) *configField {
+	for i := len(n.fields) - 1; i >= 0; i-- {
+		if n.fields[i].name == name {
+			return &n.fields[i]
+		}
+	}
+	return nil
+}
+
+func (n *configNode) setFilename(filename string) {
+	n.filename = filename
+	for _, field := range n.fields {
+		field.value.setFilename(filename)
+	}
+	for _, item := range n.items {
+		item.setFilename(filename)
+	}
+}
+
+/*
+A number's text the way json has it. YAML and TOML allow underscores, hex and so on, which
+are turned into plain decimal.
+*/
+func numberText(text string) (string, error) {
+	if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return text, nil
+	}
+
+	plain := strings.ReplaceAll(text, "_", "")
+	if integer, err := strconv.ParseInt(plain, 0, 64); err == nil {
+		return strconv.FormatInt(integer, 10), nil
+	}
+	float, err := strconv.ParseFloat(plain, 64)
+	if err != nil || float-float != 0 {
+		// NaN and infinities don't survive being turned into json
+		return "", fmt.Errorf("%q isn't a number tunny can use", text)
+	}
+	return strconv.FormatFloat(float, 'g', -1, 64), nil
+}
@@ -0,0 +1,362 @@
+package monitor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// Reads a toml config into nodes, keeping where everything is
+type tomlConfigReader struct {
+	filename string
+	parser   *unstable.Parser
+	root     *configNode
+}
+
+func readTOMLConfig(filename string, contents []byte) (*configNode, error) {
+	r := &tomlConfigReader{
+		filename: filename,
+		parser:   &unstable.Parser{},
+		root:     &configNode{kind: objectNode, line: 1, column: 1},
+	}
+	r.parser.Reset(contents)
+
+	// The table the key/values go in, the root until there's a [table] or [[array]]
+	current := r.root
+	for r.parser.NextExpression() {
+		expression := r.parser.Expression()
+
+		var err error
+		switch expression.Kind {
+		case unstable.Table:
+			current, err = r.table(expression)
+		case unstable.ArrayTable:
+			current, err = r.arrayTable(expression)
+		case unstable.KeyValue:
+			err = r.keyValue(current, expression)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.parser.Error(); err != nil {
+		line, column := r.errorPosition(err)
+		message := err.Error()
+		var parserErr *unstable.ParserError
+		if errors.As(err, &parserErr) {
+			message = parserErr.Message
+		}
+		return nil, ConfigErrors{{Filename: filename, Line: line, Column: column, Message: message}}
+	}
+
+	return r.root, nil
+}
+
+// Where a parser error is, the end of the file if that can't be worked out
+func (r *tomlConfigReader) errorPosition(err error) (line int, column int) {
+	contents := r.parser.Data()
+	line = bytes.Count(contents, []byte("\n")) + 1
+	column = len(contents) - bytes.LastIndexByte(contents, '\n')
+
+	var parserErr *unstable.ParserError
+	if !errors.As(err, &parserErr) || len(parserErr.Highlight) == 0 {
+		return line, column
+	}
+	defer func() {
+		// The highlight isn't always part of the input
+		recover()
+	}()
+	shape := r.parser.Shape(r.parser.Range(parserErr.Highlight))
+	return shape.Start.Line, shape.Start.Column
+}
+
+func (r *tomlConfigReader) fail(line int, column int, format string, args ...interface{}) error {
+	return ConfigErrors{{Filename: r.filename, Line: line, Column: column, Message: fmt.Sprintf(format, args...)}}
+}
+
+func (r *tomlConfigReader) position(raw unstable.Range) (int, int) {
+	shape := r.parser.Shape(raw)
+	return shape.Start.Line, shape.Start.Column
+}
+
+/*
+Find (or make) the object a dotted key leads to from an object. The last element of an array
+of tables is the one that's meant, like [servers.settings] after [[servers]].
+*/
+func (r *tomlConfigReader) walk(from *configNode, keys []*unstable.Node) (*configNode, error) {
+	current := from
+	for _, key := range keys {
+		name := string(key.Data)
+		line, column := r.position(key.Raw)
+
+		field := current.field(name)
+		if field == nil {
+			object := &configNode{kind: objectNode, line: line, column: column}
+			current.fields = append(current.fields, configField{name: name, line: line, column: column, value: object})
+			current = object
+			continue
+		}
+
+		switch {
+		case field.value.kind == objectNode:
+			current = field.value
+		case field.value.kind == arrayNode && len(field.value.items) > 0 && field.value.items[len(field.value.items)-1].kind == objectNode:
+			current = field.value.items[len(field.value.items)-1]
+		default:
+			return nil, r.fail(line, column, "%s is already set to a %s, it can't be a table too", name, field.value.kind)
+		}
+	}
+	return current, nil
+}
+
+func keyNodes(iterator unstable.Iterator) []*unstable.Node {
+	keys := []*unstable.Node{}
+	for iterator.Next() {
+		keys = append(keys, iterator.Node())
+	}
+	return keys
+}
+
+// A [table], the key/values that follow go in it
+func (r *tomlConfigReader) table(expression *unstable.Node) (*configNode, error) {
+	return r.walk(r.root, keyNodes(expression.Key()))
+}
+
+// An [[array]], a new object is added to it and the key/values that follow go in that
+func (r *tomlConfigReader) arrayTable(expression *unstable.Node) (*configNode, error) {
+	keys := keyNodes(expression.Key())
+	parent, err := r.walk(r.root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := keys[len(keys)-1]
+	name := string(last.Data)
+	line, column := r.position(last.Raw)
+	object := &configNode{kind: objectNode, line: line, column: column}
+
+	field := parent.field(name)
+	if field == nil {
+		array := &configNode{kind: arrayNode, line: line, column: column, items: []*configNode{object}}
+		parent.fields = append(parent.fields, configField{name: name, line: line, column: column, value: array})
+		return object, nil
+	}
+	if field.value.kind != arrayNode {
+		return nil, r.fail(line, column, "%s is already set to a %s, it can't be an array of tables too", name, field.value.kind)
+	}
+	field.value.items = append(field.value.items, object)
+	return object, nil
+}
+
+// A key = value, the key can be dotted
+func (r *tomlConfigReader) keyValue(into *configNode, expression *unstable.Node) error {
+	keys := keyNodes(expression.Key())
+	parent, err := r.walk(into, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+
+	last := keys[len(keys)-1]
+	line, column := r.position(last.Raw)
+	value, err := r.value(expression.Value(), line, column)
+	if err != nil {
+		return err
+	}
+	parent.fields = append(parent.fields, configField{name: string(last.Data), line: line, column: column, value: value})
+	return nil
+}
+
+// A value, where it is if the parser kept that and at the key's position otherwise
+func (r *tomlConfigReader) value(value *unstable.Node, line int, column int) (*configNode, error) {
+	if value.Raw.Length > 0 {
+		line, column = r.position(value.Raw)
+	}
+	node := &configNode{line: line, column: column, text: string(value.Data)}
+
+	switch value.Kind {
+	case unstable.String:
+		node.kind = stringNode
+	case unstable.Integer, unstable.Float:
+		node.kind = numberNode
+	case unstable.Bool:
+		node.kind = boolNode
+	case unstable.LocalDate, unstable.LocalTime, unstable.LocalDateTime, unstable.DateTime:
+		// Nothing in the config is a date, they're kept as written
+		node.kind = stringNode
+	case unstable.Array:
+		node.kind = arrayNode
+		items := value.Children()
+		for items.Next() {
+			item, err := r.value(items.Node(), line, column)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+	case unstable.InlineTable:
+		node.kind = objectNode
+		node.text = ""
+		keyValues := value.Children()
+		for keyValues.Next() {
+			if err := r.keyValue(node, keyValues.Node()); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, r.fail(line, column, "unexpected %s", value.Kind)
+	}
+	return node, nil
+}
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKey(name string) string {
+	if bareTOMLKey.MatchString(name) {
+		return name
+	}
+	return tomlString(name)
+}
+
+// A toml basic string
+func tomlString(value string) string {
+	out := &strings.Builder{}
+	out.WriteString(`"`)
+	for _, c := range value {
+		switch {
+		case c == '"' || c == '\\':
+			out.WriteString(`\` + string(c))
+		case c == '\n':
+			out.WriteString(`\n`)
+		case c == '\t':
+			out.WriteString(`\t`)
+		case c == '\r':
+			out.WriteString(`\r`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(out, `\u%04X`, c)
+		default:
+			out.WriteRune(c)
+		}
+	}
+	out.WriteString(`"`)
+	return out.String()
+}
+
+/*
+The node as toml. Objects become [tables] and arrays of objects [[arrays of tables]], everything
+else is written inline. toml has no null, null fields are left out.
+*/
+func writeTOMLConfig(node *configNode) ([]byte, error) {
+	if node.kind != objectNode {
+		return nil, fmt.Errorf("toml files have to be a table at the top, not a %s", node.kind)
+	}
+	out := &bytes.Buffer{}
+	if err := writeTOMLTable(out, node, nil); err != nil {
+		return nil, err
+	}
+	return bytes.TrimLeft(out.Bytes(), "\n"), nil
+}
+
+// Whether the value is written as its own table(s) rather than inline
+func isTOMLTable(node *configNode) bool {
+	if node.kind == objectNode {
+		return true
+	}
+	if node.kind != arrayNode || len(node.items) == 0 {
+		return false
+	}
+	for _, item := range node.items {
+		if item.kind != objectNode {
+			return false
+		}
+	}
+	return true
+}
+
+func writeTOMLTable(out *bytes.Buffer, node *configNode, path []string) error {
+	// The key/values have to come before any table, or they'd land in it
+	for _, field := range node.fields {
+		if field.value.kind == nullNode || isTOMLTable(field.value) {
+			continue
+		}
+		value, err := tomlInline(field.value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s = %s\n", tomlKey(field.name), value)
+	}
+
+	for _, field := range node.fields {
+		if !isTOMLTable(field.value) {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), tomlKey(field.name))
+		header := strings.Join(fieldPath, ".")
+
+		if field.value.kind == objectNode {
+			fmt.Fprintf(out, "\n[%s]\n", header)
+			if err := writeTOMLTable(out, field.value, fieldPath); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, item := range field.value.items {
+			fmt.Fprintf(out, "\n[[%s]]\n", header)
+			if err := writeTOMLTable(out, item, fieldPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A value written inline, objects as inline tables
+func tomlInline(node *configNode) (string, error) {
+	switch node.kind {
+	case objectNode:
+		parts := []string{}
+		for _, field := range node.fields {
+			if field.value.kind == nullNode {
+				continue
+			}
+			value, err := tomlInline(field.value)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, tomlKey(field.name)+" = "+value)
+		}
+		if len(parts) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", nil
+	case arrayNode:
+		parts := []string{}
+		for _, item := range node.items {
+			if item.kind == nullNode {
+				return "", fmt.Errorf("toml arrays can't have nulls in them")
+			}
+			value, err := tomlInline(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, value)
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	case stringNode:
+		return tomlString(node.text), nil
+	case numberNode:
+		number, err := numberText(node.text)
+		if err != nil {
+			return "", err
+		}
+		return number, nil
+	case boolNode:
+		return node.text, nil
+	default:
+		return "", fmt.Errorf("toml has no null")
+	}
+}
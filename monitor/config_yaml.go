@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yaml's errors only say where they are in their message
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func readYAMLConfig(filename string, contents []byte) (*configNode, error) {
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(contents, document); err != nil {
+		line := 1
+		message := err.Error()
+		if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			message = message[len(match[0]):]
+		}
+		return nil, ConfigErrors{{Filename: filename, Line: line, Column: 1, Message: message}}
+	}
+
+	// An empty file
+	if len(document.Content) == 0 {
+		return &configNode{kind: objectNode, line: 1, column: 1}, nil
+	}
+
+	root, err := yamlNode(document.Content[0])
+	if err != nil {
+		return nil, ConfigErrors{{Filename: filename, Line: document.Content[0].Line, Column: document.Content[0].Column, Message: err.Error()}}
+	}
+	return root, nil
+}
+
+func yamlNode(node *yaml.Node) (*configNode, error) {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	converted := &configNode{line: node.Line, column: node.Column}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		converted.kind = objectNode
+		merged := []configField{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			// Merge keys (<<: *defaults) bring in the fields that aren't set here
+			if key.Tag == "!!merge" {
+				fields, err := yamlMerge(value)
+				if err != nil {
+					return nil, err
+				}
+				merged = append(merged, fields...)
+				continue
+			}
+
+			convertedValue, err := yamlNode(value)
+			if err != nil {
+				return nil, err
+			}
+			converted.fields = append(converted.fields, configField{name: key.Value, line: key.Line, column: key.Column, value: convertedValue})
+		}
+		for _, field := range merged {
+			if converted.field(field.name) == nil {
+				converted.fields = append(converted.fields, field)
+			}
+		}
+	case yaml.SequenceNode:
+		converted.kind = arrayNode
+		for _, item := range node.Content {
+			convertedItem, err := yamlNode(item)
+			if err != nil {
+				return nil, err
+			}
+			converted.items = append(converted.items, convertedItem)
+		}
+	case yaml.ScalarNode:
+		converted.text = node.Value
+		switch node.ShortTag() {
+		case "!!int", "!!float":
+			converted.kind = numberNode
+		case "!!bool":
+			converted.kind = boolNode
+			value, err := strconv.ParseBool(node.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%q isn't true or false", node.Value)
+			}
+			converted.text = strconv.FormatBool(value)
+		case "!!null":
+			converted.kind = nullNode
+		default:
+			converted.kind = stringNode
+		}
+	default:
+		return nil, fmt.Errorf("unexpected yaml")
+	}
+
+	return converted, nil
+}
+
+// The fields a merge key brings in, from one mapping or a list of them (earlier ones win)
+func yamlMerge(value *yaml.Node) ([]configField, error) {
+	sources := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		sources = value.Content
+	}
+
+	fields := []configField{}
+	for _, source := range sources {
+		merged, err := yamlNode(source)
+		if err != nil {
+			return nil, err
+		}
+		if merged.kind != objectNode {
+			return nil, fmt.Errorf("only mappings can be merged with <<")
+		}
+		fields = append(fields, merged.fields...)
+	}
+	return fields, nil
+}
+
+// The node as yaml
+func writeYAMLConfig(node *configNode) ([]byte, error) {
+	converted, err := toYAMLNode(node)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(converted); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func toYAMLNode(node *configNode) (*yaml.Node, error) {
+	switch node.kind {
+	case objectNode:
+		converted := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, field := range node.fields {
+			value, err := toYAMLNode(field.value)
+			if err != nil {
+				return nil, err
+			}
+			converted.Content = append(converted.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: field.name}, value)
+		}
+		return converted, nil
+	case arrayNode:
+		converted := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range node.items {
+			value, err := toYAMLNode(item)
+			if err != nil {
+				return nil, err
+			}
+			converted.Content = append(converted.Content, value)
+		}
+		return converted, nil
+	case stringNode:
+		// Tagged as a string, yaml quotes it if it would read as something else
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: node.text}, nil
+	case numberNode:
+		number, err := numberText(node.text)
+		if err != nil {
+			return nil, err
+		}
+		tag := "!!int"
+		if _, err := strconv.ParseInt(number, 10, 64); err != nil {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: number}, nil
+	case boolNode:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: node.text}, nil
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+}
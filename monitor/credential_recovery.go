@@ -0,0 +1,149 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"tunny/tun"
+)
+
+// A target waiting on fresh credentials
+type recoveringTarget struct {
+	name string
+	// The target's own, it stops waiting when this is done
+	ctx context.Context
+
+	// Try the target again, called once the login worked
+	retry func()
+	// Called instead of retry when the login doesn't happen
+	giveUp func()
+	// Called instead of either when the target's stopped while it waits
+	stopped func()
+
+	// Closed once the login's over and the target's been handled
+	handled chan struct{}
+}
+
+// Targets waiting on fresh credentials, and whether a login is already going on for them
+type credentialRecovery struct {
+	lock    sync.Mutex
+	waiting []*recoveringTarget
+	running bool
+}
+
+var _recovery = &credentialRecovery{}
+
+type recoveryContextKey struct{}
+
+/*
+The context the credential recovery runs on for targets started with ctx. The login is for every
+target waiting on it, so it can't run on the context of whichever target asked first, stopping
+that one target would call it off for all of them.
+*/
+func withRecoveryContext(ctx context.Context, recovery context.Context) context.Context {
+	return context.WithValue(ctx, recoveryContextKey{}, recovery)
+}
+
+func recoveryContext(ctx context.Context) context.Context {
+	if recovery, ok := ctx.Value(recoveryContextKey{}).(context.Context); ok {
+		return recovery
+	}
+	return ctx
+}
+
+/*
+Queue a target up to be retried once the credentials are sorted out.
+The first target to land here offers the SSO login, any that show up while that is
+going on get retried along with it so there's only ever one login at a time.
+A target that's stopped while it waits is dropped from the queue right away.
+*/
+func (r *credentialRecovery) add(mon MonitoringInteractor, target recoveringTarget) {
+	waiting := &target
+	waiting.handled = make(chan struct{})
+
+	r.lock.Lock()
+	r.waiting = append(r.waiting, waiting)
+	start := !r.running
+	r.running = true
+	r.lock.Unlock()
+
+	go r.dropWhenStopped(waiting)
+	if start {
+		go r.run(recoveryContext(target.ctx), mon)
+	}
+}
+
+func (r *credentialRecovery) dropWhenStopped(target *recoveringTarget) {
+	select {
+	case <-target.handled:
+		return
+	case <-target.ctx.Done():
+	}
+
+	r.lock.Lock()
+	for i, other := range r.waiting {
+		if other == target {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			r.lock.Unlock()
+			target.stopped()
+			return
+		}
+	}
+	// The login's just finished, run handles it
+	r.lock.Unlock()
+}
+
+func (r *credentialRecovery) run(ctx context.Context, mon MonitoringInteractor) {
+	loginErr := r.login(ctx, mon)
+
+	r.lock.Lock()
+	waiting := r.waiting
+	r.waiting = nil
+	r.running = false
+	r.lock.Unlock()
+
+	for _, target := range waiting {
+		close(target.handled)
+		switch {
+		case target.ctx.Err() != nil:
+			target.stopped()
+		case loginErr != nil:
+			mon.ReportFatalError(target.name, "Not retrying: %s", loginErr)
+			target.giveUp()
+		default:
+			mon.ReportInfo(target.name, "Retrying now that the SSO login is done")
+			target.retry()
+		}
+	}
+}
+
+// Offer the SSO device login and wait for the user to finish it
+func (r *credentialRecovery) login(ctx context.Context, mon MonitoringInteractor) error {
+	answer, err := mon.AskForInput("aws", "AWS credentials are missing or expired, run the AWS SSO login? [y/N]")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.ToLower(answer), "y") {
+		return fmt.Errorf("sso login declined")
+	}
+
+	login, err := tun.StartSsoLogin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't start the sso login: %w", err)
+	}
+	mon.ReportSsoLogin(login.VerificationUrl, login.UserCode)
+	defer mon.ReportSsoLogin("", "")
+
+	select {
+	case err := <-login.Done:
+		if err != nil {
+			return fmt.Errorf("sso login failed: %w", err)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	mon.ReportGeneralMessage("SSO login finished")
+	return nil
+}
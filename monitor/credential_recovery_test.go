@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answers the login prompt with whatever's sent on answers
+type promptingMonitor struct {
+	*recordingMonitor
+	asked   chan string
+	answers chan string
+}
+
+func (m *promptingMonitor) AskForInput(targetName string, prompt string) (string, error) {
+	m.asked <- prompt
+	return <-m.answers, nil
+}
+
+func TestCredentialRecoveryOutlivesTheTargetThatStartedIt(t *testing.T) {
+	mon := &promptingMonitor{recordingMonitor: newRecordingMonitor(), asked: make(chan string, 1), answers: make(chan string)}
+	recovery := &credentialRecovery{}
+	root, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+
+	outcomes := make(chan string, 4)
+	waitOn := func(name string) context.CancelFunc {
+		ctx, cancel := context.WithCancel(withRecoveryContext(root, root))
+		recovery.add(mon, recoveringTarget{
+			name:    name,
+			ctx:     ctx,
+			retry:   func() { outcomes <- name + " retried" },
+			giveUp:  func() { outcomes <- name + " gave up" },
+			stopped: func() { outcomes <- name + " stopped" },
+		})
+		return cancel
+	}
+
+	stopFirst := waitOn("first")
+	defer stopFirst()
+	select {
+	case <-mon.asked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the login to be offered")
+	}
+	stopSecond := waitOn("second")
+	defer stopSecond()
+
+	// The target that started the login is stopped while it's being asked about
+	stopFirst()
+	select {
+	case outcome := <-outcomes:
+		if outcome != "first stopped" {
+			t.Fatalf("Expected first to be stopped right away, got %s", outcome)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected first to stop without waiting for the login")
+	}
+
+	// The login goes on for the other one
+	mon.answers <- "n"
+	select {
+	case outcome := <-outcomes:
+		if outcome != "second gave up" {
+			t.Fatalf("Expected second to give up on the declined login, got %s", outcome)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected second to be handled once the login was answered")
+	}
+	if messages := mon.joinedMessages(); !strings.Contains(messages, "second: Not retrying: sso login declined") {
+		t.Errorf("Expected second to give up because the login was declined, got:\n%s", messages)
+	}
+}
@@ -0,0 +1,348 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"time"
+	"tunny/tun"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// How long the doctor waits on anything over the network
+const doctorNetworkTimeout = 10 * time.Second
+
+// One thing the doctor looked at
+type DoctorCheck struct {
+	// The target it's about, empty for the ones that aren't about a target
+	Target string
+	Name   string
+
+	// Nil when it passed
+	Err error
+	// Anything worth showing when it passed, e.g. where the aws cli was found
+	Detail string
+	// What to do about it when it failed
+	Hint string
+}
+
+func (c DoctorCheck) Passed() bool {
+	return c.Err == nil
+}
+
+// Goes through the targets, collecting checks
+type doctor struct {
+	ctx    context.Context
+	mon    MonitoringInteractor
+	checks []DoctorCheck
+}
+
+// Run a check and keep the result, returns whether it passed
+func (d *doctor) check(targetName string, name string, hint string, run func() (string, error)) bool {
+	detail, err := run()
+	d.checks = append(d.checks, DoctorCheck{
+		Target: targetName,
+		Name:   name,
+		Err:    err,
+		Detail: detail,
+		Hint:   hint,
+	})
+	return err == nil
+}
+
+/*
+RunDoctor checks everything the targets need before they can start: binaries, credentials,
+keys, local ports and whatever they point at. It goes through the same code as starting
+them does, short of actually starting any tunnels. MFA codes are asked for through mon.
+*/
+func RunDoctor(ctx context.Context, targets []TunnelTarget, mon MonitoringInteractor) []DoctorCheck {
+	d := &doctor{ctx: ctx, mon: mon}
+	for _, target := range targets {
+		d.examine(target)
+	}
+	return d.checks
+}
+
+func (d *doctor) examine(target TunnelTarget) {
+	if hasSecrets(target) {
+		var resolved TunnelTarget
+		ok := d.check(target.Name, "secrets", "Check the ${file:...} and ${aws-secretsmanager:...} references can be read", func() (string, error) {
+			var err error
+			resolved, err = ResolveSecrets(d.ctx, target)
+			return "", err
+		})
+		if !ok {
+			return
+		}
+		target = resolved
+	}
+
+	transports := target.transports()
+	if len(transports) == 0 {
+		d.check(target.Name, "config", "Give it one of ssm_config, eb_ssm_config, ssh_config, ecs_config, k8s_config or command_config", func() (string, error) {
+			return "", fmt.Errorf("no way of reaching it is configured")
+		})
+		return
+	}
+
+	checkedPorts := make(map[string]bool)
+	for _, transport := range transports {
+		prefix := ""
+		if len(transports) > 1 {
+			prefix = transport.Name + ": "
+		}
+		transportTarget := target.via(transport)
+
+		for _, port := range transportTarget.localPorts() {
+			if checkedPorts[port] {
+				continue
+			}
+			checkedPorts[port] = true
+			d.check(target.Name, fmt.Sprintf("local port %s is free", port),
+				"Stop whatever is listening on it (lsof -i :"+port+") or pick another local_port",
+				func() (string, error) {
+					if conflict := checkPort(PortUse{User: target.Name, Port: port}); conflict != nil {
+						return "", conflict
+					}
+					return "", nil
+				})
+		}
+
+		switch {
+		case transport.SsmConfig != nil:
+			d.examineAws(target.Name, prefix, transport.SsmConfig.AwsConfig, true)
+		case transport.EbSsmConfig != nil:
+			d.examineEb(transportTarget, prefix)
+		case transport.EcsConfig != nil:
+			d.examineEcs(transportTarget, prefix)
+		case transport.SshConfig != nil:
+			d.examineSsh(transportTarget, prefix)
+		case transport.K8sConfig != nil:
+			d.examineK8s(transportTarget, prefix)
+		case transport.CommandConfig != nil:
+			d.examineCommand(transportTarget, prefix)
+		}
+	}
+}
+
+// Every local port the target listens on
+func (t TunnelTarget) localPorts() []string {
+	ports := []string{}
+	if port := t.localPort(); port != "" {
+		ports = append(ports, port)
+	}
+	if t.SshConfig != nil {
+		for _, forward := range t.SshConfig.Forwards {
+			if forward.LocalPort != "" {
+				ports = append(ports, forward.LocalPort)
+			}
+		}
+		if t.SshConfig.SocksPort != "" {
+			ports = append(ports, t.SshConfig.SocksPort)
+		}
+	}
+	return ports
+}
+
+/*
+Check the aws cli and plugin (when sessions are started with them) and the credentials.
+The credentials are handed back for further checks, ok is false if they don't work.
+*/
+func (d *doctor) examineAws(
+	targetName string,
+	prefix string,
+	awsConfig AwsConfig,
+	usesCli bool) (creds *credentials.Credentials, spec tun.AssumeRoleSpec, ok bool) {
+	overrides := awsConfig.overrides()
+
+	if usesCli {
+		d.check(targetName, prefix+"aws cli",
+			"Install the AWS CLI v2 (https://docs.aws.amazon.com/cli/latest/userguide/getting-started-install.html), or point aws_cli_path or TUNNY_AWS_CLI at it",
+			func() (string, error) { return tun.FindAwsCli(overrides) })
+		d.check(targetName, prefix+"session-manager-plugin",
+			"Install the Session Manager plugin (https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html), or point session_manager_plugin_path or TUNNY_SESSION_MANAGER_PLUGIN at it",
+			func() (string, error) { return tun.FindSessionManagerPlugin(overrides) })
+	}
+
+	arn, err := func() (string, error) {
+		var err error
+		creds, spec, err = getTargetCredentials(targetName, awsConfig, d.mon)
+		if err != nil {
+			return "", err
+		}
+
+		ctx, cancel := context.WithTimeout(d.ctx, doctorNetworkTimeout)
+		defer cancel()
+		return tun.CheckAwsCredentials(ctx, creds, overrides)
+	}()
+
+	hint := "Check role_arn, and that your own credentials are allowed to assume it"
+	if tun.IsCredentialsError(err) {
+		hint = "Log in again (aws sso login, or refresh your access keys) and rerun the doctor"
+	}
+	ok = d.check(targetName, prefix+"aws credentials", hint, func() (string, error) { return arn, err })
+
+	return creds, spec, ok
+}
+
+func (d *doctor) examineEb(target TunnelTarget, prefix string) {
+	ebConfig := target.EbSsmConfig
+	creds, _, ok := d.examineAws(target.Name, prefix, ebConfig.AwsConfig, true)
+	if !ok {
+		return
+	}
+
+	d.check(target.Name, prefix+"beanstalk environment "+ebConfig.EnvironmentName,
+		"Check environment_name, application_name and region, and that the environment has a running instance",
+		func() (string, error) {
+			ctx, cancel := context.WithTimeout(d.ctx, doctorNetworkTimeout)
+			defer cancel()
+			env, err := resolveBeanstalkTarget(ctx, target.Name, ebConfig, creds, d.mon)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %s", env.InstanceId, env.Describe()), nil
+		})
+}
+
+func (d *doctor) examineEcs(target TunnelTarget, prefix string) {
+	ecsConfig := target.EcsConfig
+	creds, _, ok := d.examineAws(target.Name, prefix, ecsConfig.AwsConfig, true)
+	if !ok {
+		return
+	}
+
+	d.check(target.Name, prefix+"ecs service "+ecsConfig.Service,
+		"Check cluster, service and container, the service needs a running task with ECS Exec turned on",
+		func() (string, error) {
+			region := ecsConfig.Region
+			if region == "" {
+				region = tun.DefaultRegion()
+			}
+			ctx, cancel := context.WithTimeout(d.ctx, doctorNetworkTimeout)
+			defer cancel()
+			task, err := tun.ResolveEcsTarget(ctx, region, creds, ecsConfig.overrides(), ecsConfig.Cluster, ecsConfig.Service, ecsConfig.Container)
+			if err != nil {
+				return "", err
+			}
+			return task.TaskArn, nil
+		})
+}
+
+func (d *doctor) examineSsh(target TunnelTarget, prefix string) {
+	sshConfig := target.SshConfig
+
+	if sshConfig.OverSsm != nil {
+		d.examineAws(target.Name, prefix+"over_ssm ", sshConfig.OverSsm.AwsConfig, true)
+	}
+
+	d.check(target.Name, prefix+"ssh key and known_hosts",
+		"Check key_path points at an unencrypted private key, and that the host is in known_hosts (ssh-keyscan -H host >> ~/.ssh/known_hosts)",
+		func() (string, error) {
+			_, err := sshClientConfig(target, d.mon)
+			return "", err
+		})
+
+	if sshConfig.OverSsm == nil {
+		d.check(target.Name, prefix+"ssh server "+sshConfig.Host+" is reachable",
+			"Check host, and that you're on a network (or vpn) that can reach it",
+			func() (string, error) {
+				dialer := &net.Dialer{Timeout: doctorNetworkTimeout}
+				conn, err := dialer.DialContext(d.ctx, "tcp", sshConfig.Host)
+				if err != nil {
+					return "", err
+				}
+				return "", conn.Close()
+			})
+	}
+}
+
+func (d *doctor) examineK8s(target TunnelTarget, prefix string) {
+	k8sConfig := target.K8sConfig
+
+	var cluster *tun.K8sCluster
+	ok := d.check(target.Name, prefix+"kubeconfig",
+		"Check kubeconfig and context, kubectl config get-contexts lists what's there",
+		func() (string, error) {
+			var err error
+			cluster, err = tun.LoadK8sCluster(k8sConfig.Kubeconfig, k8sConfig.Context)
+			if err != nil {
+				return "", err
+			}
+			return cluster.Config.Host, nil
+		})
+	if !ok {
+		return
+	}
+
+	d.check(target.Name, prefix+"pod to forward to",
+		"Check namespace, the selector and remote_port, kubectl get pods should show a running pod for them",
+		func() (string, error) {
+			selector, err := k8sSelector(k8sConfig)
+			if err != nil {
+				return "", err
+			}
+			ctx, cancel := context.WithTimeout(d.ctx, doctorNetworkTimeout)
+			defer cancel()
+			pod, err := cluster.ResolveK8sPod(ctx, k8sConfig.Namespace, selector, k8sConfig.RemotePort)
+			if err != nil {
+				return "", err
+			}
+			return pod.String(), nil
+		})
+}
+
+func (d *doctor) examineCommand(target TunnelTarget, prefix string) {
+	var tunnel tun.CommandTunnel
+	ok := d.check(target.Name, prefix+"command config",
+		"Check the templates in command and env, and ready_pattern",
+		func() (string, error) {
+			var err error
+			tunnel, err = commandTunnel(target)
+			return "", err
+		})
+	if !ok {
+		return
+	}
+
+	d.check(target.Name, prefix+"command "+tunnel.Args[0],
+		"Install it, or put its full path in command",
+		func() (string, error) { return exec.LookPath(tunnel.Args[0]) })
+}
+
+// Print the checks grouped by target, returns how many failed
+func WriteDoctorReport(w io.Writer, checks []DoctorCheck) int {
+	failed := 0
+	lastTarget := "\x00"
+	for _, check := range checks {
+		if check.Target != lastTarget {
+			lastTarget = check.Target
+			if check.Target == "" {
+				fmt.Fprintf(w, "tunny:\n")
+			} else {
+				fmt.Fprintf(w, "%s:\n", check.Target)
+			}
+		}
+
+		if check.Passed() {
+			if check.Detail != "" {
+				fmt.Fprintf(w, "  [PASS] %s (%s)\n", check.Name, check.Detail)
+			} else {
+				fmt.Fprintf(w, "  [PASS] %s\n", check.Name)
+			}
+			continue
+		}
+
+		failed++
+		fmt.Fprintf(w, "  [FAIL] %s: %s\n", check.Name, check.Err)
+		if check.Hint != "" {
+			fmt.Fprintf(w, "         -> %s\n", check.Hint)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d checks, %d failed\n", len(checks), failed)
+	return failed
+}
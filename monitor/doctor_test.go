@@ -0,0 +1,56 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDoctorReport(t *testing.T) {
+	taken, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer taken.Close()
+	_, takenPort, _ := net.SplitHostPort(taken.Addr().String())
+
+	targets := []TunnelTarget{
+		{
+			Name: "iap",
+			Transport: Transport{CommandConfig: &CommandConfig{
+				RemoteSpec: RemoteSpec{LocalPort: takenPort},
+				Command:    []string{"definitely-not-a-tunnel-cli", "--port", "{{.LocalPort}}"},
+			}},
+		},
+		{
+			Name: "shell",
+			Transport: Transport{CommandConfig: &CommandConfig{
+				Command: []string{"sh", "-c", "sleep 100"},
+			}},
+		},
+		{Name: "empty"},
+	}
+
+	checks := RunDoctor(context.Background(), targets, newRecordingMonitor())
+
+	out := &bytes.Buffer{}
+	failed := WriteDoctorReport(out, checks)
+	report := out.String()
+
+	if failed != 3 {
+		t.Errorf("Expected 3 failures, got %d:\n%s", failed, report)
+	}
+	for _, expected := range []string{
+		"[FAIL] local port " + takenPort + " is free",
+		"-> Stop whatever is listening on it",
+		"[FAIL] command definitely-not-a-tunnel-cli",
+		"[PASS] command sh",
+		"[FAIL] config: no way of reaching it is configured",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected %q in the report:\n%s", expected, report)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Which targets to run, by name or by group. An empty selection is all of them.
+type TargetSelection struct {
+	Names  []string `json:"names,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func (s TargetSelection) Empty() bool {
+	return len(s.Names) == 0 && len(s.Groups) == 0
+}
+
+// Whether the target is one of the names or in one of the groups
+func (s TargetSelection) Matches(target TunnelTarget) bool {
+	if s.Empty() {
+		return true
+	}
+	for _, name := range s.Names {
+		if name == target.Name {
+			return true
+		}
+	}
+	for _, group := range s.Groups {
+		if target.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t TunnelTarget) InGroup(group string) bool {
+	for _, in := range t.Groups {
+		if in == group {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+The names of the targets the selection picks, in the order they're in. Names and groups that
+none of the targets have are an error, they're probably typos.
+*/
+func (s TargetSelection) Pick(targets []TunnelTarget) ([]string, error) {
+	unknown := []string{}
+	for _, name := range s.Names {
+		found := false
+		for _, target := range targets {
+			found = found || target.Name == name
+		}
+		if !found {
+			unknown = append(unknown, fmt.Sprintf("no target named %s", name))
+		}
+	}
+	for _, group := range s.Groups {
+		found := false
+		for _, target := range targets {
+			found = found || target.InGroup(group)
+		}
+		if !found {
+			unknown = append(unknown, fmt.Sprintf("no targets in group %s (there's %s)", group, strings.Join(orNone(TargetGroups(targets)), ", ")))
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(unknown, "\n"))
+	}
+
+	picked := []string{}
+	for _, target := range targets {
+		if s.Matches(target) {
+			picked = append(picked, target.Name)
+		}
+	}
+	return picked, nil
+}
+
+// Every group the targets are in, sorted
+func TargetGroups(targets []TunnelTarget) []string {
+	seen := make(map[string]bool)
+	groups := []string{}
+	for _, target := range targets {
+		for _, group := range target.Groups {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func orNone(list []string) []string {
+	if len(list) == 0 {
+		return []string{"none"}
+	}
+	return list
+}
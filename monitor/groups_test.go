@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTargetSelectionPick(t *testing.T) {
+	targets := []TunnelTarget{
+		{Name: "db-main", Groups: []string{"staging", "db"}},
+		{Name: "api-cache", Groups: []string{"staging"}},
+		{Name: "prod-db", Groups: []string{"prod", "db"}},
+		{Name: "loner"},
+	}
+
+	cases := []struct {
+		selection TargetSelection
+		expected  string
+	}{
+		{TargetSelection{}, "db-main,api-cache,prod-db,loner"},
+		{TargetSelection{Groups: []string{"staging"}}, "db-main,api-cache"},
+		{TargetSelection{Groups: []string{"db"}, Names: []string{"loner"}}, "db-main,prod-db,loner"},
+		{TargetSelection{Names: []string{"api-cache", "db-main"}}, "db-main,api-cache"},
+	}
+	for _, c := range cases {
+		picked, err := c.selection.Pick(targets)
+		if err != nil || strings.Join(picked, ",") != c.expected {
+			t.Errorf("Expected %+v to pick %s, got %v (%v)", c.selection, c.expected, picked, err)
+		}
+	}
+
+	_, err := TargetSelection{Names: []string{"db-mian"}, Groups: []string{"stagign"}}.Pick(targets)
+	if err == nil || !strings.Contains(err.Error(), "no target named db-mian") ||
+		!strings.Contains(err.Error(), "no targets in group stagign (there's db, prod, staging)") {
+		t.Errorf("Expected the unknown name and group to be reported, got %v", err)
+	}
+}
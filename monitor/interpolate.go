@@ -0,0 +1,349 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"tunny/tun"
+)
+
+/*
+Config strings can have references in them:
+
+	${NAME}                  the environment variable, it has to be set
+	${NAME:-default}         the environment variable, or default when it's unset or empty
+	${source:reference}      a secret, e.g. ${file:~/.secrets/db} or ${aws-secretsmanager:prod/db#password}
+	$${                      a literal ${
+
+and a ~ at the start is the home directory. Environment variables and ~ are expanded when the
+config is loaded, secrets only when a target starts (see ResolveSecrets) so they aren't kept
+around in the config, shown by the web api or logged.
+*/
+
+// Gets a secret's value from what's after the source's name, e.g. the path in ${file:/path}
+type SecretSource func(ctx context.Context, reference string) (string, error)
+
+var (
+	_secretSourcesLock sync.Mutex
+	_secretSources     = map[string]SecretSource{
+		"file":               fileSecret,
+		"aws-secretsmanager": secretsManagerSecret,
+	}
+)
+
+// RegisterSecretSource makes ${name:reference} in the config get its value from source
+func RegisterSecretSource(name string, source SecretSource) {
+	_secretSourcesLock.Lock()
+	defer _secretSourcesLock.Unlock()
+	_secretSources[name] = source
+}
+
+func secretSource(name string) (SecretSource, bool) {
+	_secretSourcesLock.Lock()
+	defer _secretSourcesLock.Unlock()
+	source, ok := _secretSources[name]
+	return source, ok
+}
+
+// The file's contents, without the newline editors leave at the end
+func fileSecret(ctx context.Context, reference string) (string, error) {
+	contents, err := os.ReadFile(expandHome(reference))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// A Secrets Manager secret with the default credentials, see tun.GetSecretString for the reference
+func secretsManagerSecret(ctx context.Context, reference string) (string, error) {
+	return tun.GetSecretString(ctx, tun.DefaultRegion(), nil, tun.AwsOverrides{}, reference)
+}
+
+// A ~ at the start of the path is the home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+var (
+	envReference    = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(:-(.*))?$`)
+	secretReference = regexp.MustCompile(`^([a-z][a-z0-9-]*):(.+)$`)
+)
+
+/*
+Replace each ${...} in s with what expand gives for what's inside it. $${ is left as it is, the
+last pass (secrets) turns it into ${.
+*/
+func expandReferences(s string, unescape bool, expand func(reference string) (string, error)) (string, error) {
+	out := &strings.Builder{}
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "$${"):
+			if unescape {
+				out.WriteString("${")
+			} else {
+				out.WriteString("$${")
+			}
+			i += 3
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("%s has a ${ without a }, $${ is a literal ${", s[i:])
+			}
+			value, err := expand(s[i+2 : i+end])
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += end + 1
+		default:
+			out.WriteByte(s[i])
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+/*
+Expand ~ and environment variables in a config string. Secret references are checked and left
+for ResolveSecrets, and a variable's value that has a ${ in it is escaped so it stays as it is.
+*/
+func interpolateEnv(s string) (string, error) {
+	return expandReferences(expandHome(s), false, func(reference string) (string, error) {
+		if match := envReference.FindStringSubmatch(reference); match != nil {
+			value, set := os.LookupEnv(match[1])
+			if match[2] != "" && value == "" {
+				value = match[3]
+			} else if !set {
+				return "", fmt.Errorf("environment variable %s isn't set, ${%s:-default} gives it a default", match[1], match[1])
+			}
+			return strings.ReplaceAll(value, "${", "$${"), nil
+		}
+
+		if match := secretReference.FindStringSubmatch(reference); match != nil {
+			if _, ok := secretSource(match[1]); !ok {
+				return "", fmt.Errorf("unknown secret source %s in ${%s}, expected one of %s", match[1], reference, strings.Join(secretSourceNames(), ", "))
+			}
+			return "${" + reference + "}", nil
+		}
+		return "", fmt.Errorf("${%s} isn't an environment variable or a secret", reference)
+	})
+}
+
+func secretSourceNames() []string {
+	_secretSourcesLock.Lock()
+	defer _secretSourcesLock.Unlock()
+	names := make([]string, 0, len(_secretSources))
+	for name := range _secretSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Call f with every string in v (a pointer to it, or something holding pointers) by its path with
+json names, e.g. ssm_config.local_port, replacing it with what f gives back when that's different.
+*/
+func mapConfigStrings(v reflect.Value, path string, f func(path string, s string) (string, error)) error {
+	join := func(name string) string {
+		if path == "" || name == "" {
+			return path + name
+		}
+		return path + "." + name
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return mapConfigStrings(v.Elem(), path, f)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || (name == "" && !field.Anonymous) {
+				continue
+			}
+			if err := mapConfigStrings(v.Field(i), join(name), f); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := mapConfigStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), f); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			value, err := f(join(key.String()), v.MapIndex(key).String())
+			if err != nil {
+				return err
+			}
+			if value != v.MapIndex(key).String() {
+				v.SetMapIndex(key, reflect.ValueOf(value).Convert(v.Type().Elem()))
+			}
+		}
+	case reflect.String:
+		value, err := f(path, v.String())
+		if err != nil {
+			return err
+		}
+		if value != v.String() {
+			v.SetString(value)
+		}
+	}
+	return nil
+}
+
+// Expand ~ and environment variables in every string of the targets, problems come back by path
+func interpolateTargets(targets []TunnelTarget) []configProblem {
+	problems := []configProblem{}
+	for i := range targets {
+		// Carry on past a problem so they're all reported
+		mapConfigStrings(reflect.ValueOf(&targets[i]), fmt.Sprintf("tunnels[%d]", i), func(path string, s string) (string, error) {
+			value, err := interpolateEnv(s)
+			if err != nil {
+				problems = append(problems, configProblem{path: path, message: err.Error()})
+				return s, nil
+			}
+			return value, nil
+		})
+	}
+	return problems
+}
+
+/*
+ResolveSecrets gives a copy of the target with its secret references replaced by their values,
+which are redacted from anything tunny shows or logs from then on. It's done every time the
+target starts, so a rotated secret is picked up by a restart.
+*/
+func ResolveSecrets(ctx context.Context, target TunnelTarget) (TunnelTarget, error) {
+	// A deep copy, the configs are shared with the loaded targets
+	contents, err := json.Marshal(target)
+	if err != nil {
+		return target, err
+	}
+	var resolved TunnelTarget
+	if err := json.Unmarshal(contents, &resolved); err != nil {
+		return target, err
+	}
+
+	err = mapConfigStrings(reflect.ValueOf(&resolved), "", func(path string, s string) (string, error) {
+		return expandReferences(s, true, func(reference string) (string, error) {
+			match := secretReference.FindStringSubmatch(reference)
+			if match == nil {
+				return "", fmt.Errorf("%s: ${%s} isn't a secret", path, reference)
+			}
+			source, ok := secretSource(match[1])
+			if !ok {
+				return "", fmt.Errorf("%s: unknown secret source %s", path, match[1])
+			}
+			value, err := source(ctx, match[2])
+			if err != nil {
+				return "", fmt.Errorf("%s: error getting ${%s}: %w", path, reference, err)
+			}
+			_redactor.add(value)
+			return value, nil
+		})
+	})
+	if err != nil {
+		return target, err
+	}
+	return resolved, nil
+}
+
+// Whether any of the target's strings has a secret reference in it
+func hasSecrets(target TunnelTarget) bool {
+	found := false
+	mapConfigStrings(reflect.ValueOf(target), "", func(path string, s string) (string, error) {
+		expandReferences(s, true, func(reference string) (string, error) {
+			found = true
+			return "", nil
+		})
+		return s, nil
+	})
+	return found
+}
+
+// Secrets shorter than this aren't redacted, they'd blank out too much of everything else
+const minRedactedLength = 4
+
+// Every secret that's been resolved, to keep them out of what's shown and logged
+type secretRedactor struct {
+	lock    sync.Mutex
+	secrets map[string]bool
+	// Longest first, so a secret that has another in it is redacted whole
+	replacer *strings.Replacer
+}
+
+var _redactor = &secretRedactor{secrets: make(map[string]bool)}
+
+func (r *secretRedactor) add(secret string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(secret) < minRedactedLength || r.secrets[secret] {
+		return
+	}
+	r.secrets[secret] = true
+
+	secrets := make([]string, 0, len(r.secrets))
+	for secret := range r.secrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, "[redacted]")
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces any secret that's been resolved from the config with [redacted]
+func Redact(s string) string {
+	_redactor.lock.Lock()
+	replacer := _redactor.replacer
+	_redactor.lock.Unlock()
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+// RedactingWriter redacts secrets from what's written through it, e.g. for the log
+func RedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w: w}
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,111 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("TUNNY_TEST_HOST", "db.internal")
+	t.Setenv("TUNNY_TEST_EMPTY", "")
+	t.Setenv("TUNNY_TEST_BRACES", "a${b}")
+	home, _ := os.UserHomeDir()
+
+	cases := []struct {
+		in       string
+		expected string
+	}{
+		{"${TUNNY_TEST_HOST}", "db.internal"},
+		{"${TUNNY_TEST_HOST}:5432", "db.internal:5432"},
+		{"${TUNNY_TEST_UNSET:-bastion}", "bastion"},
+		{"${TUNNY_TEST_EMPTY:-bastion}", "bastion"},
+		{"${TUNNY_TEST_EMPTY}", ""},
+		{"${TUNNY_TEST_BRACES}", "a$${b}"},
+		{"~/.ssh/id_rsa", filepath.Join(home, ".ssh/id_rsa")},
+		{"not~/home", "not~/home"},
+		{"${file:~/secret}", "${file:~/secret}"},
+		{"echo $${HOME}", "echo $${HOME}"},
+	}
+	for _, c := range cases {
+		out, err := interpolateEnv(c.in)
+		if err != nil || out != c.expected {
+			t.Errorf("Expected %q to be %q, got %q (%v)", c.in, c.expected, out, err)
+		}
+	}
+
+	for _, bad := range []string{"${TUNNY_TEST_UNSET}", "${vault:db}", "${not closed", "${1BAD}"} {
+		if out, err := interpolateEnv(bad); err == nil {
+			t.Errorf("Expected %q to be an error, got %q", bad, out)
+		}
+	}
+}
+
+func TestParseTunnelTargetsInterpolates(t *testing.T) {
+	t.Setenv("TUNNY_TEST_INSTANCE", "i-123")
+	config := `{"tunnels": [
+	{"name": "db", "ssm_config": {"local_port": "${TUNNY_TEST_PORT:-5432}", "remote_port": "5432",
+		"instance_name": "${TUNNY_TEST_INSTANCE}", "role_arn": "${aws-secretsmanager:role}"}},
+	{"name": "other", "k8s_config": {"local_port": "1", "remote_port": "1", "service": "${TUNNY_TEST_UNSET}"}}
+]}`
+
+	_, err := ParseTunnelTargets("tunny.json", []byte(config))
+	if err == nil || !strings.Contains(err.Error(), "tunny.json:4:85: tunnels[1].k8s_config.service: environment variable TUNNY_TEST_UNSET isn't set") {
+		t.Fatalf("Expected the unset variable to be reported, got %v", err)
+	}
+
+	targets, err := ParseTunnelTargets("tunny.json", []byte(strings.Replace(config, "${TUNNY_TEST_UNSET}", "api", 1)))
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	ssm := targets[0].SsmConfig
+	if ssm.LocalPort != "5432" || ssm.InstanceName != "i-123" || ssm.RoleArn != "${aws-secretsmanager:role}" {
+		t.Errorf("Unexpected config %+v", ssm)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("hunter2-from-a-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	RegisterSecretSource("test-vault", func(ctx context.Context, reference string) (string, error) {
+		if reference == "missing" {
+			return "", fmt.Errorf("no such secret")
+		}
+		return "vault-" + reference, nil
+	})
+
+	target := TunnelTarget{Name: "db", Transport: Transport{CommandConfig: &CommandConfig{
+		RemoteSpec: RemoteSpec{LocalPort: "1"},
+		Command:    []string{"connect", "--password=${file:" + filepath.Join(dir, "password") + "}", "echo $${HOME}"},
+		Env:        map[string]string{"TOKEN": "${test-vault:token}"},
+	}}}
+	if !hasSecrets(target) {
+		t.Errorf("Expected the target to have secrets")
+	}
+
+	resolved, err := ResolveSecrets(context.Background(), target)
+	if err != nil {
+		t.Fatalf("Error resolving: %s", err)
+	}
+	command := resolved.CommandConfig
+	if command.Command[1] != "--password=hunter2-from-a-file" || command.Command[2] != "echo ${HOME}" || command.Env["TOKEN"] != "vault-token" {
+		t.Errorf("Unexpected resolved config %+v", command)
+	}
+	if target.CommandConfig.Env["TOKEN"] != "${test-vault:token}" {
+		t.Errorf("Expected the original target to be left alone, got %+v", target.CommandConfig)
+	}
+
+	if redacted := Redact("logged in with hunter2-from-a-file and vault-token"); redacted != "logged in with [redacted] and [redacted]" {
+		t.Errorf("Unexpected redaction %q", redacted)
+	}
+
+	target.CommandConfig.Env["TOKEN"] = "${test-vault:missing}"
+	if _, err := ResolveSecrets(context.Background(), target); err == nil || !strings.Contains(err.Error(), "command_config.env.TOKEN: error getting ${test-vault:missing}: no such secret") {
+		t.Errorf("Expected the missing secret to be an error, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"tunny/tun"
+)
+
+// What the k8s config says to forward to
+func k8sSelector(k8sConfig *K8sConfig) (tun.K8sSelector, error) {
+	selector := tun.K8sSelector{
+		Pod:        k8sConfig.Pod,
+		Deployment: k8sConfig.Deployment,
+		Service:    k8sConfig.Service,
+		Selector:   k8sConfig.Selector,
+	}
+
+	set := 0
+	for _, picked := range []string{selector.Pod, selector.Deployment, selector.Service, selector.Selector} {
+		if picked != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return selector, fmt.Errorf("exactly one of pod, deployment, service or selector is needed, got %d", set)
+	}
+
+	return selector, nil
+}
+
+// Pick a pod for a k8s target and forward to it through the api server
+func startK8sTarget(
+	topCtx context.Context,
+	target TunnelTarget,
+	mon MonitoringInteractor,
+	onReady func()) (<-chan error, error) {
+	k8sConfig := target.K8sConfig
+
+	selector, err := k8sSelector(k8sConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := tun.LoadK8sCluster(k8sConfig.Kubeconfig, k8sConfig.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	pod, err := cluster.ResolveK8sPod(topCtx, k8sConfig.Namespace, selector, k8sConfig.RemotePort)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding a pod for %s: %w", selector, err)
+	}
+
+	eventual, err := cluster.StartK8sPortForward(topCtx, pod, k8sConfig.LocalPort, &tun.K8sForwardOptions{
+		OnOutput: func(stream tun.OutputStream, line string) {
+			reportOutputLine(target.Name, mon, stream, line)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error starting port forward: %w", err)
+	}
+
+	mon.ReportInfo(target.Name, "Started port forward (from %s) to %s", selector, pod)
+
+	// The local port is listening, so it's ready straight away
+	onReady()
+	return eventual, nil
+}
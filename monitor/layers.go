@@ -0,0 +1,384 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+Where the user's own config is: config.json, .yaml, .yml or .toml in $XDG_CONFIG_HOME/tunny, or
+~/.config/tunny. Empty when there isn't one.
+*/
+func UserConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+		path := filepath.Join(dir, "tunny", "config"+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// A config put together from the user's config, the project's and whatever they include
+type LoadedConfig struct {
+	Targets []TunnelTarget
+
+	// Every file it came from, in the order they were layered, later ones win
+	Files []string
+
+	// Where local ports left to tunny are picked from, see AssignPorts
+	AutoPortRange string
+
+	// The project config, the others are layered under it
+	filename string
+
+	// The merged config with its templates expanded, where every setting came from
+	root *configNode
+}
+
+/*
+LoadConfig loads the project config at filename layered over the user's config (see
+UserConfigPath). Each file's includes are layered under it, in order, before it.
+
+Later layers win by target name: a target with a new name is added, and one with a name
+that's already there is merged into it. Objects are merged field by field, anything else
+(strings, arrays like command or transports) is replaced, and null removes a setting.
+A target that picks a different kind of config (ssh_config where it was ssm_config) drops
+the one it had.
+*/
+func LoadConfig(filename string) (*LoadedConfig, error) {
+	loader := &configLoader{loaded: make(map[string]bool), loading: make(map[string]bool)}
+	if user := UserConfigPath(); user != "" {
+		if err := loader.load(user, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := loader.load(filename, nil); err != nil {
+		return nil, err
+	}
+	if loader.mismatched {
+		return nil, loader.errs
+	}
+
+	root := &configNode{kind: objectNode, filename: filename, line: 1, column: 1}
+	files := make([]string, 0, len(loader.layers))
+	for _, layer := range loader.layers {
+		mergeConfigLayer(root, layer)
+		files = append(files, layer.filename)
+	}
+
+	parsed, expanded, err := targetsFromConfig(root, loader.errs)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadedConfig{Targets: parsed.Targets, Files: files, AutoPortRange: parsed.AutoPortRange, filename: filename, root: expanded}, nil
+}
+
+// Reads config files and their includes, lowest layer first
+type configLoader struct {
+	layers []*configNode
+	errs   ConfigErrors
+	// Whether a file couldn't be read at all, so there's nothing to go on with
+	mismatched bool
+
+	// By absolute path, the ones done and the ones being done (to catch include loops)
+	loaded  map[string]bool
+	loading map[string]bool
+}
+
+/*
+Load a file and what it includes. Problems with the files' contents are collected, the error
+returned is for the file not being there or readable. includedAt is the include entry the file
+is from, nil for the user and project configs.
+*/
+func (l *configLoader) load(filename string, includedAt *configNode) error {
+	fail := func(err error) error {
+		if includedAt == nil {
+			return err
+		}
+		l.errs = append(l.errs, ConfigError{Filename: includedAt.filename, Line: includedAt.line, Column: includedAt.column,
+			Path: "include", Message: err.Error()})
+		return nil
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return fail(err)
+	}
+	if l.loading[abs] {
+		return fail(fmt.Errorf("%s includes itself", filename))
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loading[abs] = true
+	defer func() {
+		delete(l.loading, abs)
+		l.loaded[abs] = true
+	}()
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return fail(err)
+	}
+	format := ConfigFormatOf(filename)
+	root, err := readConfig(format, filename, contents)
+	if err != nil {
+		if errs, ok := err.(ConfigErrors); ok {
+			l.errs = append(l.errs, errs...)
+			l.mismatched = true
+			return nil
+		}
+		return fail(err)
+	}
+
+	checker := newConfigChecker(format)
+	checker.check(root, tunnelsFileType, "")
+	l.errs = append(l.errs, checker.errs...)
+
+	if include := root.field("include"); include != nil {
+		for _, item := range include.value.items {
+			if item.kind != stringNode {
+				continue
+			}
+			if err := l.load(includePath(filename, item.text), item); err != nil {
+				return err
+			}
+		}
+	}
+
+	l.layers = append(l.layers, root)
+	return nil
+}
+
+// An include's path, ~ is the home directory and relative paths are from the including file
+func includePath(from string, include string) string {
+	if include == "~" || strings.HasPrefix(include, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			include = filepath.Join(home, include[1:])
+		}
+	}
+	if filepath.IsAbs(include) {
+		return include
+	}
+	return filepath.Join(filepath.Dir(from), include)
+}
+
+// Layer a config file's targets, defaults and templates over what's been merged so far
+func mergeConfigLayer(root *configNode, layer *configNode) {
+	// Anything else at the top, like auto_port_range, is replaced
+	for _, field := range layer.fields {
+		if field.name == "tunnels" || field.name == "defaults" || field.name == "templates" || field.name == "include" {
+			continue
+		}
+		if merged := root.field(field.name); merged != nil {
+			*merged = field
+		} else {
+			root.fields = append(root.fields, field)
+		}
+	}
+
+	// Merged like a target's settings, templates by name
+	for _, name := range []string{"defaults", "templates"} {
+		field := layer.field(name)
+		if field == nil {
+			continue
+		}
+		merged := root.field(name)
+		if merged == nil {
+			root.fields = append(root.fields, *field)
+			continue
+		}
+		merged.value = mergeConfigNodes(merged.value, field.value)
+		merged.line, merged.column = field.line, field.column
+	}
+
+	tunnels := layer.field("tunnels")
+	if tunnels == nil || tunnels.value.kind != arrayNode {
+		return
+	}
+
+	merged := root.field("tunnels")
+	if merged == nil {
+		root.fields = append(root.fields, configField{
+			name: "tunnels", line: tunnels.line, column: tunnels.column,
+			value: &configNode{kind: arrayNode, filename: tunnels.value.filename, line: tunnels.value.line, column: tunnels.value.column},
+		})
+		merged = root.field("tunnels")
+	}
+
+	// Only targets from the layers below are overridden, a name used twice in one file is an error
+	below := merged.value.items[:len(merged.value.items):len(merged.value.items)]
+	for _, target := range tunnels.value.items {
+		existing := -1
+		if name := targetNodeName(target); name != "" {
+			for i, other := range below {
+				if targetNodeName(other) == name {
+					existing = i
+				}
+			}
+		}
+
+		if existing < 0 {
+			merged.value.items = append(merged.value.items, target)
+		} else {
+			merged.value.items[existing] = mergeTargetNodes(merged.value.items[existing], target)
+		}
+	}
+}
+
+func targetNodeName(target *configNode) string {
+	if target.kind != objectNode {
+		return ""
+	}
+	if name := target.field("name"); name != nil && name.value.kind == stringNode {
+		return name.value.text
+	}
+	return ""
+}
+
+// The names of the transport configs, a target (and each of its transports) has one
+var transportConfigNames = []string{"ssm_config", "eb_ssm_config", "ssh_config", "ecs_config", "k8s_config", "command_config"}
+
+func isTransportConfigName(name string) bool {
+	for _, config := range transportConfigNames {
+		if name == config {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeTargetNodes(base *configNode, override *configNode) *configNode {
+	if base.kind != objectNode || override.kind != objectNode {
+		return override
+	}
+
+	// Picking a different kind of config replaces the one the target had
+	for _, field := range override.fields {
+		if !isTransportConfigName(field.name) || base.field(field.name) != nil {
+			continue
+		}
+		kept := configNode{kind: objectNode, filename: base.filename, line: base.line, column: base.column}
+		for _, baseField := range base.fields {
+			if !isTransportConfigName(baseField.name) {
+				kept.fields = append(kept.fields, baseField)
+			}
+		}
+		base = &kept
+		break
+	}
+
+	return mergeConfigNodes(base, override)
+}
+
+// Objects are merged field by field, anything else is replaced. A null field removes it.
+func mergeConfigNodes(base *configNode, override *configNode) *configNode {
+	if base.kind != objectNode || override.kind != objectNode {
+		return override
+	}
+
+	merged := &configNode{kind: objectNode, filename: base.filename, line: base.line, column: base.column}
+	merged.fields = append(merged.fields, base.fields...)
+	for _, field := range override.fields {
+		at := -1
+		for i := range merged.fields {
+			if merged.fields[i].name == field.name {
+				at = i
+			}
+		}
+
+		switch {
+		case field.value.kind == nullNode && at >= 0:
+			merged.fields = append(merged.fields[:at], merged.fields[at+1:]...)
+		case field.value.kind == nullNode:
+		case at >= 0:
+			value := mergeConfigNodes(merged.fields[at].value, field.value)
+			merged.fields[at] = configField{name: field.name, line: field.line, column: field.column, value: value}
+		default:
+			merged.fields = append(merged.fields, field)
+		}
+	}
+	return merged
+}
+
+// Write the targets with their templates and defaults expanded, in the format (json, yaml or toml)
+func (c *LoadedConfig) WriteExpanded(w io.Writer, format string) error {
+	contents, err := writeConfig(format, c.root)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(contents)
+	return err
+}
+
+/*
+Write every setting in the config with the file and line it came from, e.g.
+tunnels[0].ssm_config.local_port = "5432"   tunny.json:7:20
+*/
+func (c *LoadedConfig) WriteSources(w io.Writer) error {
+	fmt.Fprintf(w, "Files, later ones win:\n")
+	for _, file := range c.Files {
+		fmt.Fprintf(w, "  %s\n", file)
+	}
+	fmt.Fprintf(w, "\n")
+
+	table := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	if err := writeNodeSources(table, c.root, ""); err != nil {
+		return err
+	}
+	return table.Flush()
+}
+
+func writeNodeSources(w io.Writer, node *configNode, path string) error {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	switch {
+	case node.kind == objectNode && len(node.fields) > 0:
+		for _, field := range node.fields {
+			if err := writeNodeSources(w, field.value, join(field.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case node.kind == arrayNode && len(node.items) > 0 && node.items[0].kind == objectNode:
+		for i, item := range node.items {
+			if err := writeNodeSources(w, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	value, err := writeJSONConfig(node)
+	if err != nil {
+		return err
+	}
+	// Arrays of strings on one line
+	compact := &bytes.Buffer{}
+	if err := json.Compact(compact, value); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s = %s\t%s:%d:%d\n", path, compact, node.filename, node.line, node.column)
+	return err
+}
@@ -0,0 +1,130 @@
+package monitor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, filename string, contents string) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatalf("Error making %s: %s", filepath.Dir(filename), err)
+	}
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatalf("Error writing %s: %s", filename, err)
+	}
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	dir := t.TempDir()
+
+	writeConfigFile(t, filepath.Join(home, "tunny", "config.yaml"), `
+tunnels:
+  - name: db
+    ssm_config:
+      local_port: 5432
+      remote_host: db.internal
+      remote_port: 5432
+      instance_name: bastion
+      role_arn: arn:aws:iam::1:role/personal
+  - name: cache
+    ssh_config: {local_port: 6379, remote_host: cache.internal, remote_port: 6379, host: "bastion:22", username: ec2-user}
+`)
+	writeConfigFile(t, filepath.Join(dir, "shared", "bastions.toml"), `
+[[tunnels]]
+name = "db"
+[tunnels.ssm_config]
+role_arn = "arn:aws:iam::2:role/work"
+instance_name = "work-bastion"
+`)
+	project := filepath.Join(dir, "tunny.json")
+	writeConfigFile(t, project, `{
+	"include": ["shared/bastions.toml"],
+	"tunnels": [
+		{"name": "db", "ssm_config": {"local_port": "15432", "role_arn": null}},
+		{"name": "cache", "k8s_config": {"local_port": "6379", "remote_port": "6379", "service": "cache"}},
+		{"name": "api", "k8s_config": {"local_port": "8080", "remote_port": "http", "service": "api"}}
+	]
+}`)
+
+	config, err := LoadConfig(project)
+	if err != nil {
+		t.Fatalf("Error loading the config: %s", err)
+	}
+
+	expectedFiles := []string{filepath.Join(home, "tunny", "config.yaml"), filepath.Join(dir, "shared", "bastions.toml"), project}
+	if strings.Join(config.Files, ",") != strings.Join(expectedFiles, ",") {
+		t.Errorf("Expected the files %v, got %v", expectedFiles, config.Files)
+	}
+
+	if len(config.Targets) != 3 {
+		t.Fatalf("Expected 3 targets, got %+v", config.Targets)
+	}
+	db := config.Targets[0].SsmConfig
+	if db == nil || db.LocalPort != "15432" || db.InstanceName != "work-bastion" || db.RemoteHost != "db.internal" || db.RoleArn != "" {
+		t.Errorf("Unexpected db config %+v", db)
+	}
+	cache := config.Targets[1]
+	if cache.SshConfig != nil || cache.K8sConfig == nil {
+		t.Errorf("Expected cache to switch to k8s, got %+v", cache)
+	}
+
+	out := &bytes.Buffer{}
+	if err := config.WriteSources(out); err != nil {
+		t.Fatalf("Error writing the sources: %s", err)
+	}
+	for _, expected := range []string{
+		`tunnels[0].ssm_config.local_port = "15432"`,
+		`tunny.json:4`,
+		`tunnels[0].ssm_config.instance_name = "work-bastion"`,
+		`bastions.toml:6`,
+		`tunnels[0].ssm_config.remote_host = "db.internal"`,
+		`config.yaml:7`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out.String(), "role_arn") {
+		t.Errorf("Expected the role to be removed:\n%s", out)
+	}
+}
+
+func TestLoadConfigIncludeProblems(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+
+	writeConfigFile(t, filepath.Join(dir, "a.json"), `{"include": ["b.json"], "tunnels": []}`)
+	writeConfigFile(t, filepath.Join(dir, "b.json"), `{"include": ["a.json", "missing.json"], "tunnels": [{"name": "db"}]}`)
+
+	_, err := LoadConfig(filepath.Join(dir, "a.json"))
+	if err == nil {
+		t.Fatalf("Expected include problems")
+	}
+	for _, expected := range []string{"b.json:1:14: include: ", "a.json includes itself", "b.json:1:24: include: ", "missing.json"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in:\n%s", expected, err)
+		}
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "nope.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing project config to be an error, got %v", err)
+	}
+}
+
+func TestLoadConfigKeepsDuplicatesInOneFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	filename := filepath.Join(t.TempDir(), "tunny.json")
+	writeConfigFile(t, filename, `{"tunnels": [
+		{"name": "db", "k8s_config": {"local_port": "1", "remote_port": "1", "service": "a"}},
+		{"name": "db", "k8s_config": {"local_port": "2", "remote_port": "1", "service": "b"}}
+	]}`)
+
+	if _, err := LoadConfig(filename); err == nil || !strings.Contains(err.Error(), "db") {
+		t.Errorf("Expected the duplicate name to be reported, got %v", err)
+	}
+}
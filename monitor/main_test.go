@@ -0,0 +1,20 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// The processes the tests start are written down in a runtime dir of their own, not a real tunny's
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "tunny-test-runtime")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error making a runtime dir: %s\n", err)
+		os.Exit(1)
+	}
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
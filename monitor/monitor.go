@@ -5,9 +5,22 @@ type MonitoringInteractor interface {
 	ReportError(targetName string, fmt string, args ...any)
 	ReportFatalError(targetName string, fmt string, args ...any)
 
+	// The target can't go on because the AWS credentials are missing or expired
+	ReportCredentialsExpired(targetName string, fmt string, args ...any)
+
 	ReportGeneralMessage(fmt string, args ...any)
 
-	// TODO Ask for input
+	// Change what's known about how a target is doing, the update is applied to the stored status
+	ReportStatus(targetName string, update func(status *TargetStatus))
+
+	// Show where to finish an SSO device login, empty strings mean the login is over
+	ReportSsoLogin(verificationUrl string, userCode string)
+
+	// The set of targets changed, e.g. the config was reloaded
+	ReportTargets(targets []TunnelTarget)
+
+	// Ask the user for a line of input on behalf of a target, blocks until it's answered
+	AskForInput(targetName string, prompt string) (string, error)
 }
 
 type (
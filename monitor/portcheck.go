@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"fmt"
+	"tunny/tun"
+)
+
+// A local port and what needs it, a target's name or e.g. the web monitor
+type PortUse struct {
+	User string
+	Port string
+}
+
+// Every local port the targets listen on, with any of their transports
+func TargetPortUses(targets []TunnelTarget) []PortUse {
+	uses := []PortUse{}
+	for _, target := range targets {
+		seen := make(map[string]bool)
+		for _, transport := range target.transports() {
+			for _, port := range target.via(transport).localPorts() {
+				if !seen[port] {
+					seen[port] = true
+					uses = append(uses, PortUse{User: target.Name, Port: port})
+				}
+			}
+		}
+	}
+	return uses
+}
+
+// A local port that's needed but can't be listened on
+type PortConflict struct {
+	PortUse
+	// What's listening on it, nil when that can't be found out
+	Owner *tun.PortOwner
+	Err   error
+}
+
+func (c PortConflict) Error() string {
+	switch {
+	case c.Owner != nil && c.Owner.IsLeftover():
+		return fmt.Sprintf("port %s for %s is in use by %s, left over from an earlier run", c.Port, c.User, c.Owner)
+	case c.Owner != nil:
+		return fmt.Sprintf("port %s for %s is in use by %s: %s", c.Port, c.User, c.Owner, c.Owner.Command)
+	default:
+		return fmt.Sprintf("port %s for %s can't be used: %s", c.Port, c.User, c.Err)
+	}
+}
+
+// Check whether the port can be listened on, and if not who has it
+func checkPort(use PortUse) *PortConflict {
+	err := tun.CheckLocalPort(use.Port)
+	if err == nil {
+		return nil
+	}
+	// Without an owner the listen error says why
+	owner, _ := tun.FindPortOwner(use.Port)
+	return &PortConflict{PortUse: use, Owner: owner, Err: err}
+}
+
+/*
+FindPortConflicts checks every port can be listened on before anything is started, so a port
+that's in use is reported with who has it rather than by whatever fails to listen on it.
+*/
+func FindPortConflicts(uses []PortUse) []PortConflict {
+	conflicts := []PortConflict{}
+	for _, use := range uses {
+		if conflict := checkPort(use); conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+	return conflicts
+}
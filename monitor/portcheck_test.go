@@ -0,0 +1,59 @@
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestTargetPortUses(t *testing.T) {
+	targets := []TunnelTarget{
+		{Name: "db", Transports: []NamedTransport{
+			{Transport: Transport{K8sConfig: &K8sConfig{LocalPort: "5432"}}},
+			{Transport: Transport{K8sConfig: &K8sConfig{LocalPort: "5433"}}},
+			{Transport: Transport{K8sConfig: &K8sConfig{}}},
+		}},
+		{Name: "api", Transport: Transport{K8sConfig: &K8sConfig{LocalPort: "8081"}}},
+	}
+
+	uses := TargetPortUses(targets)
+	expected := []PortUse{{"db", "5432"}, {"db", "5433"}, {"api", "8081"}}
+	if fmt.Sprint(uses) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, uses)
+	}
+}
+
+func TestFindPortConflicts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+	_, taken, _ := net.SplitHostPort(listener.Addr().String())
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	_, freePort, _ := net.SplitHostPort(free.Addr().String())
+	free.Close()
+
+	conflicts := FindPortConflicts([]PortUse{{"db", taken}, {"api", freePort}})
+	if len(conflicts) != 1 || conflicts[0].User != "db" {
+		t.Fatalf("Expected just db's port to be taken, got %v", conflicts)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if conflicts[0].Owner == nil || conflicts[0].Owner.Pid != os.Getpid() {
+		t.Fatalf("Expected the test to be found as the owner, got %v", conflicts[0].Owner)
+	}
+	want := fmt.Sprintf("port %s for db is in use by %s (pid %d)", taken, conflicts[0].Owner.Name, os.Getpid())
+	if !strings.HasPrefix(conflicts[0].Error(), want) {
+		t.Errorf("Expected %q, got %q", want, conflicts[0].Error())
+	}
+}
@@ -0,0 +1,85 @@
+package monitor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Keeps the statuses and messages so tests can look at them
+type recordingMonitor struct {
+	lock     sync.Mutex
+	statuses map[string]*TargetStatus
+	messages []string
+}
+
+func newRecordingMonitor() *recordingMonitor {
+	return &recordingMonitor{statuses: make(map[string]*TargetStatus)}
+}
+
+func (m *recordingMonitor) record(level string, targetName string, _fmt string, args ...any) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = append(m.messages, fmt.Sprintf("%s %s: %s", level, targetName, fmt.Sprintf(_fmt, args...)))
+}
+
+func (m *recordingMonitor) ReportInfo(targetName string, _fmt string, args ...any) {
+	m.record("info", targetName, _fmt, args...)
+}
+func (m *recordingMonitor) ReportError(targetName string, _fmt string, args ...any) {
+	m.record("error", targetName, _fmt, args...)
+}
+func (m *recordingMonitor) ReportFatalError(targetName string, _fmt string, args ...any) {
+	m.record("fatal", targetName, _fmt, args...)
+}
+func (m *recordingMonitor) ReportCredentialsExpired(targetName string, _fmt string, args ...any) {
+	m.record("auth", targetName, _fmt, args...)
+}
+func (m *recordingMonitor) ReportGeneralMessage(_fmt string, args ...any) {
+	m.record("general", "", _fmt, args...)
+}
+func (m *recordingMonitor) ReportSsoLogin(verificationUrl string, userCode string) {}
+func (m *recordingMonitor) AskForInput(targetName string, prompt string) (string, error) {
+	return "", fmt.Errorf("nobody to ask")
+}
+
+// Removed targets lose their status, the way the dashboard does it
+func (m *recordingMonitor) ReportTargets(targets []TunnelTarget) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keep := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		keep[target.Name] = true
+	}
+	for name := range m.statuses {
+		if !keep[name] {
+			delete(m.statuses, name)
+		}
+	}
+}
+func (m *recordingMonitor) ReportStatus(targetName string, update func(status *TargetStatus)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	status, ok := m.statuses[targetName]
+	if !ok {
+		status = &TargetStatus{}
+		m.statuses[targetName] = status
+	}
+	update(status)
+}
+
+func (m *recordingMonitor) status(targetName string) TargetStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if status, ok := m.statuses[targetName]; ok {
+		return *status
+	}
+	return TargetStatus{}
+}
+
+// Every message so far, a line each
+func (m *recordingMonitor) joinedMessages() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return strings.Join(m.messages, "\n")
+}
@@ -0,0 +1,379 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// Editors write files in bursts, wait for it to settle before reloading
+	reloadSettleTime = 250 * time.Millisecond
+
+	// How long a removed or changed target gets to stop before the new config goes ahead anyway
+	reloadStopTimeout = 10 * time.Second
+)
+
+// What changed between two sets of targets, by name
+type ConfigDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (d ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d ConfigDiff) String() string {
+	if d.Empty() {
+		return "nothing changed"
+	}
+
+	parts := []string{}
+	if len(d.Added) > 0 {
+		parts = append(parts, "started "+strings.Join(d.Added, ", "))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "stopped "+strings.Join(d.Removed, ", "))
+	}
+	if len(d.Changed) > 0 {
+		parts = append(parts, "restarted "+strings.Join(d.Changed, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Compare the targets by name, in the order they're in the configs
+func diffTargets(old []TunnelTarget, new []TunnelTarget) ConfigDiff {
+	diff := ConfigDiff{}
+
+	oldByName := make(map[string]TunnelTarget, len(old))
+	for _, target := range old {
+		oldByName[target.Name] = target
+	}
+	newByName := make(map[string]bool, len(new))
+	for _, target := range new {
+		newByName[target.Name] = true
+	}
+
+	for _, target := range old {
+		if !newByName[target.Name] {
+			diff.Removed = append(diff.Removed, target.Name)
+		}
+	}
+	for _, target := range new {
+		oldTarget, ok := oldByName[target.Name]
+		if !ok {
+			diff.Added = append(diff.Added, target.Name)
+		} else if !reflect.DeepEqual(oldTarget, target) {
+			diff.Changed = append(diff.Changed, target.Name)
+		}
+	}
+
+	return diff
+}
+
+/*
+TargetSet is the targets that are running, which can be swapped for a new set when the config
+changes. Each target gets its own context so it can be stopped without touching the others.
+The waitgroup is held for every target until it's done, like with MakeTargetIntoSomething.
+Targets can also be left stopped (see Select) and started and stopped by name.
+*/
+type TargetSet struct {
+	ctx    context.Context
+	mon    MonitoringInteractor
+	waiter *sync.WaitGroup
+
+	// Only one change at a time
+	lock sync.Mutex
+	// Every target in the config, running or not
+	targets []TunnelTarget
+	// Whether each target should be running, by name
+	wanted  map[string]bool
+	running map[string]*runningTarget
+
+	// Which of the targets that are new to the set get started
+	selection TargetSelection
+}
+
+type runningTarget struct {
+	cancel context.CancelFunc
+	// Done once the target's runner is
+	done *sync.WaitGroup
+	// Closed once the runner is done, e.g. it gave up
+	finished chan struct{}
+}
+
+func NewTargetSet(ctx context.Context, mon MonitoringInteractor, waiter *sync.WaitGroup) *TargetSet {
+	return &TargetSet{ctx: ctx, mon: mon, waiter: waiter, wanted: make(map[string]bool), running: make(map[string]*runningTarget)}
+}
+
+/*
+Select which targets are started when they're first applied (at startup, or added to the config
+later), the rest are left stopped until they're started. All of them by default.
+*/
+func (s *TargetSet) Select(selection TargetSelection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.selection = selection
+}
+
+// The targets that should be running
+func (s *TargetSet) wantedTargets(targets []TunnelTarget) []TunnelTarget {
+	wanted := []TunnelTarget{}
+	for _, target := range targets {
+		if s.wanted[target.Name] {
+			wanted = append(wanted, target)
+		}
+	}
+	return wanted
+}
+
+/*
+Apply makes the running targets match targets: the ones that are new are started, the ones that
+are gone are stopped and the ones whose config changed are stopped and started again. Targets
+whose config is the same are left alone, even if they've failed, and so are ones that were
+stopped. Returns what it did.
+*/
+func (s *TargetSet) Apply(targets []TunnelTarget) ConfigDiff {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	inConfig := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		inConfig[target.Name] = true
+		if _, known := s.wanted[target.Name]; !known {
+			s.wanted[target.Name] = s.selection.Matches(target)
+			if !s.wanted[target.Name] {
+				s.mon.ReportStatus(target.Name, func(status *TargetStatus) {
+					status.State = StateStopped
+				})
+			}
+		}
+	}
+
+	diff := diffTargets(s.wantedTargets(s.targets), s.wantedTargets(targets))
+
+	// Stop first, a changed target probably wants its local port back
+	for _, name := range append(append([]string{}, diff.Removed...), diff.Changed...) {
+		s.stop(name)
+	}
+
+	restart := make(map[string]bool)
+	for _, name := range append(append([]string{}, diff.Added...), diff.Changed...) {
+		restart[name] = true
+	}
+	for _, target := range targets {
+		if restart[target.Name] {
+			s.start(target)
+		}
+	}
+
+	for name := range s.wanted {
+		if !inConfig[name] {
+			delete(s.wanted, name)
+		}
+	}
+	s.targets = targets
+	s.mon.ReportTargets(targets)
+	return diff
+}
+
+/*
+Start the selected targets, the ones that are already running are left alone and the ones that
+gave up are started again. Returns the names of the ones it started.
+*/
+func (s *TargetSet) Start(selection TargetSelection) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := selection.Pick(s.targets); err != nil {
+		return nil, err
+	}
+	started := []string{}
+	for _, target := range s.targets {
+		if !selection.Matches(target) || s.isRunning(target.Name) {
+			continue
+		}
+		// Clear out the runner that gave up, if there is one
+		s.stop(target.Name)
+		s.wanted[target.Name] = true
+		s.start(target)
+		started = append(started, target.Name)
+	}
+	if len(started) > 0 {
+		s.mon.ReportGeneralMessage("Started %s", strings.Join(started, ", "))
+	}
+	return started, nil
+}
+
+// Stop the selected targets, they stay stopped across reloads until they're started
+func (s *TargetSet) Stop(selection TargetSelection) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names, err := selection.Pick(s.targets)
+	if err != nil {
+		return nil, err
+	}
+	stopped := []string{}
+	for _, name := range names {
+		s.wanted[name] = false
+		if s.isRunning(name) {
+			s.stop(name)
+			stopped = append(stopped, name)
+		}
+	}
+	if len(stopped) > 0 {
+		s.mon.ReportGeneralMessage("Stopped %s", strings.Join(stopped, ", "))
+	}
+	return stopped, nil
+}
+
+// Whether the target's runner is going, which includes waiting to restart it
+func (s *TargetSet) isRunning(name string) bool {
+	running, ok := s.running[name]
+	if !ok {
+		return false
+	}
+	select {
+	case <-running.finished:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *TargetSet) start(target TunnelTarget) {
+	ctx, cancel := context.WithCancel(withRecoveryContext(s.ctx, s.ctx))
+	done := &sync.WaitGroup{}
+	done.Add(1)
+	finished := make(chan struct{})
+	s.running[target.Name] = &runningTarget{cancel: cancel, done: done, finished: finished}
+
+	s.waiter.Add(1)
+	go func() {
+		done.Wait()
+		close(finished)
+		cancel()
+		s.waiter.Done()
+	}()
+
+	MakeTargetIntoSomething(ctx, target, s.mon, done)
+}
+
+// Stop a target and wait (for a while) for it to let go of its ports
+func (s *TargetSet) stop(name string) {
+	running, ok := s.running[name]
+	if !ok {
+		return
+	}
+	delete(s.running, name)
+	running.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		running.done.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(reloadStopTimeout):
+		s.mon.ReportError(name, "Still stopping after %s, going ahead with the new config anyway", reloadStopTimeout)
+	}
+}
+
+/*
+WatchConfig reloads the targets from filename whenever it, or a file layered with it (see
+LoadConfig), changes and applies them to the set, until ctx is done. A config that doesn't
+validate is reported and otherwise ignored, the running targets are left as they are until it's
+fixed.
+*/
+func WatchConfig(ctx context.Context, filename string, set *TargetSet, mon MonitoringInteractor) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Editors often replace a file rather than write to it, which a watch on the file itself
+	// doesn't survive, so watch the directories they're in
+	watched := make(map[string]bool)
+	watch := func(files []string) {
+		for _, file := range files {
+			path := filepath.Clean(file)
+			if watched[path] {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(path)); err != nil {
+				mon.ReportGeneralMessage("Not watching %s: %s", file, err)
+				continue
+			}
+			watched[path] = true
+		}
+	}
+	if config, err := LoadConfig(filename); err == nil {
+		watch(config.Files)
+	} else {
+		watch([]string{filename})
+	}
+	if len(watched) == 0 {
+		return fmt.Errorf("couldn't watch %s", filename)
+	}
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if watched[filepath.Clean(event.Name)] && event.Op != fsnotify.Chmod {
+				settle = time.After(reloadSettleTime)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			mon.ReportGeneralMessage("Error watching %s: %s", filename, err)
+		case <-settle:
+			settle = nil
+			watch(reloadConfig(filename, set, mon))
+		}
+	}
+}
+
+// Reload the config and apply it, the files it came from are returned, nil when it wasn't applied
+func reloadConfig(filename string, set *TargetSet, mon MonitoringInteractor) []string {
+	config, err := LoadConfig(filename)
+	if os.IsNotExist(err) {
+		// Probably in the middle of being replaced, there'll be another event when it's back
+		return nil
+	}
+	if err != nil {
+		mon.ReportGeneralMessage("Not reloading %s, keeping the running targets:\n%s", filename, err)
+		return nil
+	}
+	assignments, err := config.AssignPorts()
+	if err != nil {
+		mon.ReportGeneralMessage("Not reloading %s, keeping the running targets: %s", filename, err)
+		return nil
+	}
+	ReportNewPorts(mon, assignments)
+
+	diff := set.Apply(config.Targets)
+	if !diff.Empty() {
+		mon.ReportGeneralMessage("Reloaded %s: %s", filename, diff)
+	}
+	return config.Files
+}
@@ -0,0 +1,224 @@
+//go:build linux
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiffTargets(t *testing.T) {
+	target := func(name string, port string) TunnelTarget {
+		return TunnelTarget{Name: name, Transport: Transport{CommandConfig: &CommandConfig{
+			RemoteSpec: RemoteSpec{LocalPort: port},
+			Command:    []string{"true"},
+		}}}
+	}
+
+	diff := diffTargets(
+		[]TunnelTarget{target("same", "1"), target("gone", "2"), target("moved", "3")},
+		[]TunnelTarget{target("moved", "4"), target("new", "5"), target("same", "1")})
+
+	if diff.String() != "started new; stopped gone; restarted moved" {
+		t.Errorf("Unexpected diff %q", diff)
+	}
+	if !diffTargets([]TunnelTarget{target("same", "1")}, []TunnelTarget{target("same", "1")}).Empty() {
+		t.Errorf("Expected no changes between equal configs")
+	}
+}
+
+// A config of command targets that log their pid to <name>.pids in dir every time they start
+func writeReloadConfig(t *testing.T, filename string, dir string, targets map[string]string) {
+	entries := []string{}
+	for name, port := range targets {
+		entries = append(entries, fmt.Sprintf(`{"name": %q, "command_config": {
+			"local_port": %q,
+			"command": ["sh", "-c", "echo $$ >> {{.Name}}.pids; echo up; exec sleep 100"],
+			"dir": %q,
+			"ready_pattern": "up",
+			"probe_address": "none"
+		}}`, name, port, dir))
+	}
+	contents := fmt.Sprintf(`{"tunnels": [%s]}`, strings.Join(entries, ",\n"))
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+}
+
+func startCount(t *testing.T, dir string, name string) int {
+	contents, err := os.ReadFile(filepath.Join(dir, name+".pids"))
+	if err != nil {
+		return 0
+	}
+	return strings.Count(string(contents), "\n")
+}
+
+func TestWatchConfigAppliesTheDiff(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "tunny.json")
+	writeReloadConfig(t, filename, dir, map[string]string{"keep": "47101", "change": "47102", "remove": "47103"})
+
+	targets, err := GetTunnelTargets(filename)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mon := newRecordingMonitor()
+	waiter := &sync.WaitGroup{}
+
+	set := NewTargetSet(ctx, mon, waiter)
+	set.Apply(targets)
+	watched := make(chan error, 1)
+	go func() { watched <- WatchConfig(ctx, filename, set, mon) }()
+
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				mon.lock.Lock()
+				t.Fatalf("Timed out waiting for %s, messages:\n%s", what, strings.Join(mon.messages, "\n"))
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	for _, name := range []string{"keep", "change", "remove"} {
+		waitFor(name+" to be ready", func() bool { return mon.status(name).State == StateReady })
+	}
+	// Give the watcher a moment to start watching
+	time.Sleep(100 * time.Millisecond)
+
+	// A broken config leaves everything running
+	if err := os.WriteFile(filename, []byte(`{"tunnels": [{"name": "keep", "bogus": 1}]}`), 0644); err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+	waitFor("the broken config to be reported", func() bool {
+		mon.lock.Lock()
+		defer mon.lock.Unlock()
+		return strings.Contains(strings.Join(mon.messages, "\n"), "Not reloading")
+	})
+
+	writeReloadConfig(t, filename, dir, map[string]string{"keep": "47101", "change": "47104", "add": "47105"})
+	waitFor("the reload", func() bool {
+		mon.lock.Lock()
+		defer mon.lock.Unlock()
+		return strings.Contains(strings.Join(mon.messages, "\n"), "Reloaded")
+	})
+	waitFor("add to be ready", func() bool { return mon.status("add").State == StateReady })
+	waitFor("change to be ready", func() bool { return mon.status("change").State == StateReady })
+	// The removed target's last status came before the reload, not after it
+	time.Sleep(100 * time.Millisecond)
+	mon.lock.Lock()
+	_, removedStatus := mon.statuses["remove"]
+	mon.lock.Unlock()
+	if removedStatus {
+		t.Errorf("Expected the removed target to lose its status")
+	}
+
+	mon.lock.Lock()
+	messages := strings.Join(mon.messages, "\n")
+	mon.lock.Unlock()
+	if !strings.Contains(messages, ": started add; stopped remove; restarted change") {
+		t.Errorf("Expected the diff to be reported, got:\n%s", messages)
+	}
+
+	if count := startCount(t, dir, "keep"); count != 1 {
+		t.Errorf("Expected keep to be left alone, it was started %d times", count)
+	}
+	if count := startCount(t, dir, "change"); count != 2 {
+		t.Errorf("Expected change to be restarted once, it was started %d times", count)
+	}
+	if count := startCount(t, dir, "add"); count != 1 {
+		t.Errorf("Expected add to be started once, it was started %d times", count)
+	}
+
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		waiter.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Targets didn't stop after cancelling")
+	}
+	if err := <-watched; err != nil {
+		t.Errorf("Error watching: %s", err)
+	}
+}
+
+func TestTargetSetStartsAndStopsGroups(t *testing.T) {
+	dir := t.TempDir()
+	target := func(name string, port string, groups ...string) TunnelTarget {
+		return TunnelTarget{Name: name, Groups: groups, Transport: Transport{CommandConfig: &CommandConfig{
+			RemoteSpec:   RemoteSpec{LocalPort: port},
+			Command:      []string{"sh", "-c", "echo $$ >> {{.Name}}.pids; echo up; exec sleep 100"},
+			Dir:          dir,
+			ReadyPattern: "up",
+			ProbeAddress: "none",
+		}}}
+	}
+	targets := []TunnelTarget{
+		target("db", "47111", "staging"),
+		target("cache", "47112", "staging"),
+		target("prod", "47113", "prod"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mon := newRecordingMonitor()
+	waiter := &sync.WaitGroup{}
+	set := NewTargetSet(ctx, mon, waiter)
+	set.Select(TargetSelection{Groups: []string{"staging"}})
+	set.Apply(targets)
+
+	waitFor := func(name string, state TargetState) {
+		deadline := time.Now().Add(10 * time.Second)
+		for mon.status(name).State != state {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s to be %s, it's %s", name, state, mon.status(name).State)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor("db", StateReady)
+	waitFor("cache", StateReady)
+	waitFor("prod", StateStopped)
+
+	if stopped, err := set.Stop(TargetSelection{Groups: []string{"staging"}}); err != nil || len(stopped) != 2 {
+		t.Fatalf("Expected staging to be stopped, got %v (%v)", stopped, err)
+	}
+	waitFor("db", StateStopped)
+	waitFor("cache", StateStopped)
+
+	// Stopped targets stay stopped when the config is applied again
+	set.Apply(append(targets, target("new-prod", "47114", "prod")))
+	if started, err := set.Start(TargetSelection{Groups: []string{"prod"}, Names: []string{"db"}}); err != nil || strings.Join(started, ",") != "db,prod,new-prod" {
+		t.Fatalf("Expected db and prod to be started, got %v (%v)", started, err)
+	}
+	waitFor("prod", StateReady)
+	waitFor("new-prod", StateReady)
+	waitFor("db", StateReady)
+	if mon.status("cache").State != StateStopped {
+		t.Errorf("Expected cache to stay stopped, it's %s", mon.status("cache").State)
+	}
+	if count := startCount(t, dir, "db"); count != 2 {
+		t.Errorf("Expected db to be started twice, it was started %d times", count)
+	}
+
+	if _, err := set.Start(TargetSelection{Groups: []string{"nope"}}); err == nil {
+		t.Errorf("Expected an unknown group to be an error")
+	}
+
+	cancel()
+	waiter.Wait()
+}
@@ -1,26 +1,114 @@
 package monitor
 
-import "fmt"
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
 
 type CliMonitor struct {
+	// Only one prompt can own stdin at a time
+	inputLock sync.Mutex
+	stdin     *bufio.Reader
+
+	statusLock sync.Mutex
+	statuses   map[string]*TargetStatus
 }
 
 func (m *CliMonitor) ReportInfo(targetName string, _fmt string, args ...interface{}) {
-	passedFmted := fmt.Sprintf(_fmt, args...)
+	passedFmted := Redact(fmt.Sprintf(_fmt, args...))
 	fmt.Printf("[I %s]: %s\n", targetName, passedFmted)
 }
 
 func (m *CliMonitor) ReportError(targetName string, _fmt string, args ...interface{}) {
-	passedFmted := fmt.Sprintf(_fmt, args...)
+	passedFmted := Redact(fmt.Sprintf(_fmt, args...))
 	fmt.Printf("[E %s]: %s\n", targetName, passedFmted)
 }
 
 func (m *CliMonitor) ReportFatalError(targetName string, _fmt string, args ...interface{}) {
-	passedFmted := fmt.Sprintf(_fmt, args...)
+	passedFmted := Redact(fmt.Sprintf(_fmt, args...))
 	fmt.Printf("[F %s]: %s\n", targetName, passedFmted)
 }
 
+func (m *CliMonitor) ReportCredentialsExpired(targetName string, _fmt string, args ...interface{}) {
+	passedFmted := Redact(fmt.Sprintf(_fmt, args...))
+	fmt.Printf("[A %s]: %s\n", targetName, passedFmted)
+}
+
+func (m *CliMonitor) ReportStatus(targetName string, update func(status *TargetStatus)) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	if m.statuses == nil {
+		m.statuses = make(map[string]*TargetStatus)
+	}
+	status, ok := m.statuses[targetName]
+	if !ok {
+		status = &TargetStatus{}
+		m.statuses[targetName] = status
+	}
+
+	before := *status
+	update(status)
+	if status.State == StateReady && (status.Transport != "" || status.LocalPort != "") {
+		if status.State != before.State || status.Transport != before.Transport || status.LocalPort != before.LocalPort {
+			line := fmt.Sprintf("[S %s]: %s", targetName, status.State)
+			if status.LocalPort != "" {
+				line += " on localhost:" + status.LocalPort
+			}
+			if status.Transport != "" {
+				line += " via " + status.Transport
+			}
+			fmt.Println(line)
+		}
+	} else if status.State != before.State {
+		fmt.Printf("[S %s]: %s\n", targetName, status.State)
+	}
+}
+
+func (m *CliMonitor) ReportSsoLogin(verificationUrl string, userCode string) {
+	if verificationUrl == "" {
+		return
+	}
+	fmt.Printf("[I]: To log in to AWS SSO, open %s and enter the code %s\n", verificationUrl, userCode)
+}
+
+// Reloads are reported with a general message already, the statuses of removed targets are dropped
+func (m *CliMonitor) ReportTargets(targets []TunnelTarget) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	keep := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		keep[target.Name] = true
+	}
+	for name := range m.statuses {
+		if !keep[name] {
+			delete(m.statuses, name)
+		}
+	}
+}
+
 func (m *CliMonitor) ReportGeneralMessage(_fmt string, args ...interface{}) {
-	passedFmted := fmt.Sprintf(_fmt, args...)
+	passedFmted := Redact(fmt.Sprintf(_fmt, args...))
 	fmt.Printf("[I]: %s\n", passedFmted)
 }
+
+func (m *CliMonitor) AskForInput(targetName string, prompt string) (string, error) {
+	m.inputLock.Lock()
+	defer m.inputLock.Unlock()
+
+	if m.stdin == nil {
+		m.stdin = bufio.NewReader(os.Stdin)
+	}
+
+	fmt.Printf("[? %s]: %s: ", targetName, prompt)
+	line, err := m.stdin.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
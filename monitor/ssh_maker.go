@@ -0,0 +1,167 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"tunny/tun"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The ssh client config for a target, the host key is checked against known_hosts
+func sshClientConfig(target TunnelTarget, mon MonitoringInteractor) (*ssh.ClientConfig, error) {
+	sshConfig := target.SshConfig
+
+	auth, err := sshAuthMethod(target, mon)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := tun.KnownHostsCallback(sshConfig.KnownHostsPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading known hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            sshConfig.Username,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// Authenticate with the key at key_path, or an ephemeral one when instance_connect is set
+func sshAuthMethod(target TunnelTarget, mon MonitoringInteractor) (ssh.AuthMethod, error) {
+	sshConfig := target.SshConfig
+
+	if sshConfig.InstanceConnect == nil {
+		keyFile, err := os.ReadFile(sshConfig.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading key file: %w", err)
+		}
+		parsedKey, err := ssh.ParsePrivateKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing key file %s: %w", sshConfig.KeyPath, err)
+		}
+		return ssh.PublicKeys(parsedKey), nil
+	}
+
+	instanceConnect := sshConfig.InstanceConnect
+	instanceId := instanceConnect.InstanceId
+	awsConfig := instanceConnect.AwsConfig
+	if sshConfig.OverSsm != nil {
+		if instanceId == "" {
+			instanceId = sshConfig.OverSsm.InstanceName
+		}
+		if awsConfig.RoleArn == "" {
+			awsConfig = sshConfig.OverSsm.AwsConfig
+		}
+	}
+	if instanceId == "" {
+		return nil, fmt.Errorf("instance_connect needs an instance_id when the target isn't over_ssm")
+	}
+
+	region := instanceConnect.Region
+	if region == "" {
+		region = tun.DefaultRegion()
+	}
+
+	creds, _, err := getTargetCredentials(target.Name, awsConfig, mon)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting credentials: %w", err)
+	}
+
+	return tun.InstanceConnectAuth(region, creds, instanceId, sshConfig.Username)
+}
+
+// Connect to the target's ssh server, directly or through an ssm session
+func dialSshTarget(
+	topCtx context.Context,
+	target TunnelTarget,
+	mon MonitoringInteractor,
+	config *ssh.ClientConfig) (*ssh.Client, error) {
+	sshConfig := target.SshConfig
+	if sshConfig.OverSsm == nil {
+		return tun.DialSSH(topCtx, config, sshConfig.Host)
+	}
+
+	overSsm := sshConfig.OverSsm
+	creds, _, err := getTargetCredentials(target.Name, overSsm.AwsConfig, mon)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting credentials: %w", err)
+	}
+
+	port := overSsm.Port
+	if port == "" {
+		port = "22"
+	}
+
+	conn, err := tun.DialSSHOverSSM(topCtx, overSsm.InstanceName, port, &tun.SsmOptions{
+		Credentials: creds,
+		Overrides:   overSsm.overrides(),
+		OnOutput: func(stream tun.OutputStream, line string) {
+			reportOutputLine(target.Name, mon, stream, line)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error starting ssm session: %w", err)
+	}
+
+	// The host key is checked against the configured host, or the instance if there isn't one
+	address := sshConfig.Host
+	if address == "" {
+		address = net.JoinHostPort(overSsm.InstanceName, port)
+	}
+
+	return tun.NewSSHClient(conn, address, config)
+}
+
+// Start every forward (and the socks proxy) of an ssh target over a single connection
+func startSshTarget(
+	topCtx context.Context,
+	target TunnelTarget,
+	mon MonitoringInteractor,
+	onReady func()) (<-chan error, error) {
+	sshConfig := target.SshConfig
+
+	config, err := sshClientConfig(target, mon)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dialSshTarget(topCtx, target, mon, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to ssh server: %w", err)
+	}
+
+	forwards := []tun.SshForward{}
+	for _, spec := range append([]RemoteSpec{sshConfig.RemoteSpec}, sshConfig.Forwards...) {
+		if spec.LocalPort == "" {
+			continue
+		}
+		forwards = append(forwards, tun.SshForward{
+			LocalPort:  spec.LocalPort,
+			RemoteHost: spec.RemoteHost,
+			RemotePort: spec.RemotePort,
+		})
+	}
+
+	eventual, err := tun.StartSSHForwards(topCtx, client, forwards, sshConfig.SocksPort)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting forwards: %w", err)
+	}
+
+	via := sshConfig.Host
+	if sshConfig.OverSsm != nil {
+		via = fmt.Sprintf("%s (over ssm)", sshConfig.OverSsm.InstanceName)
+	}
+	mon.ReportInfo(target.Name, "Started %d forward(s) through %s", len(forwards), via)
+	if sshConfig.SocksPort != "" {
+		mon.ReportInfo(target.Name, "SOCKS proxy listening on localhost:%s", sshConfig.SocksPort)
+	}
+
+	// The listeners are up, so it's ready straight away
+	onReady()
+	return eventual, nil
+}
@@ -0,0 +1,164 @@
+package monitor
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type instanceConnectPush struct {
+	InstanceId     string
+	InstanceOSUser string
+	// The region the push was signed for
+	Region string
+}
+
+// Fakes ec2-instance-connect for the test, and returns what gets pushed to it
+func fakeInstanceConnect(t *testing.T) <-chan instanceConnectPush {
+	pushes := make(chan instanceConnectPush, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var push instanceConnectPush
+		json.NewDecoder(r.Body).Decode(&push)
+		// Credential=AKIA/20240101/<region>/ec2-instance-connect/aws4_request
+		if parts := strings.Split(r.Header.Get("Authorization"), "/"); len(parts) > 2 {
+			push.Region = parts[2]
+		}
+		pushes <- push
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"RequestId": "1", "Success": true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	return pushes
+}
+
+// Have the auth method offer its keys to an ssh server, which takes any key
+func offerKeys(t *testing.T, auth ssh.AuthMethod) {
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(privateKey)
+	config := &ssh.ServerConfig{PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverSide, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverSide.Close()
+		ssh.NewServerConn(serverSide, config)
+	}()
+	defer func() { <-done }()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	defer clientSide.Close()
+	_, _, _, err = ssh.NewClientConn(clientSide, "test", &ssh.ClientConfig{
+		User:            "ec2-user",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Error connecting with the keys: %s", err)
+	}
+}
+
+func TestSshAuthMethodKeyFile(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatalf("Error marshalling key: %s", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Error writing key: %s", err)
+	}
+
+	target := TunnelTarget{Name: "bastion", Transport: Transport{SshConfig: &SshConfig{Username: "ec2-user", KeyPath: keyPath}}}
+	auth, err := sshAuthMethod(target, newRecordingMonitor())
+	if err != nil {
+		t.Fatalf("Error with the key file: %s", err)
+	}
+	offerKeys(t, auth)
+
+	target.SshConfig.KeyPath = filepath.Join(t.TempDir(), "missing")
+	if _, err := sshAuthMethod(target, newRecordingMonitor()); err == nil {
+		t.Errorf("Expected a missing key file to be an error")
+	}
+}
+
+func TestSshAuthMethodInstanceConnect(t *testing.T) {
+	pushes := fakeInstanceConnect(t)
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	tests := []struct {
+		name     string
+		config   SshConfig
+		expected instanceConnectPush
+	}{
+		{
+			name: "instance and region given",
+			config: SshConfig{Username: "ec2-user", InstanceConnect: &InstanceConnectConfig{
+				InstanceId: "i-0aaaaaaaaaaaaaaaa", Region: "ap-south-1",
+			}},
+			expected: instanceConnectPush{"i-0aaaaaaaaaaaaaaaa", "ec2-user", "ap-south-1"},
+		},
+		{
+			name: "instance from over_ssm, default region",
+			config: SshConfig{Username: "ubuntu", InstanceConnect: &InstanceConnectConfig{},
+				OverSsm: &SshOverSsmConfig{InstanceName: "i-0bbbbbbbbbbbbbbbb"}},
+			expected: instanceConnectPush{"i-0bbbbbbbbbbbbbbbb", "ubuntu", "eu-west-1"},
+		},
+		{
+			name: "instance given as well as over_ssm",
+			config: SshConfig{Username: "ubuntu", InstanceConnect: &InstanceConnectConfig{InstanceId: "i-0cccccccccccccccc"},
+				OverSsm: &SshOverSsmConfig{InstanceName: "i-0bbbbbbbbbbbbbbbb"}},
+			expected: instanceConnectPush{"i-0cccccccccccccccc", "ubuntu", "eu-west-1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			auth, err := sshAuthMethod(TunnelTarget{Name: "bastion", Transport: Transport{SshConfig: &config}}, newRecordingMonitor())
+			if err != nil {
+				t.Fatalf("Error making the auth method: %s", err)
+			}
+			offerKeys(t, auth)
+			if push := <-pushes; push != test.expected {
+				t.Errorf("Expected %+v to be pushed, got %+v", test.expected, push)
+			}
+		})
+	}
+
+	// Nothing to push to
+	target := TunnelTarget{Name: "bastion", Transport: Transport{SshConfig: &SshConfig{Username: "ec2-user", InstanceConnect: &InstanceConnectConfig{}}}}
+	if _, err := sshAuthMethod(target, newRecordingMonitor()); err == nil || !strings.Contains(err.Error(), "instance_id") {
+		t.Errorf("Expected an error about the missing instance_id, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package monitor
+
+import "time"
+
+type TargetState string
+
+const (
+	// Being looked up or started, not usable yet
+	StateStarting TargetState = "starting"
+	// The local port is accepting connections
+	StateReady TargetState = "ready"
+	// Waiting out the backoff before it's started again
+	StateRestarting TargetState = "restarting"
+	// Waiting on an AWS login before it's retried
+	StateWaitingForLogin TargetState = "waiting_for_login"
+	// Gave up on it
+	StateFailed TargetState = "failed"
+	// Shut down without anything going wrong
+	StateStopped TargetState = "stopped"
+)
+
+// Everything the monitor knows about how a target is doing
+type TargetStatus struct {
+	State TargetState `json:"state"`
+
+	// How many times the supervisor has restarted it
+	Restarts int `json:"restarts"`
+
+	// How whatever it tunnels into says it's doing, e.g. a beanstalk environment's status and health
+	Health string `json:"health,omitempty"`
+
+	// The port it's listening on locally, once it's ready
+	LocalPort string `json:"local_port,omitempty"`
+
+	// The name of the transport it's up on, only set when the target has several
+	Transport string `json:"transport,omitempty"`
+
+	// Why it last went down, and when
+	LastFailure     string    `json:"last_failure,omitempty"`
+	LastFailureTime time.Time `json:"last_failure_time,omitempty"`
+}
@@ -0,0 +1,442 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"tunny/tun"
+)
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 2 * time.Minute
+)
+
+// A parsed RestartConfig
+type restartPolicy struct {
+	mode           string
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func parseRestartPolicy(config *RestartConfig) (restartPolicy, error) {
+	policy := restartPolicy{
+		mode:           RestartNever,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+	}
+	if config == nil {
+		return policy, nil
+	}
+
+	switch config.Policy {
+	case "", RestartNever:
+	case RestartOnFailure, RestartAlways:
+		policy.mode = config.Policy
+	default:
+		return policy, fmt.Errorf("unknown restart policy %q, expected %s, %s or %s", config.Policy, RestartNever, RestartOnFailure, RestartAlways)
+	}
+
+	policy.maxRetries = config.MaxRetries
+
+	if config.InitialBackoff != "" {
+		backoff, err := time.ParseDuration(config.InitialBackoff)
+		if err != nil {
+			return policy, fmt.Errorf("bad initial_backoff %q: %w", config.InitialBackoff, err)
+		}
+		policy.initialBackoff = backoff
+	}
+	if config.MaxBackoff != "" {
+		backoff, err := time.ParseDuration(config.MaxBackoff)
+		if err != nil {
+			return policy, fmt.Errorf("bad max_backoff %q: %w", config.MaxBackoff, err)
+		}
+		policy.maxBackoff = backoff
+	}
+
+	return policy, nil
+}
+
+// Whether a tunnel that ended with err (nil for a clean exit) should be started again
+func (p restartPolicy) shouldRestart(err error, failuresInARow int) bool {
+	if p.maxRetries > 0 && failuresInARow >= p.maxRetries {
+		return false
+	}
+
+	switch p.mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+// How long to wait before the next restart, doubling with every failure in a row
+func (p restartPolicy) backoff(failuresInARow int) time.Duration {
+	backoff := p.initialBackoff
+	for i := 0; i < failuresInARow && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	return backoff
+}
+
+/*
+The restart policy of a target, nil when it doesn't have one. With several transports
+it's the first one's that counts.
+*/
+func targetRestartConfig(target TunnelTarget) *RestartConfig {
+	transports := target.transports()
+	if len(transports) == 0 {
+		return nil
+	}
+	return transports[0].restartConfig()
+}
+
+// The restart policy of a transport, nil when it doesn't have one
+func (t Transport) restartConfig() *RestartConfig {
+	if t.SsmConfig != nil {
+		return t.SsmConfig.Restart
+	} else if t.EbSsmConfig != nil {
+		return t.EbSsmConfig.Restart
+	} else if t.SshConfig != nil {
+		return t.SshConfig.Restart
+	} else if t.EcsConfig != nil {
+		if t.EcsConfig.Restart == nil {
+			// Sessions end whenever the task is replaced, so follow it to the new one
+			return &RestartConfig{Policy: RestartAlways}
+		}
+		return t.EcsConfig.Restart
+	} else if t.K8sConfig != nil {
+		if t.K8sConfig.Restart == nil {
+			// Pods get rescheduled, so follow the forward to the new one
+			return &RestartConfig{Policy: RestartAlways}
+		}
+		return t.K8sConfig.Restart
+	} else if t.CommandConfig != nil {
+		return t.CommandConfig.Restart
+	}
+	return nil
+}
+
+/*
+targetRunner supervises a single target: it starts the tunnel, watches it, and depending on
+how it ended gets credentials sorted out, restarts it per the restart policy, or gives up.
+The waitgroup is held from the first start until the runner gives up or the context is done.
+*/
+type targetRunner struct {
+	ctx    context.Context
+	target TunnelTarget
+	mon    MonitoringInteractor
+	waiter *sync.WaitGroup
+
+	policy restartPolicy
+
+	lock sync.Mutex
+	// Reset whenever the tunnel makes it to ready
+	failuresInARow int
+	restarts       int
+}
+
+func newTargetRunner(
+	ctx context.Context,
+	target TunnelTarget,
+	mon MonitoringInteractor,
+	waiter *sync.WaitGroup) *targetRunner {
+	return &targetRunner{ctx: ctx, target: target, mon: mon, waiter: waiter}
+}
+
+// Start the target for the first time
+func (r *targetRunner) start() {
+	policy, err := parseRestartPolicy(targetRestartConfig(r.target))
+	if err != nil {
+		r.mon.ReportError(r.target.Name, "Not restarting this target: %s", err)
+	}
+	r.policy = policy
+
+	r.run()
+}
+
+// Start the target, trying its transports in order
+func (r *targetRunner) run() {
+	r.runFrom(0, nil)
+}
+
+/*
+Start the target with the first of its transports from first on that starts, wrapping around to
+the start of the list. earlier has why the ones already tried this time round didn't work, and
+each transport is only tried once a round. If none of them start it's down to the restart policy.
+*/
+func (r *targetRunner) runFrom(first int, earlier []error) {
+	r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+		status.State = StateStarting
+	})
+
+	transports := r.target.transports()
+	if len(transports) == 0 {
+		// startTunnel knows how to complain about that
+		transports = []NamedTransport{{}}
+	}
+
+	for i := first % len(transports); len(earlier) < len(transports); i = (i + 1) % len(transports) {
+		attempt := &transportAttempt{index: i, transport: transports[i]}
+		// Secrets are looked up on every start, they may have been rotated
+		target, err := ResolveSecrets(r.ctx, r.target.via(attempt.transport))
+		var eventual <-chan error
+		if err == nil {
+			eventual, err = startTunnel(r.ctx, target, r.mon, func() {
+				r.ready(attempt, len(transports))
+			})
+		}
+		if err == nil {
+			go r.watch(eventual, attempt, earlier)
+			return
+		}
+
+		earlier = append(earlier, r.transportFailed(attempt, transports, len(earlier), err))
+	}
+
+	r.ended(joinTransportErrors(earlier))
+}
+
+// Where a start of one of the target's transports is at
+type transportAttempt struct {
+	index     int
+	transport NamedTransport
+
+	lock     sync.Mutex
+	wasReady bool
+}
+
+/*
+A transport failed, report it if there's another one to go on to, tried is how many were tried
+before it this round. The error comes back marked with which transport it was when there are several.
+*/
+func (r *targetRunner) transportFailed(attempt *transportAttempt, transports []NamedTransport, tried int, err error) error {
+	if len(transports) == 1 {
+		return err
+	}
+
+	if tried+1 < len(transports) {
+		next := (attempt.index + 1) % len(transports)
+		r.mon.ReportError(r.target.Name, "Transport %s failed, trying %s: %s",
+			attempt.transport.Name, transports[next].Name, err)
+	}
+	return fmt.Errorf("%s: %w", attempt.transport.Name, err)
+}
+
+// All the ways the transports failed, as one error
+func joinTransportErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// The tunnel is accepting connections
+func (r *targetRunner) ready(attempt *transportAttempt, transportCount int) {
+	attempt.lock.Lock()
+	attempt.wasReady = true
+	attempt.lock.Unlock()
+
+	r.lock.Lock()
+	r.failuresInARow = 0
+	r.lock.Unlock()
+
+	if transportCount > 1 {
+		r.mon.ReportInfo(r.target.Name, "Using transport %s (%d of %d)", attempt.transport.Name, attempt.index+1, transportCount)
+	}
+	r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+		status.State = StateReady
+		status.LocalPort = attempt.transport.localPort()
+		if transportCount > 1 {
+			status.Transport = attempt.transport.Name
+		}
+	})
+}
+
+/*
+Handle the started connection by watching for errors. A transport that fails before it's
+ever ready is passed over for the next one straight away, like one that doesn't start. One
+that fails after being ready is restarted per its own restart policy, and once that's used up
+(or it hasn't got one) the next transport takes over after the policy's backoff, wrapping around
+to the first.
+*/
+func (r *targetRunner) watch(errChan <-chan error, attempt *transportAttempt, earlier []error) {
+	err := <-errChan
+	if r.ctx.Err() != nil {
+		r.stopped()
+		return
+	}
+
+	attempt.lock.Lock()
+	wasReady := attempt.wasReady
+	attempt.lock.Unlock()
+
+	transports := r.target.transports()
+	if err != nil && !wasReady {
+		earlier = append(earlier, r.transportFailed(attempt, transports, len(earlier), err))
+		r.runFrom(attempt.index+1, earlier)
+		return
+	}
+
+	// Expired credentials are sorted out the same way whichever transport it was
+	if err != nil && len(transports) > 1 && !tun.IsCredentialsError(err) {
+		policy := r.policy
+		if attempt.index > 0 {
+			// Bad policies were reported by validate, here they're never
+			policy, _ = parseRestartPolicy(attempt.transport.restartConfig())
+		}
+		if r.restart(err, policy, attempt.index) {
+			return
+		}
+		r.failOver(err, policy, attempt, transports)
+		return
+	}
+
+	r.ended(err)
+}
+
+/*
+Go on to the next transport after one that was ready failed, once the policy's backoff is up.
+Without it a target whose transports all keep coming up and failing would spin through them.
+*/
+func (r *targetRunner) failOver(err error, policy restartPolicy, attempt *transportAttempt, transports []NamedTransport) {
+	r.lock.Lock()
+	failuresInARow := r.failuresInARow
+	r.failuresInARow++
+	r.lock.Unlock()
+
+	backoff := policy.backoff(failuresInARow)
+	next := (attempt.index + 1) % len(transports)
+	r.mon.ReportError(r.target.Name, "Transport %s failed, trying %s in %s: %s",
+		attempt.transport.Name, transports[next].Name, backoff, err)
+	r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+		status.State = StateRestarting
+		status.LastFailure = err.Error()
+		status.LastFailureTime = time.Now()
+	})
+
+	go func() {
+		select {
+		case <-time.After(backoff):
+			r.runFrom(next, []error{fmt.Errorf("%s: %w", attempt.transport.Name, err)})
+		case <-r.ctx.Done():
+			r.stopped()
+		}
+	}()
+}
+
+/*
+The tunnel couldn't be started or stopped on its own, err is nil if it exited cleanly.
+If it's down to the AWS credentials it's handed to the credential recovery,
+which holds on to the waitgroup until the target is retried or given up on.
+*/
+func (r *targetRunner) ended(err error) {
+	if r.ctx.Err() != nil {
+		r.stopped()
+		return
+	}
+
+	if err != nil && tun.IsCredentialsError(err) {
+		r.mon.ReportCredentialsExpired(r.target.Name, "%s", err)
+		r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+			status.State = StateWaitingForLogin
+		})
+		_recovery.add(r.mon, recoveringTarget{
+			name:    r.target.Name,
+			ctx:     r.ctx,
+			retry:   r.run,
+			giveUp:  r.failed,
+			stopped: r.stopped,
+		})
+		return
+	}
+
+	if !r.restart(err, r.policy, 0) {
+		if err != nil {
+			r.mon.ReportFatalError(r.target.Name, "Proxy %s failed: %s", r.target.Name, err)
+			r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+				status.LastFailure = err.Error()
+				status.LastFailureTime = time.Now()
+			})
+			r.failed()
+		} else {
+			r.stopped()
+		}
+	}
+}
+
+/*
+Restart the target from the transport at first after the backoff if the policy says to,
+otherwise it's left to the caller and false comes back.
+*/
+func (r *targetRunner) restart(err error, policy restartPolicy, first int) bool {
+	r.lock.Lock()
+	failuresInARow := r.failuresInARow
+	restart := policy.shouldRestart(err, failuresInARow)
+	if restart {
+		r.restarts++
+		if err != nil {
+			r.failuresInARow++
+		}
+	}
+	restarts := r.restarts
+	r.lock.Unlock()
+
+	if !restart {
+		return false
+	}
+
+	backoff := policy.backoff(failuresInARow)
+	if err != nil {
+		r.mon.ReportError(r.target.Name, "Proxy %s failed, restarting in %s: %s", r.target.Name, backoff, err)
+	} else {
+		r.mon.ReportInfo(r.target.Name, "Proxy %s exited, restarting in %s", r.target.Name, backoff)
+	}
+	r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+		status.State = StateRestarting
+		status.Restarts = restarts
+		if err != nil {
+			status.LastFailure = err.Error()
+			status.LastFailureTime = time.Now()
+		}
+	})
+
+	go func() {
+		select {
+		case <-time.After(backoff):
+			r.runFrom(first, nil)
+		case <-r.ctx.Done():
+			r.stopped()
+		}
+	}()
+	return true
+}
+
+// Give up on the target for good. The status goes first, the target's done (and can be forgotten) after it.
+func (r *targetRunner) failed() {
+	r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+		status.State = StateFailed
+	})
+	r.waiter.Done()
+}
+
+// The target was shut down
+func (r *targetRunner) stopped() {
+	r.mon.ReportStatus(r.target.Name, func(status *TargetStatus) {
+		status.State = StateStopped
+	})
+	r.waiter.Done()
+}
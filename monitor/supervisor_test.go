@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyDefaultsToNever(t *testing.T) {
+	policy, err := parseRestartPolicy(nil)
+	if err != nil {
+		t.Fatalf("Error parsing an empty policy: %s", err)
+	}
+
+	if policy.shouldRestart(errors.New("boom"), 0) {
+		t.Errorf("Nothing should be restarted without a policy")
+	}
+}
+
+func TestRestartPolicyOnFailure(t *testing.T) {
+	policy, err := parseRestartPolicy(&RestartConfig{Policy: RestartOnFailure, MaxRetries: 3})
+	if err != nil {
+		t.Fatalf("Error parsing policy: %s", err)
+	}
+
+	if !policy.shouldRestart(errors.New("boom"), 2) {
+		t.Errorf("A failure under max_retries should be restarted")
+	}
+	if policy.shouldRestart(errors.New("boom"), 3) {
+		t.Errorf("A failure at max_retries shouldn't be restarted")
+	}
+	if policy.shouldRestart(nil, 0) {
+		t.Errorf("A clean exit shouldn't be restarted with on-failure")
+	}
+}
+
+func TestRestartPolicyAlways(t *testing.T) {
+	policy, err := parseRestartPolicy(&RestartConfig{Policy: RestartAlways})
+	if err != nil {
+		t.Fatalf("Error parsing policy: %s", err)
+	}
+
+	if !policy.shouldRestart(nil, 0) {
+		t.Errorf("A clean exit should be restarted with always")
+	}
+	if !policy.shouldRestart(errors.New("boom"), 100) {
+		t.Errorf("Without max_retries there's no giving up")
+	}
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy, err := parseRestartPolicy(&RestartConfig{
+		Policy:         RestartOnFailure,
+		InitialBackoff: "1s",
+		MaxBackoff:     "10s",
+	})
+	if err != nil {
+		t.Fatalf("Error parsing policy: %s", err)
+	}
+
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for failures, want := range expected {
+		if got := policy.backoff(failures); got != want {
+			t.Errorf("After %d failures expected %s, got %s", failures, want, got)
+		}
+	}
+}
+
+func TestRestartPolicyRejectsUnknown(t *testing.T) {
+	if _, err := parseRestartPolicy(&RestartConfig{Policy: "sometimes"}); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,202 @@
+package monitor
+
+import (
+	"fmt"
+)
+
+/*
+Expand the targets' templates and the defaults into them, giving a config that's just the
+tunnels and the settings for the whole file. Each target is its template (and the template's
+template and so on) with the target merged over it, the same way layers are merged (see
+LoadConfig). The defaults go under that:
+their ssm_config only into targets and transports with an ssm_config and so on for each kind of
+config, everything else into every target. The values keep where they're from, so errors and
+tunny config point at the template or defaults they came from.
+*/
+func expandTemplates(root *configNode) (*configNode, ConfigErrors) {
+	e := &templateExpander{templates: make(map[string]*configField)}
+	if templates := root.field("templates"); templates != nil && templates.value.kind == objectNode {
+		for i := range templates.value.fields {
+			template := &templates.value.fields[i]
+			e.templates[template.name] = template
+			e.checkPartial(template.value, "templates."+template.name)
+		}
+	}
+	if defaults := root.field("defaults"); defaults != nil && defaults.value.kind == objectNode {
+		e.defaults = defaults.value
+		e.checkPartial(e.defaults, "defaults")
+		if transports := e.defaults.field("transports"); transports != nil {
+			e.fail(transports.line, transports.column, transports.value.filename, "defaults.transports",
+				"defaults can't have transports, the defaults for each kind of config go into every transport with that kind")
+		}
+	}
+
+	expanded := &configNode{kind: objectNode, filename: root.filename, line: root.line, column: root.column}
+	// Settings for the whole file, like auto_port_range, stay as they are
+	for _, field := range root.fields {
+		if field.name != "tunnels" && field.name != "defaults" && field.name != "templates" && field.name != "include" {
+			expanded.fields = append(expanded.fields, field)
+		}
+	}
+	tunnels := root.field("tunnels")
+	if tunnels == nil {
+		return expanded, e.errs
+	}
+	items := &configNode{kind: tunnels.value.kind, filename: tunnels.value.filename, line: tunnels.value.line, column: tunnels.value.column}
+	for i, target := range tunnels.value.items {
+		items.items = append(items.items, e.expand(target, fmt.Sprintf("tunnels[%d]", i)))
+	}
+	expanded.fields = append(expanded.fields, configField{name: "tunnels", line: tunnels.line, column: tunnels.column, value: items})
+	return expanded, e.errs
+}
+
+type templateExpander struct {
+	templates map[string]*configField
+	defaults  *configNode
+	errs      ConfigErrors
+}
+
+// Add a problem, once even if several targets extend the same broken template
+func (e *templateExpander) fail(line int, column int, filename string, path string, message string) {
+	problem := ConfigError{Filename: filename, Line: line, Column: column, Path: path, Message: message}
+	for _, err := range e.errs {
+		if err == problem {
+			return
+		}
+	}
+	e.errs = append(e.errs, problem)
+}
+
+// Templates and defaults are bits of targets, they can't be named
+func (e *templateExpander) checkPartial(node *configNode, path string) {
+	if node.kind != objectNode {
+		return
+	}
+	if name := node.field("name"); name != nil {
+		e.fail(name.line, name.column, name.value.filename, path+".name", "only targets have names")
+	}
+}
+
+// The target with its template and the defaults expanded into it
+func (e *templateExpander) expand(target *configNode, path string) *configNode {
+	if target.kind != objectNode {
+		return target
+	}
+	written := target
+
+	if extends := target.field("extends"); extends != nil && extends.value.kind == stringNode {
+		template := e.template(extends.value, path+".extends", nil)
+		if template != nil {
+			target = keepPosition(mergeTargetNodes(template, target), target)
+		}
+	}
+	expanded := e.withDefaults(target)
+	if expanded == written {
+		return expanded
+	}
+
+	// The name first, it's easier to read
+	first := []configField{}
+	rest := []configField{}
+	for _, field := range expanded.fields {
+		if field.name == "name" || field.name == "extends" {
+			first = append(first, field)
+		} else {
+			rest = append(rest, field)
+		}
+	}
+	expanded.fields = append(first, rest...)
+	return expanded
+}
+
+/*
+The template by name with what it extends merged in, without its extends. name is where the
+name is written, for errors, and from is the templates on the way to it to catch loops.
+*/
+func (e *templateExpander) template(name *configNode, path string, from []string) *configNode {
+	template, ok := e.templates[name.text]
+	if !ok {
+		e.fail(name.line, name.column, name.filename, path, fmt.Sprintf("there's no template named %q", name.text))
+		return nil
+	}
+	for _, seen := range from {
+		if seen == name.text {
+			e.fail(name.line, name.column, name.filename, path, fmt.Sprintf("template %q extends itself", name.text))
+			return nil
+		}
+	}
+	if template.value.kind != objectNode {
+		return nil
+	}
+
+	own := &configNode{kind: objectNode, filename: template.value.filename, line: template.value.line, column: template.value.column}
+	for _, field := range template.value.fields {
+		if field.name != "extends" {
+			own.fields = append(own.fields, field)
+		}
+	}
+
+	extends := template.value.field("extends")
+	if extends == nil || extends.value.kind != stringNode {
+		return own
+	}
+	base := e.template(extends.value, "templates."+name.text+".extends", append(from, name.text))
+	if base == nil {
+		return own
+	}
+	return keepPosition(mergeTargetNodes(base, own), own)
+}
+
+// Put a merged node where the node merged over the base is, rather than where the base is
+func keepPosition(merged *configNode, over *configNode) *configNode {
+	if merged != over {
+		merged.filename, merged.line, merged.column = over.filename, over.line, over.column
+	}
+	return merged
+}
+
+// The defaults merged under the target
+func (e *templateExpander) withDefaults(target *configNode) *configNode {
+	if e.defaults == nil {
+		return target
+	}
+
+	// Everything but the configs goes under the target as it is
+	general := &configNode{kind: objectNode, filename: e.defaults.filename, line: e.defaults.line, column: e.defaults.column}
+	for _, field := range e.defaults.fields {
+		if !isTransportConfigName(field.name) && field.name != "transports" {
+			general.fields = append(general.fields, field)
+		}
+	}
+	expanded := e.withConfigDefaults(keepPosition(mergeConfigNodes(general, target), target))
+
+	transports := expanded.field("transports")
+	if transports == nil || transports.value.kind != arrayNode {
+		return expanded
+	}
+	items := &configNode{kind: arrayNode, filename: transports.value.filename, line: transports.value.line, column: transports.value.column}
+	for _, transport := range transports.value.items {
+		items.items = append(items.items, e.withConfigDefaults(transport))
+	}
+	for i := range expanded.fields {
+		if expanded.fields[i].name == "transports" {
+			expanded.fields[i].value = items
+		}
+	}
+	return expanded
+}
+
+// A copy of the target or transport with the defaults for its kind of config merged under it
+func (e *templateExpander) withConfigDefaults(node *configNode) *configNode {
+	if node.kind != objectNode {
+		return node
+	}
+	copied := &configNode{kind: objectNode, filename: node.filename, line: node.line, column: node.column}
+	for _, field := range node.fields {
+		if defaults := e.defaults.field(field.name); defaults != nil && isTransportConfigName(field.name) {
+			field.value = keepPosition(mergeConfigNodes(defaults.value, field.value), field.value)
+		}
+		copied.fields = append(copied.fields, field)
+	}
+	return copied
+}
@@ -0,0 +1,132 @@
+package monitor
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTunnelTargetsExpandsTemplates(t *testing.T) {
+	config := `
+defaults:
+  groups: [staging]
+  eb_ssm_config:
+    environment_name: shared-env
+    region: eu-west-1
+    remote_port: 5432
+  ssh_config:
+    username: ec2-user
+templates:
+  db:
+    eb_ssm_config:
+      remote_host: db.internal
+  replica:
+    extends: db
+    eb_ssm_config:
+      remote_host: replica.internal
+tunnels:
+  - name: main
+    extends: db
+    eb_ssm_config: {local_port: 5001}
+  - name: replica
+    extends: replica
+    groups: [replicas]
+    eb_ssm_config: {local_port: 5002, environment_name: other-env}
+  - name: bastion
+    ssh_config: {local_port: 5003, remote_host: x, remote_port: 22, host: "b:22"}
+    transports:
+      - eb_ssm_config: {remote_host: fallback.internal}
+`
+	targets, err := ParseTunnelTargets("tunny.yaml", []byte(config))
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+
+	main := targets[0].EbSsmConfig
+	if main.EnvironmentName != "shared-env" || main.Region != "eu-west-1" || main.RemoteHost != "db.internal" ||
+		main.RemotePort != "5432" || main.LocalPort != "5001" || targets[0].Groups[0] != "staging" {
+		t.Errorf("Unexpected main %+v", targets[0])
+	}
+	replica := targets[1].EbSsmConfig
+	if replica.EnvironmentName != "other-env" || replica.RemoteHost != "replica.internal" || replica.RemotePort != "5432" ||
+		strings.Join(targets[1].Groups, ",") != "replicas" {
+		t.Errorf("Unexpected replica %+v", targets[1])
+	}
+	bastion := targets[2]
+	if bastion.EbSsmConfig != nil || bastion.SshConfig.Username != "ec2-user" {
+		t.Errorf("Expected only the ssh defaults in the bastion, got %+v", bastion)
+	}
+	if fallback := bastion.Transports[0].EbSsmConfig; fallback == nil || fallback.EnvironmentName != "shared-env" || fallback.RemoteHost != "fallback.internal" {
+		t.Errorf("Expected the eb defaults in the bastion's transport, got %+v", bastion.Transports[0])
+	}
+}
+
+func TestParseTunnelTargetsTemplateProblems(t *testing.T) {
+	config := `{
+	"defaults": {"name": "x", "transports": []},
+	"templates": {
+		"a": {"extends": "b"},
+		"b": {"extends": "a"}
+	},
+	"tunnels": [
+		{"name": "one", "extends": "a", "k8s_config": {"local_port": "1", "remote_port": "1", "service": "s"}},
+		{"name": "two", "extends": "nope", "k8s_config": {"local_port": "2", "remote_port": "1", "service": "s"}},
+		{"name": "three", "extends": "b"},
+		{"name": "four", "extends": "a", "k8s_config": {"local_port": "4", "remote_port": "1", "service": "s"}}
+	]
+}`
+
+	_, err := ParseTunnelTargets("tunny.json", []byte(config))
+	if err == nil {
+		t.Fatalf("Expected template problems")
+	}
+	if strings.Count(err.Error(), "templates.b.extends") != 1 {
+		t.Errorf("Expected the loop to be reported once:\n%s", err)
+	}
+	for _, expected := range []string{
+		"tunny.json:2:15: defaults.name: only targets have names",
+		"tunny.json:2:28: defaults.transports: defaults can't have transports",
+		`tunny.json:5:20: templates.b.extends: template "a" extends itself`,
+		`tunny.json:9:30: tunnels[1].extends: there's no template named "nope"`,
+		"tunny.json:10:3: tunnels[2]: needs one of ssm_config",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in:\n%s", expected, err)
+		}
+	}
+}
+
+func TestLoadConfigLayersTemplates(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+
+	writeConfigFile(t, filepath.Join(home, "tunny", "config.toml"), `
+[templates.bastion.ssh_config]
+host = "bastion.example.com:22"
+username = "ec2-user"
+remote_port = 5432
+`)
+	project := filepath.Join(t.TempDir(), "tunny.json")
+	writeConfigFile(t, project, `{
+	"templates": {"bastion": {"ssh_config": {"username": "deploy"}}},
+	"tunnels": [{"name": "db", "extends": "bastion", "ssh_config": {"local_port": "5432", "remote_host": "db"}}]
+}`)
+
+	config, err := LoadConfig(project)
+	if err != nil {
+		t.Fatalf("Error loading: %s", err)
+	}
+	ssh := config.Targets[0].SshConfig
+	if ssh.Host != "bastion.example.com:22" || ssh.Username != "deploy" || ssh.RemotePort != "5432" {
+		t.Errorf("Unexpected ssh config %+v", ssh)
+	}
+
+	out := &bytes.Buffer{}
+	if err := config.WriteExpanded(out, ConfigFormatJSON); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	if !strings.Contains(out.String(), `"host": "bastion.example.com:22"`) || strings.Contains(out.String(), "templates") {
+		t.Errorf("Expected the expanded targets without the templates, got:\n%s", out)
+	}
+}
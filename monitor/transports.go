@@ -0,0 +1,114 @@
+package monitor
+
+// Which kind of config the transport has, "" when it has none
+func (t Transport) kind() string {
+	switch {
+	case t.SsmConfig != nil:
+		return "ssm"
+	case t.EbSsmConfig != nil:
+		return "eb_ssm"
+	case t.SshConfig != nil:
+		return "ssh"
+	case t.EcsConfig != nil:
+		return "ecs"
+	case t.K8sConfig != nil:
+		return "k8s"
+	case t.CommandConfig != nil:
+		return "command"
+	default:
+		return ""
+	}
+}
+
+// The local port the transport listens on
+func (t Transport) localPort() string {
+	switch {
+	case t.SsmConfig != nil:
+		return t.SsmConfig.LocalPort
+	case t.EbSsmConfig != nil:
+		return t.EbSsmConfig.LocalPort
+	case t.SshConfig != nil:
+		return t.SshConfig.LocalPort
+	case t.EcsConfig != nil:
+		return t.EcsConfig.LocalPort
+	case t.K8sConfig != nil:
+		return t.K8sConfig.LocalPort
+	case t.CommandConfig != nil:
+		return t.CommandConfig.LocalPort
+	default:
+		return ""
+	}
+}
+
+/*
+Whether the transport forwards its local port anywhere. An ssh_config can be there just for its
+forwards and socks_port, with no remote_host or remote_port of its own.
+*/
+func (t Transport) forwardsLocalPort() bool {
+	if t.SshConfig != nil {
+		return t.SshConfig.RemoteHost != "" || t.SshConfig.RemotePort != ""
+	}
+	return t.kind() != ""
+}
+
+// A copy of the transport listening on port instead, the configs are copied rather than changed
+func (t Transport) withLocalPort(port string) Transport {
+	switch {
+	case t.SsmConfig != nil:
+		config := *t.SsmConfig
+		config.LocalPort = port
+		t.SsmConfig = &config
+	case t.EbSsmConfig != nil:
+		config := *t.EbSsmConfig
+		config.LocalPort = port
+		t.EbSsmConfig = &config
+	case t.SshConfig != nil:
+		config := *t.SshConfig
+		config.LocalPort = port
+		t.SshConfig = &config
+	case t.EcsConfig != nil:
+		config := *t.EcsConfig
+		config.LocalPort = port
+		t.EcsConfig = &config
+	case t.K8sConfig != nil:
+		config := *t.K8sConfig
+		config.LocalPort = port
+		t.K8sConfig = &config
+	case t.CommandConfig != nil:
+		config := *t.CommandConfig
+		config.LocalPort = port
+		t.CommandConfig = &config
+	}
+	return t
+}
+
+/*
+Every way of reaching the target in the order they're tried: the config on the target itself
+first, then its transports. The ones that leave out their local port get the first one's.
+*/
+func (t TunnelTarget) transports() []NamedTransport {
+	all := make([]NamedTransport, 0, len(t.Transports)+1)
+	if t.Transport.kind() != "" {
+		all = append(all, NamedTransport{Transport: t.Transport})
+	}
+	all = append(all, t.Transports...)
+
+	if len(all) == 0 {
+		return all
+	}
+	port := all[0].localPort()
+	for i := range all {
+		if all[i].Name == "" {
+			all[i].Name = all[i].kind()
+		}
+		if all[i].localPort() == "" && port != "" {
+			all[i].Transport = all[i].withLocalPort(port)
+		}
+	}
+	return all
+}
+
+// The target as if it only had the one transport, which is what gets started
+func (t TunnelTarget) via(transport NamedTransport) TunnelTarget {
+	return TunnelTarget{Name: t.Name, Transport: transport.Transport}
+}
@@ -0,0 +1,226 @@
+//go:build linux
+
+package monitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransportsShareTheLocalPort(t *testing.T) {
+	target := TunnelTarget{
+		Name: "db",
+		Transport: Transport{SsmConfig: &SsmConfig{
+			RemoteSpec: RemoteSpec{LocalPort: "5432", RemoteHost: "db.internal", RemotePort: "5432"},
+		}},
+		Transports: []NamedTransport{
+			{Name: "bastion", Transport: Transport{SshConfig: &SshConfig{
+				RemoteSpec: RemoteSpec{RemoteHost: "db.internal", RemotePort: "5432"},
+			}}},
+		},
+	}
+
+	transports := target.transports()
+	if len(transports) != 2 {
+		t.Fatalf("Expected 2 transports, got %d", len(transports))
+	}
+	if transports[0].Name != "ssm" || transports[1].Name != "bastion" {
+		t.Errorf("Expected ssm then bastion, got %s then %s", transports[0].Name, transports[1].Name)
+	}
+	if port := transports[1].localPort(); port != "5432" {
+		t.Errorf("Expected the bastion to get the ssm local port, got %q", port)
+	}
+	if target.Transports[0].SshConfig.LocalPort != "" {
+		t.Errorf("Filling in the local port shouldn't change the config itself")
+	}
+}
+
+func TestRunnerFallsBackToTheNextTransport(t *testing.T) {
+	commandTransport := func(script string) Transport {
+		return Transport{CommandConfig: &CommandConfig{
+			Command:      []string{"sh", "-c", script},
+			ReadyPattern: "up",
+			ProbeAddress: noProbe,
+		}}
+	}
+
+	target := TunnelTarget{
+		Name: "db",
+		Transports: []NamedTransport{
+			{Name: "primary", Transport: commandTransport("echo outage >&2; exit 1")},
+			{Name: "fallback", Transport: commandTransport("echo up; sleep 100")},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mon := newRecordingMonitor()
+	waiter := &sync.WaitGroup{}
+	waiter.Add(1)
+	newTargetRunner(ctx, target, mon, waiter).start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for mon.status("db").State != StateReady && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	status := mon.status("db")
+	if status.State != StateReady || status.Transport != "fallback" {
+		t.Fatalf("Expected to be ready via fallback, got %+v", status)
+	}
+
+	mon.lock.Lock()
+	messages := strings.Join(mon.messages, "\n")
+	mon.lock.Unlock()
+	if !strings.Contains(messages, "Transport primary failed, trying fallback") {
+		t.Errorf("Expected the fallback to be reported, got:\n%s", messages)
+	}
+
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		waiter.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Runner didn't stop after cancelling")
+	}
+}
+
+func TestRunnerFallsBackAfterAReadyTransportFails(t *testing.T) {
+	commandTransport := func(script string) Transport {
+		return Transport{CommandConfig: &CommandConfig{
+			Command:      []string{"sh", "-c", script},
+			ReadyPattern: "up",
+			ProbeAddress: noProbe,
+		}}
+	}
+
+	primary := commandTransport("echo up; sleep 0.3; echo outage >&2; exit 1")
+	primary.CommandConfig.LocalPort = "5440"
+	target := TunnelTarget{
+		Name: "db",
+		Transports: []NamedTransport{
+			{Name: "primary", Transport: primary},
+			{Name: "fallback", Transport: commandTransport("echo up; sleep 100")},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mon := newRecordingMonitor()
+	waiter := &sync.WaitGroup{}
+	waiter.Add(1)
+	newTargetRunner(ctx, target, mon, waiter).start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for mon.status("db").Transport != "fallback" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	status := mon.status("db")
+	if status.State != StateReady || status.Transport != "fallback" || status.LocalPort != "5440" {
+		t.Fatalf("Expected to be ready via fallback on the same port, got %+v", status)
+	}
+
+	messages := mon.joinedMessages()
+	if !strings.Contains(messages, "Using transport primary") || !strings.Contains(messages, "Transport primary failed, trying fallback") {
+		t.Errorf("Expected primary to be used and then fallen back from, got:\n%s", messages)
+	}
+
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		waiter.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Runner didn't stop after cancelling")
+	}
+}
+
+func TestRunnerWrapsAroundToTheFirstTransport(t *testing.T) {
+	target := TunnelTarget{
+		Name: "db",
+		Transports: []NamedTransport{
+			{Name: "primary", Transport: Transport{CommandConfig: &CommandConfig{
+				// Only comes up the second time it's run
+				Command:      []string{"sh", "-c", `if [ -e "$0" ]; then echo up; sleep 100; else touch "$0"; exit 1; fi`, filepath.Join(t.TempDir(), "ran")},
+				ReadyPattern: "up",
+				ProbeAddress: noProbe,
+			}}},
+			{Name: "fallback", Transport: Transport{CommandConfig: &CommandConfig{
+				Command:      []string{"sh", "-c", "echo up; sleep 0.3; exit 1"},
+				ReadyPattern: "up",
+				ProbeAddress: noProbe,
+			}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mon := newRecordingMonitor()
+	waiter := &sync.WaitGroup{}
+	waiter.Add(1)
+	newTargetRunner(ctx, target, mon, waiter).start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(mon.joinedMessages(), "Transport fallback failed, trying primary") && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	for mon.status("db").Transport != "primary" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status := mon.status("db"); status.State != StateReady || status.Transport != "primary" {
+		t.Errorf("Expected to wrap around to primary, got %+v:\n%s", status, mon.joinedMessages())
+	}
+
+	cancel()
+	waiter.Wait()
+}
+
+func TestRunnerBacksOffBetweenFlappingTransports(t *testing.T) {
+	dir := t.TempDir()
+	flapping := func(name string) NamedTransport {
+		return NamedTransport{Name: name, Transport: Transport{CommandConfig: &CommandConfig{
+			Command:      []string{"sh", "-c", "echo $$ >> " + filepath.Join(dir, "starts") + "; echo up; sleep 0.1; exit 1"},
+			ReadyPattern: "up",
+			ProbeAddress: noProbe,
+			Restart:      &RestartConfig{Policy: RestartNever, InitialBackoff: "500ms", MaxBackoff: "500ms"},
+		}}}
+	}
+	target := TunnelTarget{Name: "db", Transports: []NamedTransport{flapping("primary"), flapping("fallback")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mon := newRecordingMonitor()
+	waiter := &sync.WaitGroup{}
+	waiter.Add(1)
+	newTargetRunner(ctx, target, mon, waiter).start()
+
+	// Each one's up for 0.1s and then waits out the backoff, a few starts at most
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+	waiter.Wait()
+
+	contents, _ := os.ReadFile(filepath.Join(dir, "starts"))
+	if starts := strings.Count(string(contents), "\n"); starts < 2 || starts > 4 {
+		t.Errorf("Expected 2 to 4 starts with the backoff in between, got %d:\n%s", starts, mon.joinedMessages())
+	}
+	if messages := mon.joinedMessages(); !strings.Contains(messages, "Transport primary failed, trying fallback in 500ms") {
+		t.Errorf("Expected the backoff to be reported, got:\n%s", messages)
+	}
+}
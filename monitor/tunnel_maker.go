@@ -3,33 +3,70 @@ package monitor
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 	"tunny/tun"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
 )
 
-var _ek2 *tun.Ec2Interactor
+var (
+	// Assumed role credentials are shared by every target using the same role
+	_roleCreds = tun.NewRoleCredentialCache()
+)
 
-func lazyMakeEk2() (*tun.Ec2Interactor, error) {
-	if _ek2 == nil {
-		var err error
-		_ek2, err = tun.NewEc2()
-		if err != nil {
-			return nil, err
-		}
+/*
+Get the credentials a target should use, nil means the default chain.
+If the role needs MFA the code is asked for through the monitor, but only when the
+cached credentials are missing or expired.
+*/
+func getTargetCredentials(
+	targetName string,
+	awsConfig AwsConfig,
+	mon MonitoringInteractor) (*credentials.Credentials, tun.AssumeRoleSpec, error) {
+	spec := tun.AssumeRoleSpec{}
+	if awsConfig.RoleArn == "" {
+		return nil, spec, nil
+	}
 
-		errs := _ek2.RefreshAllRegions()
-		if len(errs) > 0 {
-			// Collect all the error strings into one big one
-			errStrCollector := ""
-			for _, err := range errs {
-				errStrCollector += fmt.Sprintf("%s\n", err)
-			}
-			return nil, fmt.Errorf("big problems: %s", errStrCollector)
+	spec.StsEndpoint = awsConfig.overrides().StsEndpoint
+	spec.RoleArn = awsConfig.RoleArn
+	spec.ExternalId = awsConfig.ExternalId
+	spec.MfaSerial = awsConfig.MfaSerial
+	if awsConfig.SessionDuration != "" {
+		duration, err := time.ParseDuration(awsConfig.SessionDuration)
+		if err != nil {
+			return nil, spec, fmt.Errorf("bad session_duration %q: %w", awsConfig.SessionDuration, err)
 		}
+		spec.Duration = duration
+	}
 
+	creds, err := _roleCreds.Get(spec, func(spec tun.AssumeRoleSpec) (string, error) {
+		return mon.AskForInput(targetName, fmt.Sprintf("MFA code for %s (assuming %s)", spec.MfaSerial, spec.RoleArn))
+	})
+	if err != nil {
+		return nil, spec, err
 	}
-	return _ek2, nil
 
+	return creds, spec, nil
+}
+
+// The endpoints and binaries the config points at, the environment fills in the rest later
+func (c AwsConfig) overrides() tun.AwsOverrides {
+	overrides := tun.AwsOverrides{
+		AwsCliPath: c.AwsCliPath,
+		PluginPath: c.SessionManagerPluginPath,
+	}
+	if c.Endpoints != nil {
+		overrides.Ec2Endpoint = c.Endpoints.Ec2
+		overrides.SsmEndpoint = c.Endpoints.Ssm
+		overrides.StsEndpoint = c.Endpoints.Sts
+		overrides.RdsEndpoint = c.Endpoints.Rds
+		overrides.BeanstalkEndpoint = c.Endpoints.ElasticBeanstalk
+		overrides.EcsEndpoint = c.Endpoints.Ecs
+	}
+	return overrides
 }
 
 /*
@@ -44,66 +81,194 @@ func MakeTargetIntoSomething(
 	target TunnelTarget,
 	mon MonitoringInteractor,
 	waiter *sync.WaitGroup) {
+	newTargetRunner(topCtx, target, mon, waiter).start()
+}
+
+/*
+Look up whatever the target points at and start its tunnel once.
+onReady is called when the tunnel is accepting connections, the returned channel gets
+an error (or is just closed) when the tunnel stops.
+*/
+func startTunnel(
+	topCtx context.Context,
+	target TunnelTarget,
+	mon MonitoringInteractor,
+	onReady func()) (<-chan error, error) {
+	// The processes started for it are written down under its name
+	topCtx = tun.WithTarget(topCtx, target.Name)
+
 	if target.EbSsmConfig != nil {
-		ek2, err := lazyMakeEk2()
+		ebConfig := target.EbSsmConfig
+		creds, _, err := getTargetCredentials(target.Name, ebConfig.AwsConfig, mon)
 		if err != nil {
-			mon.ReportFatalError(target.Name, "Error creating ec2 interactor: %s", err)
+			return nil, fmt.Errorf("Error getting credentials: %w", err)
 		}
-		instanceId, err := ek2.GetAnInstanceForBeanstalkEnv(target.EbSsmConfig.EnvironmentName)
+		env, err := resolveBeanstalkTarget(topCtx, target.Name, ebConfig, creds, mon)
 		if err != nil {
-			mon.ReportFatalError(target.Name, "Error getting instance for beanstalk: %s", err)
-
+			return nil, fmt.Errorf("Error getting instance for beanstalk: %w", err)
 		}
+		opts := ssmOptions(target, ebConfig.AwsConfig, ebConfig.SsmSessionConfig, creds, mon, onReady)
+		opts.Region = env.Region
 		eventual, err := tun.StartSSMProxy(
 			topCtx,
-			*instanceId.InstanceId,
-			target.EbSsmConfig.LocalPort,
-			target.EbSsmConfig.RemoteHost,
-			target.EbSsmConfig.RemotePort)
+			env.InstanceId,
+			ebConfig.LocalPort,
+			ebConfig.RemoteHost,
+			ebConfig.RemotePort,
+			opts)
 		if err != nil {
-			mon.ReportFatalError(target.Name, "Error starting proxy: %s", err)
-
-		} else {
-			mon.ReportInfo(target.Name, "Started proxy (from eb env %s) to %s", target.EbSsmConfig.EnvironmentName, *instanceId.InstanceId)
+			return nil, fmt.Errorf("Error starting proxy: %w", err)
 		}
 
-		go HandleStartedErrChan(mon, target, eventual, waiter)
+		mon.ReportInfo(target.Name, "Started proxy (from eb env %s) to %s", ebConfig.EnvironmentName, env.InstanceId)
+		return eventual, nil
 
 	} else if target.SsmConfig != nil {
+		creds, _, err := getTargetCredentials(target.Name, target.SsmConfig.AwsConfig, mon)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting credentials: %w", err)
+		}
 		eventual, err := tun.StartSSMProxy(
 			topCtx,
 			target.SsmConfig.InstanceName,
 			target.SsmConfig.LocalPort,
 			target.SsmConfig.RemoteHost,
-			target.SsmConfig.RemotePort)
+			target.SsmConfig.RemotePort,
+			ssmOptions(target, target.SsmConfig.AwsConfig, target.SsmConfig.SsmSessionConfig, creds, mon, onReady))
 		if err != nil {
-			mon.ReportFatalError(target.Name, "Error starting proxy: %s", err)
+			return nil, fmt.Errorf("Error starting proxy: %w", err)
 		}
 
-		go HandleStartedErrChan(mon, target, eventual, waiter)
+		mon.ReportInfo(target.Name, "Started proxy to %s", target.SsmConfig.InstanceName)
+		return eventual, nil
 
 	} else if target.SshConfig != nil {
-		waiter.Done()
-		panic("not implemented")
+		return startSshTarget(topCtx, target, mon, onReady)
+
+	} else if target.EcsConfig != nil {
+		ecsConfig := target.EcsConfig
+		creds, _, err := getTargetCredentials(target.Name, ecsConfig.AwsConfig, mon)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting credentials: %w", err)
+		}
+		region := ecsConfig.Region
+		if region == "" {
+			region = tun.DefaultRegion()
+		}
+		task, err := tun.ResolveEcsTarget(topCtx, region, creds, ecsConfig.overrides(), ecsConfig.Cluster, ecsConfig.Service, ecsConfig.Container)
+		if err != nil {
+			return nil, fmt.Errorf("Error finding a task for ecs service %s: %w", ecsConfig.Service, err)
+		}
+		// The task's in the service's region, which the session has to be started in too
+		opts := ssmOptions(target, ecsConfig.AwsConfig, ecsConfig.SsmSessionConfig, creds, mon, onReady)
+		opts.Region = region
+		eventual, err := tun.StartSSMProxy(
+			topCtx,
+			task.SsmTarget,
+			ecsConfig.LocalPort,
+			ecsConfig.RemoteHost,
+			ecsConfig.RemotePort,
+			opts)
+		if err != nil {
+			return nil, fmt.Errorf("Error starting proxy: %w", err)
+		}
+
+		mon.ReportInfo(target.Name, "Started proxy (from ecs service %s) to container %s of %s", ecsConfig.Service, task.Container, task.TaskArn)
+		return eventual, nil
+
+	} else if target.K8sConfig != nil {
+		return startK8sTarget(topCtx, target, mon, onReady)
+
+	} else if target.CommandConfig != nil {
+		return startCommandTarget(topCtx, target, mon, onReady)
 
 	} else {
-		waiter.Done()
-		mon.ReportFatalError(target.Name, "Must specify ssh, ssm, or beanstalk ssm config")
+		return nil, fmt.Errorf("Must specify ssh, ssm, beanstalk ssm, ecs, k8s or command config")
 
 	}
 }
 
-// Handle the started connection by watching for errors
-func HandleStartedErrChan(
+/*
+Look the beanstalk environment up and pick an instance, reporting how the environment is doing
+along the way. Terminating environments come back as an error.
+*/
+func resolveBeanstalkTarget(
+	ctx context.Context,
+	targetName string,
+	ebConfig *EbSsmConfig,
+	creds *credentials.Credentials,
+	mon MonitoringInteractor) (*tun.BeanstalkTarget, error) {
+	region := ebConfig.Region
+	if region == "" {
+		region = tun.DefaultRegion()
+	}
+
+	env, err := tun.ResolveBeanstalkEnv(ctx, region, creds, ebConfig.overrides(), ebConfig.ApplicationName, ebConfig.EnvironmentName)
+	if env != nil {
+		mon.ReportStatus(targetName, func(status *TargetStatus) {
+			status.Health = env.Describe()
+		})
+		if env.Health == "Red" {
+			mon.ReportError(targetName, "Beanstalk environment %s is unhealthy: %s", env.EnvironmentName, env.Describe())
+		} else {
+			mon.ReportInfo(targetName, "Beanstalk environment %s is %s", env.EnvironmentName, env.Describe())
+		}
+	}
+	return env, err
+}
+
+// Build the options for an ssm session, readiness and output are reported straight to the monitor
+func ssmOptions(
+	target TunnelTarget,
+	awsConfig AwsConfig,
+	sessionConfig SsmSessionConfig,
+	creds *credentials.Credentials,
 	mon MonitoringInteractor,
-	targ TunnelTarget,
-	errChan <-chan error,
-	waiter *sync.WaitGroup) {
-	defer waiter.Done()
+	onReady func()) *tun.SsmOptions {
+	opts := &tun.SsmOptions{
+		Credentials: creds,
+		Overrides:   awsConfig.overrides(),
+		OnReady: func() {
+			mon.ReportInfo(target.Name, "Proxy is accepting connections")
+			onReady()
+		},
+		OnOutput: func(stream tun.OutputStream, line string) {
+			reportOutputLine(target.Name, mon, stream, line)
+		},
+	}
 
-	err := <-errChan
-	if err != nil {
-		mon.ReportFatalError(targ.Name, "Proxy %s failed: %s", targ.Name, err)
+	if sessionConfig.StartupTimeout != "" {
+		timeout, err := time.ParseDuration(sessionConfig.StartupTimeout)
+		if err != nil {
+			mon.ReportError(target.Name, "Bad startup_timeout %q, using the default: %s", sessionConfig.StartupTimeout, err)
+		} else {
+			opts.StartupTimeout = timeout
+		}
+	}
+
+	if sessionConfig.KeepaliveInterval != "" {
+		interval, err := time.ParseDuration(sessionConfig.KeepaliveInterval)
+		if err != nil {
+			mon.ReportError(target.Name, "Bad keepalive_interval %q, not keeping the session alive: %s", sessionConfig.KeepaliveInterval, err)
+		} else {
+			opts.KeepaliveInterval = interval
+		}
+	}
+
+	return opts
+}
+
+// Pass a line of a tunnel process's output on to the monitor, at the level it looks like
+func reportOutputLine(targetName string, mon MonitoringInteractor, stream tun.OutputStream, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
 	}
 
+	switch tun.ClassifyOutputLine(stream, line) {
+	case tun.OutputError:
+		mon.ReportError(targetName, "%s", line)
+	default:
+		mon.ReportInfo(targetName, "%s", line)
+	}
 }
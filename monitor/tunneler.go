@@ -1,11 +1,5 @@
 package monitor
 
-import (
-	"encoding/json"
-
-	"os"
-)
-
 type (
 	RemoteSpec struct {
 		// The local port to listen on
@@ -18,36 +12,215 @@ type (
 		RemotePort string `json:"remote_port"`
 	}
 
+	// How to get AWS credentials, shared by all the AWS based targets
+	AwsConfig struct {
+		// The role to assume, the default credentials are used as-is when empty
+		RoleArn string `json:"role_arn,omitempty"`
+
+		// The external id the role expects, if any
+		ExternalId string `json:"external_id,omitempty"`
+
+		// The serial number (or arn) of the MFA device the role requires, if any
+		MfaSerial string `json:"mfa_serial,omitempty"`
+
+		// How long the assumed credentials should last, e.g. "1h"
+		SessionDuration string `json:"session_duration,omitempty"`
+
+		// Where to find AWS instead of the real thing, e.g. localstack
+		Endpoints *AwsEndpointsConfig `json:"endpoints,omitempty"`
+
+		// The aws cli to run, TUNNY_AWS_CLI or aws from the PATH by default
+		AwsCliPath string `json:"aws_cli_path,omitempty"`
+
+		// The session-manager-plugin for the aws cli, TUNNY_SESSION_MANAGER_PLUGIN or the one on the PATH by default
+		SessionManagerPluginPath string `json:"session_manager_plugin_path,omitempty"`
+	}
+
+	/*
+		Endpoint urls for AWS services, e.g. "http://localhost:4566". Anything left out comes from
+		AWS_ENDPOINT_URL_<SERVICE> or AWS_ENDPOINT_URL, and is the real endpoint otherwise.
+	*/
+	AwsEndpointsConfig struct {
+		Ec2 string `json:"ec2,omitempty"`
+		Ssm string `json:"ssm,omitempty"`
+		Sts string `json:"sts,omitempty"`
+		Rds string `json:"rds,omitempty"`
+		Ecs string `json:"ecs,omitempty"`
+
+		ElasticBeanstalk string `json:"elasticbeanstalk,omitempty"`
+	}
+
+	// What to do when a tunnel ends
+	RestartConfig struct {
+		// "never" (the default), "on-failure" or "always"
+		Policy string `json:"policy"`
+
+		// Give up after this many failures in a row, 0 to never give up
+		MaxRetries int `json:"max_retries,omitempty"`
+
+		// The wait before the first restart, doubled after every failure in a row, e.g. "1s"
+		InitialBackoff string `json:"initial_backoff,omitempty"`
+
+		// The longest the wait between restarts can get, e.g. "2m"
+		MaxBackoff string `json:"max_backoff,omitempty"`
+	}
+
+	// Settings for the ssm session itself, shared by the ssm based targets
+	SsmSessionConfig struct {
+		// How long the session gets to start listening before it's given up on, e.g. "45s"
+		StartupTimeout string `json:"startup_timeout,omitempty"`
+
+		// Restart the session when it ends (idle timeout, agent restart...), never by default
+		Restart *RestartConfig `json:"restart,omitempty"`
+
+		// Open a connection to the local port this often so the session doesn't idle out, e.g. "5m"
+		KeepaliveInterval string `json:"keepalive_interval,omitempty"`
+	}
+
 	// SSM configuration
 	SsmConfig struct {
 		RemoteSpec
+		AwsConfig
+		SsmSessionConfig
 		// The name of the ec2 instance to connect to
 		InstanceName string `json:"instance_name"`
 	}
 
 	EbSsmConfig struct {
 		RemoteSpec
+		AwsConfig
+		SsmSessionConfig
 		// The name of the elastic beanstalk environment to connect to
 		EnvironmentName string `json:"environment_name"`
+		// The application the environment belongs to, needed when several have one by that name
+		ApplicationName string `json:"application_name,omitempty"`
+		// The environment's region, AWS_REGION (or us-west-2) by default
+		Region string `json:"region,omitempty"`
+	}
+
+	// Port forwarding through an ECS task (Fargate or not) with ECS Exec
+	EcsConfig struct {
+		RemoteSpec
+		AwsConfig
+		// Restarts default to "always" here, a new task is picked every time
+		SsmSessionConfig
+
+		// The cluster name or arn
+		Cluster string `json:"cluster"`
+		// The service a running task is picked from
+		Service string `json:"service"`
+		// The container to go through, the first running one when empty
+		Container string `json:"container,omitempty"`
+		// The cluster's region, AWS_REGION (or us-west-2) by default
+		Region string `json:"region,omitempty"`
+	}
+
+	// Port forwarding to a pod through the kubernetes api server, like kubectl port-forward
+	K8sConfig struct {
+		// The local port to listen on
+		LocalPort string `json:"local_port"`
+		// The port on the pod (number or container port name), or the service's port with service
+		RemotePort string `json:"remote_port"`
+
+		// The kubeconfig file, KUBECONFIG or ~/.kube/config by default
+		Kubeconfig string `json:"kubeconfig,omitempty"`
+		// The kubeconfig context, its current context by default
+		Context string `json:"context,omitempty"`
+		// The namespace, the context's namespace (or "default") by default
+		Namespace string `json:"namespace,omitempty"`
+
+		// Exactly one of pod, deployment, service or selector picks the pod
+		Pod        string `json:"pod,omitempty"`
+		Deployment string `json:"deployment,omitempty"`
+		Service    string `json:"service,omitempty"`
+		// A label selector, e.g. "app=api"
+		Selector string `json:"selector,omitempty"`
+
+		// Restarts default to "always" here, so a rescheduled pod is followed
+		Restart *RestartConfig `json:"restart,omitempty"`
+	}
+
+	/*
+		Any command that runs a tunnel (gcloud iap, cloudflared...). The command, its arguments and
+		the env values are templates, {{.LocalPort}}, {{.RemoteHost}}, {{.RemotePort}} and {{.Name}}
+		are filled in from the target.
+	*/
+	CommandConfig struct {
+		RemoteSpec
+		// The command and its arguments, e.g. ["cloudflared", "access", "tcp", "--url", "localhost:{{.LocalPort}}"]
+		Command []string `json:"command"`
+		// Extra environment variables for the command
+		Env map[string]string `json:"env,omitempty"`
+		// The working directory for the command
+		Dir string `json:"dir,omitempty"`
+
+		// It's ready once a line of its output matches this regex
+		ReadyPattern string `json:"ready_pattern,omitempty"`
+		// It's ready once this address accepts connections, localhost:local_port by default when
+		// there's no ready_pattern. "none" to not probe anything.
+		ProbeAddress string `json:"probe_address,omitempty"`
+
+		// How long it gets to become ready before it's given up on, e.g. "45s"
+		StartupTimeout string `json:"startup_timeout,omitempty"`
+		// Restart the command when it exits, never by default
+		Restart *RestartConfig `json:"restart,omitempty"`
+		// Open a connection to the probe address this often so the tunnel doesn't idle out, e.g. "5m"
+		KeepaliveInterval string `json:"keepalive_interval,omitempty"`
 	}
 
 	// SSH configuration
 	SshConfig struct {
 		RemoteSpec
+		// The ssh server (host:port) to connect to, with over_ssm it's only used to check the host key
+		Host string `json:"host"`
 		// The username to connect with
 		Username string `json:"username"`
-		// The path to the private key to use
-		KeyPath string `json:"key_path"`
+		// The path to the private key to use, not needed with instance_connect
+		KeyPath string `json:"key_path,omitempty"`
+
+		// Authenticate with a throwaway key pushed by EC2 Instance Connect instead of key_path
+		InstanceConnect *InstanceConnectConfig `json:"instance_connect,omitempty"`
+
+		// More forwards to run over the same ssh connection
+		Forwards []RemoteSpec `json:"forwards,omitempty"`
+
+		// Run a SOCKS5 proxy on this local port, through the ssh connection
+		SocksPort string `json:"socks_port,omitempty"`
+
+		// The known_hosts files the host key is checked against, ~/.ssh/known_hosts by default
+		KnownHostsPaths []string `json:"known_hosts_paths,omitempty"`
+
+		// Reach the ssh server through an ssm session instead of over the network
+		OverSsm *SshOverSsmConfig `json:"over_ssm,omitempty"`
+
+		// Reconnect when the ssh connection drops, never by default
+		Restart *RestartConfig `json:"restart,omitempty"`
 
 		// TODO: Password (for Username and KeyPath) support? Some way to ask for it so it's not hardcoded?
 	}
-)
 
-// TunnelTargets are ec2 instances associate with elastic beanstalk that we can use to tunnel through
-type TunnelTarget struct {
-	// The name of the tunnel target
-	Name string `json:"name"`
+	// Pushing an ephemeral key with EC2 Instance Connect before every ssh connection
+	InstanceConnectConfig struct {
+		// Credentials for the push, with over_ssm they default to the ssm session's
+		AwsConfig
+		// The instance to push the key to, with over_ssm it defaults to the ssm session's instance
+		InstanceId string `json:"instance_id,omitempty"`
+		// The instance's region, AWS_REGION (or us-west-2) by default
+		Region string `json:"region,omitempty"`
+	}
 
+	// Getting to an ssh server with AWS-StartSSHSession, no open port 22 needed
+	SshOverSsmConfig struct {
+		AwsConfig
+		// The ec2 instance running the ssh server
+		InstanceName string `json:"instance_name"`
+		// The port sshd listens on, on the instance, 22 by default
+		Port string `json:"port,omitempty"`
+	}
+)
+
+// One way of reaching a target, exactly one of the configs should be set
+type Transport struct {
 	// The ssm configuration
 	SsmConfig *SsmConfig `json:"ssm_config,omitempty"`
 
@@ -56,28 +229,53 @@ type TunnelTarget struct {
 
 	// The ssh configuration
 	SshConfig *SshConfig `json:"ssh_config,omitempty"`
+
+	// The ecs configuration
+	EcsConfig *EcsConfig `json:"ecs_config,omitempty"`
+
+	// The kubernetes configuration
+	K8sConfig *K8sConfig `json:"k8s_config,omitempty"`
+
+	// The external command configuration
+	CommandConfig *CommandConfig `json:"command_config,omitempty"`
 }
 
-// Get all tunnel targets
-func GetTunnelTargets(filename string) ([]TunnelTarget, error) {
-	// Load from a rds_runnel.json file in the current directory
-	targets := struct {
-		Targets []TunnelTarget `json:"tunnels"`
-	}{
-		make([]TunnelTarget, 0, 10),
-	}
+// TunnelTargets are ec2 instances associate with elastic beanstalk that we can use to tunnel through
+type TunnelTarget struct {
+	// The name of the tunnel target
+	Name string `json:"name"`
+
+	// The groups it's in, e.g. "staging", to start or stop it along with the rest of the group
+	Groups []string `json:"groups,omitempty"`
+
+	// The template it's based on, the target's own settings are merged over the template's
+	Extends string `json:"extends,omitempty"`
 
-	// open the file
-	fileContents, err := os.ReadFile(filename)
+	// How to reach it, the configs sit right on the target
+	Transport
+
+	/*
+		More ways of reaching the same thing, tried in order after the one above (if any) whenever
+		the target is started or fails. Their local_port can be left out, the first one's is used.
+	*/
+	Transports []NamedTransport `json:"transports,omitempty"`
+}
+
+// A transport in a target's list of transports
+type NamedTransport struct {
+	// Shown when it's the active one, e.g. "bastion", the kind of config when empty
+	Name string `json:"name,omitempty"`
+	Transport
+}
+
+// Get all tunnel targets, with the user's config and includes layered in, validated first and their auto ports assigned
+func GetTunnelTargets(filename string) ([]TunnelTarget, error) {
+	config, err := LoadConfig(filename)
 	if err != nil {
 		return nil, err
 	}
-
-	// parse the json
-	if err := json.Unmarshal(fileContents, &targets); err != nil {
+	if _, err := config.AssignPorts(); err != nil {
 		return nil, err
 	}
-
-	return targets.Targets, nil
-
+	return config.Targets, nil
 }
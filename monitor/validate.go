@@ -0,0 +1,479 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A problem with a config file and where in it the problem is
+type ConfigError struct {
+	Filename string
+	Line     int
+	Column   int
+
+	// Where in the config it is, e.g. tunnels[2].ssm_config.local_port
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.Filename, e.Line, e.Column, e.Path, e.Message)
+}
+
+// Every problem found in a config file, one per line
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// What a config file holds
+type tunnelsFile struct {
+	// Other config files to load first, relative to this one. This file wins over them.
+	Include []string `json:"include,omitempty"`
+
+	// What every target gets unless it says otherwise, see expandTemplates
+	Defaults *TunnelTarget `json:"defaults,omitempty"`
+	// Bits of targets, by name, that targets can extend
+	Templates map[string]TunnelTarget `json:"templates,omitempty"`
+
+	// Where local ports left to tunny are picked from, e.g. "42000-42999"
+	AutoPortRange string `json:"auto_port_range,omitempty"`
+
+	Targets []TunnelTarget `json:"tunnels"`
+}
+
+var tunnelsFileType = reflect.TypeOf(tunnelsFile{})
+
+/*
+ParseTunnelTargets parses and validates a config file's contents, in json, yaml or toml by the
+file's extension. Unknown (or misspelt) fields, duplicate names and local ports, ports that
+aren't numbers and targets without exactly one transport are all errors, returned together as
+ConfigErrors with their line and column. Includes aren't followed, LoadConfig does that.
+*/
+func ParseTunnelTargets(filename string, contents []byte) ([]TunnelTarget, error) {
+	format := ConfigFormatOf(filename)
+	root, err := readConfig(format, filename, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := newConfigChecker(format)
+	checker.check(root, tunnelsFileType, "")
+	parsed, _, err := targetsFromConfig(root, checker.errs)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Targets, nil
+}
+
+/*
+The targets (and the rest of the file) in a config that's been checked against TunnelTarget,
+and what's wrong with them. errs are the problems found already, they're returned along with any
+found here. The config with its templates and defaults expanded comes back too.
+*/
+func targetsFromConfig(root *configNode, errs ConfigErrors) (*tunnelsFile, *configNode, error) {
+	root, expandErrs := expandTemplates(root)
+	errs = append(errs, expandErrs...)
+
+	// Go over it again for where everything is, it may have been put together from several files
+	positions := newConfigChecker(ConfigFormatJSON)
+	positions.check(root, tunnelsFileType, "")
+
+	normalized, err := writeJSONConfig(root)
+	if err != nil {
+		return nil, nil, ConfigErrors{positions.of("", err.Error())}
+	}
+	parsed := tunnelsFile{Targets: make([]TunnelTarget, 0, 10)}
+	if err := json.Unmarshal(normalized, &parsed); err != nil {
+		return nil, nil, ConfigErrors{positions.of("", err.Error())}
+	}
+
+	problems := interpolateTargets(parsed.Targets)
+	problems = append(problems, validateTargets(parsed.Targets)...)
+	if parsed.AutoPortRange != "" {
+		if _, _, err := parsePortRange(parsed.AutoPortRange); err != nil {
+			problems = append(problems, configProblem{"auto_port_range", err.Error()})
+		}
+	}
+	for _, problem := range problems {
+		errs = append(errs, positions.of(problem.path, problem.message))
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return &parsed, root, nil
+}
+
+// Checks the nodes read from a config file against the types they're going into
+type configChecker struct {
+	// Whether scalars can be taken as strings, yaml and toml ports are numbers unless quoted
+	loose bool
+
+	// Every value by its path, e.g. tunnels[2].ssm_config.local_port
+	positions map[string]*configNode
+	errs      ConfigErrors
+}
+
+func newConfigChecker(format string) *configChecker {
+	return &configChecker{loose: format != ConfigFormatJSON, positions: make(map[string]*configNode)}
+}
+
+func (c *configChecker) at(node *configNode, line int, column int, path string, message string) ConfigError {
+	return ConfigError{Filename: node.filename, Line: line, Column: column, Path: path, Message: message}
+}
+
+// An error about the value at path, or the closest thing around it that's in the file
+func (c *configChecker) of(path string, message string) ConfigError {
+	for lookup := path; ; {
+		if node, ok := c.positions[lookup]; ok {
+			return c.at(node, node.line, node.column, path, message)
+		}
+		cut := strings.LastIndexAny(lookup, ".[")
+		if cut < 0 {
+			return ConfigError{Line: 1, Column: 1, Path: path, Message: message}
+		}
+		lookup = lookup[:cut]
+	}
+}
+
+/*
+The value is the wrong type, which json.Unmarshal would choke on. It's reported and then replaced
+so the rest of the config can still be checked: a number or bool where a string goes by its text,
+anything else by null.
+*/
+func (c *configChecker) mismatch(node *configNode, path string, expected string) {
+	c.errs = append(c.errs, c.at(node, node.line, node.column, path, fmt.Sprintf("expected %s, got %s", expected, node.kind)))
+	if expected == "string" && (node.kind == numberNode || node.kind == boolNode) {
+		node.kind = stringNode
+		return
+	}
+	node.kind, node.fields, node.items, node.text = nullNode, nil, nil, ""
+}
+
+// Check a value goes into t, and its fields and items. A nil t takes anything.
+func (c *configChecker) check(node *configNode, t reflect.Type, path string) {
+	c.positions[path] = node
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() == reflect.Interface || node.kind == nullNode {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		if node.kind != objectNode {
+			c.mismatch(node, path, "object")
+			return
+		}
+		seen := make(map[string]bool)
+		for _, field := range node.fields {
+			fieldPath := field.name
+			if path != "" {
+				fieldPath = path + "." + field.name
+			}
+
+			if seen[field.name] {
+				c.errs = append(c.errs, c.at(field.value, field.line, field.column, fieldPath, "field is set more than once"))
+			}
+			seen[field.name] = true
+
+			var fieldType reflect.Type
+			if t.Kind() == reflect.Map {
+				fieldType = t.Elem()
+			} else {
+				var message string
+				fieldType, message = jsonField(t, field.name)
+				if message != "" {
+					c.errs = append(c.errs, c.at(field.value, field.line, field.column, fieldPath, message))
+				}
+			}
+			c.check(field.value, fieldType, fieldPath)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.kind != arrayNode {
+			c.mismatch(node, path, "array")
+			return
+		}
+		for i, item := range node.items {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		if node.kind == stringNode {
+			return
+		}
+		if c.loose && node.kind == boolNode {
+			node.kind = stringNode
+			return
+		}
+		if c.loose && node.kind == numberNode {
+			// As the number it's read as, 5_432 is 5432
+			if number, err := numberText(node.text); err == nil {
+				node.kind, node.text = stringNode, number
+				return
+			}
+		}
+		c.mismatch(node, path, "string")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if node.kind != numberNode {
+			c.mismatch(node, path, "number")
+			return
+		}
+		if number, err := numberText(node.text); err != nil || strings.ContainsAny(number, ".eE") {
+			c.errs = append(c.errs, c.at(node, node.line, node.column, path, fmt.Sprintf("expected a whole number, got %s", node.text)))
+			node.kind, node.text = nullNode, ""
+		}
+	case reflect.Float32, reflect.Float64:
+		if node.kind != numberNode {
+			c.mismatch(node, path, "number")
+		}
+	case reflect.Bool:
+		if node.kind != boolNode {
+			c.mismatch(node, path, "bool")
+		}
+	}
+}
+
+/*
+The type of the struct's field with that json name, embedded structs' fields included. Unlike
+json.Unmarshal the name has to match exactly, the message says what's wrong when it doesn't.
+*/
+func jsonField(t reflect.Type, name string) (reflect.Type, string) {
+	names := jsonFields(t)
+	if fieldType, ok := names[name]; ok {
+		return fieldType, ""
+	}
+	for known := range names {
+		if strings.EqualFold(known, name) {
+			return nil, fmt.Sprintf("unknown field, did you mean %q?", known)
+		}
+	}
+	return nil, "unknown field"
+}
+
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for embeddedName, embeddedType := range jsonFields(embedded) {
+					if _, ok := fields[embeddedName]; !ok {
+						fields[embeddedName] = embeddedType
+					}
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// Something wrong with the targets, by the path of the value it's about
+type configProblem struct {
+	path    string
+	message string
+}
+
+// A port set in a transport's config, by its path under the transport
+type configPort struct {
+	path  string
+	value string
+	local bool
+}
+
+// The json name of the transport's config, e.g. "ssm_config"
+func configName(kind string) string {
+	return kind + "_config"
+}
+
+// Every kind of config set on the transport, there should be one
+func (t Transport) kinds() []string {
+	kinds := []string{}
+	if t.SsmConfig != nil {
+		kinds = append(kinds, "ssm")
+	}
+	if t.EbSsmConfig != nil {
+		kinds = append(kinds, "eb_ssm")
+	}
+	if t.SshConfig != nil {
+		kinds = append(kinds, "ssh")
+	}
+	if t.EcsConfig != nil {
+		kinds = append(kinds, "ecs")
+	}
+	if t.K8sConfig != nil {
+		kinds = append(kinds, "k8s")
+	}
+	if t.CommandConfig != nil {
+		kinds = append(kinds, "command")
+	}
+	return kinds
+}
+
+// The ports the transport's config sets, kubernetes remote ports can be names so they're left out
+func (t Transport) ports() []configPort {
+	remoteSpec := func(prefix string, spec RemoteSpec) []configPort {
+		return []configPort{
+			{prefix + ".local_port", spec.LocalPort, true},
+			{prefix + ".remote_port", spec.RemotePort, false},
+		}
+	}
+
+	switch {
+	case t.SsmConfig != nil:
+		return remoteSpec("ssm_config", t.SsmConfig.RemoteSpec)
+	case t.EbSsmConfig != nil:
+		return remoteSpec("eb_ssm_config", t.EbSsmConfig.RemoteSpec)
+	case t.EcsConfig != nil:
+		return remoteSpec("ecs_config", t.EcsConfig.RemoteSpec)
+	case t.K8sConfig != nil:
+		return []configPort{{"k8s_config.local_port", t.K8sConfig.LocalPort, true}}
+	case t.CommandConfig != nil:
+		return remoteSpec("command_config", t.CommandConfig.RemoteSpec)
+	case t.SshConfig != nil:
+		ports := remoteSpec("ssh_config", t.SshConfig.RemoteSpec)
+		for i, forward := range t.SshConfig.Forwards {
+			ports = append(ports, remoteSpec(fmt.Sprintf("ssh_config.forwards[%d]", i), forward)...)
+		}
+		ports = append(ports, configPort{"ssh_config.socks_port", t.SshConfig.SocksPort, true})
+		if t.SshConfig.OverSsm != nil {
+			ports = append(ports, configPort{"ssh_config.over_ssm.port", t.SshConfig.OverSsm.Port, false})
+		}
+		return ports
+	default:
+		return nil
+	}
+}
+
+func validPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number > 0 && number < 65536
+}
+
+// Check what json.Unmarshal can't: names, transports and ports
+func validateTargets(targets []TunnelTarget) []configProblem {
+	problems := []configProblem{}
+	problem := func(path string, format string, args ...interface{}) {
+		problems = append(problems, configProblem{path, fmt.Sprintf(format, args...)})
+	}
+
+	names := make(map[string]int)
+	// Which target has each local port, the transports of one target can share theirs
+	portOwners := make(map[string]int)
+
+	for i, target := range targets {
+		path := fmt.Sprintf("tunnels[%d]", i)
+
+		if target.Name == "" {
+			problem(path+".name", "name is required")
+		} else if other, ok := names[target.Name]; ok {
+			problem(path+".name", "name %q is already used by tunnels[%d]", target.Name, other)
+		} else {
+			names[target.Name] = i
+		}
+		for j, group := range target.Groups {
+			if strings.TrimSpace(group) == "" {
+				problem(fmt.Sprintf("%s.groups[%d]", path, j), "group names can't be empty")
+			}
+		}
+
+		// The config on the target itself and then its transports, the same order they're tried in
+		type transportAt struct {
+			path      string
+			transport Transport
+		}
+		transports := []transportAt{}
+		if kinds := target.Transport.kinds(); len(kinds) > 0 {
+			transports = append(transports, transportAt{path, target.Transport})
+		}
+		for j, named := range target.Transports {
+			transports = append(transports, transportAt{fmt.Sprintf("%s.transports[%d]", path, j), named.Transport})
+		}
+		if len(transports) == 0 {
+			problem(path, "needs one of ssm_config, eb_ssm_config, ssh_config, ecs_config, k8s_config or command_config")
+			continue
+		}
+
+		for _, at := range transports {
+			kinds := at.transport.kinds()
+			if len(kinds) == 0 {
+				problem(at.path, "needs one of ssm_config, eb_ssm_config, ssh_config, ecs_config, k8s_config or command_config")
+				continue
+			}
+			if len(kinds) > 1 {
+				problem(at.path+"."+configName(kinds[1]), "%s is already set, only one config is allowed (list fallbacks in transports)",
+					configName(kinds[0]))
+				continue
+			}
+
+			if _, err := parseRestartPolicy(at.transport.restartConfig()); err != nil {
+				problem(at.path+"."+configName(kinds[0])+".restart", "%s", err)
+			}
+
+			portsHere := make(map[string]string)
+			for _, port := range at.transport.ports() {
+				portPath := at.path + "." + port.path
+				isLocalPort := port.path == configName(kinds[0])+".local_port"
+				if port.value == autoPort && isLocalPort && !at.transport.forwardsLocalPort() {
+					problem(portPath, "there's nothing to forward it to, set remote_port or leave local_port out")
+					continue
+				}
+				if port.value == "" || (port.value == autoPort && isLocalPort) {
+					// Left to tunny, and later transports take the first one's local port
+					continue
+				}
+				if !validPort(port.value) {
+					problem(portPath, "%q isn't a port number (1-65535)", port.value)
+					continue
+				}
+				if !port.local {
+					continue
+				}
+
+				if other, ok := portsHere[port.value]; ok {
+					problem(portPath, "local port %s is already used by %s", port.value, other)
+					continue
+				}
+				portsHere[port.value] = portPath
+				if owner, ok := portOwners[port.value]; ok && owner != i {
+					problem(portPath, "local port %s is already used by tunnels[%d] (%s)", port.value, owner, targets[owner].Name)
+					continue
+				}
+				portOwners[port.value] = i
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,183 @@
+package monitor
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseTunnelTargetsAcceptsValidConfig(t *testing.T) {
+	config := `{
+	"tunnels": [
+		{
+			"name": "db",
+			"ssm_config": {"local_port": "5432", "remote_host": "db.internal", "remote_port": "5432", "instance_name": "bastion"},
+			"transports": [
+				{"name": "ssh", "ssh_config": {"remote_host": "db.internal", "remote_port": "5432", "host": "bastion:22", "username": "ec2-user"}}
+			]
+		},
+		{
+			"name": "api",
+			"k8s_config": {"local_port": "8080", "remote_port": "http", "service": "api"}
+		}
+	]
+}`
+
+	targets, err := ParseTunnelTargets("tunny.json", []byte(config))
+	if err != nil {
+		t.Fatalf("Expected the config to be valid, got: %s", err)
+	}
+	if len(targets) != 2 || len(targets[0].transports()) != 2 {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+}
+
+func TestParseTunnelTargetsEndpoints(t *testing.T) {
+	config := `{"tunnels": [{"name": "db", "ssm_config": {"local_port": "5432", "remote_port": "5432", "instance_name": "bastion",
+		"endpoints": {"ec2": "http://localhost:4566", "rds": "http://localhost:4567", "ecs": "http://localhost:4568"}}}]}`
+
+	targets, err := ParseTunnelTargets("tunny.json", []byte(config))
+	if err != nil {
+		t.Fatalf("Expected the config to be valid, got: %s", err)
+	}
+	overrides := targets[0].SsmConfig.overrides()
+	if overrides.Ec2Endpoint != "http://localhost:4566" || overrides.RdsEndpoint != "http://localhost:4567" || overrides.EcsEndpoint != "http://localhost:4568" {
+		t.Errorf("Expected the endpoints in the overrides, got %+v", overrides)
+	}
+}
+
+func TestParseTunnelTargetsReportsWhere(t *testing.T) {
+	config := `{
+	"tunnels": [
+		{
+			"name": "db",
+			"ssm_config": {"local_port": "5432", "remote_port": "5432", "instance_nme": "bastion"}
+		},
+		{
+			"name": "db",
+			"ssm_config": {"local_port": "5432", "remote_port": "postgres", "instance_name": "bastion"},
+			"ssh_config": {"local_port": "5433", "host": "bastion:22"}
+		},
+		{
+			"name": "nothing",
+			"Name": "twice"
+		}
+	]
+}`
+
+	_, err := ParseTunnelTargets("tunny.json", []byte(config))
+	var configErrs ConfigErrors
+	if !errors.As(err, &configErrs) {
+		t.Fatalf("Expected config errors, got %v", err)
+	}
+
+	expected := []string{
+		`tunny.json:5:64: tunnels[0].ssm_config.instance_nme: unknown field`,
+		`tunny.json:14:4: tunnels[2].Name: unknown field, did you mean "name"?`,
+		`tunny.json:8:12: tunnels[1].name: name "db" is already used by tunnels[0]`,
+		`tunny.json:10:18: tunnels[1].ssh_config: ssm_config is already set`,
+		`tunny.json:12:3: tunnels[2]: needs one of`,
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(expected) {
+		t.Errorf("Expected %d errors, got:\n%s", len(expected), err)
+	}
+	for _, want := range expected {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error like %q in:\n%s", want, err)
+		}
+	}
+}
+
+func TestParseTunnelTargetsPorts(t *testing.T) {
+	config := `{"tunnels": [
+	{"name": "a", "command_config": {"local_port": "70000", "command": ["true"]}},
+	{"name": "b", "command_config": {"local_port": "8080", "remote_port": "x", "command": ["true"]}},
+	{"name": "c", "ssh_config": {"local_port": "8080", "host": "h:22", "socks_port": "1080",
+		"forwards": [{"local_port": "1080", "remote_port": "80"}]}},
+	{"name": "d", "ecs_config": {"remote_port": "80", "cluster": "c", "service": "s"}},
+	{"name": "e", "ssh_config": {"local_port": "auto", "remote_port": "22", "host": "h:22", "socks_port": "auto"}},
+	{"name": "f", "ssh_config": {"local_port": "auto", "host": "h:22", "socks_port": "1081"}}
+]}`
+
+	_, err := ParseTunnelTargets("tunny.json", []byte(config))
+	if err == nil {
+		t.Fatalf("Expected port errors")
+	}
+
+	for _, want := range []string{
+		`tunny.json:2:49: tunnels[0].command_config.local_port: "70000" isn't a port number`,
+		`tunnels[1].command_config.remote_port: "x" isn't a port number`,
+		`tunny.json:4:45: tunnels[2].ssh_config.local_port: local port 8080 is already used by tunnels[1] (b)`,
+		`tunnels[2].ssh_config.socks_port: local port 1080 is already used by tunnels[2].ssh_config.forwards[0].local_port`,
+		`tunnels[4].ssh_config.socks_port: "auto" isn't a port number`,
+		`tunnels[5].ssh_config.local_port: there's nothing to forward it to`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error like %q in:\n%s", want, err)
+		}
+	}
+	// Left out or auto, tunny picks the local port
+	if strings.Contains(err.Error(), "tunnels[3]") || strings.Contains(err.Error(), "tunnels[4].ssh_config.local_port") {
+		t.Errorf("Expected d and e's local ports to be left to tunny, got:\n%s", err)
+	}
+}
+
+func TestParseTunnelTargetsRestart(t *testing.T) {
+	config := `{"tunnels": [
+	{"name": "a", "ssm_config": {"local_port": "5440", "remote_port": "5432", "instance_name": "bastion",
+		"restart": {"policy": "sometimes"}},
+		"transports": [
+			{"ssh_config": {"remote_port": "5432", "host": "bastion:22", "restart": {"policy": "always", "initial_backoff": "soon"}}},
+			{"k8s_config": {"remote_port": "5432", "service": "db", "restart": {"policy": "on-failure", "max_backoff": "1m"}}}
+		]}
+]}`
+	_, err := ParseTunnelTargets("tunny.json", []byte(config))
+	if err == nil {
+		t.Fatalf("Expected restart errors")
+	}
+	for _, want := range []string{
+		`tunny.json:3:14: tunnels[0].ssm_config.restart: unknown restart policy "sometimes"`,
+		`tunnels[0].transports[0].ssh_config.restart: bad initial_backoff "soon"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error like %q in:\n%s", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "transports[1]") {
+		t.Errorf("Expected the k8s restart to be fine, got:\n%s", err)
+	}
+}
+
+func TestParseTunnelTargetsSyntaxAndTypes(t *testing.T) {
+	_, err := ParseTunnelTargets("tunny.json", []byte("{\n\t\"tunnels\": [\n\t\t{\"name\": \"a\",}\n\t]\n}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "tunny.json:3:16: ") {
+		t.Errorf("Expected a syntax error on line 3, got %v", err)
+	}
+
+	_, err = ParseTunnelTargets("tunny.json", []byte("{\"tunnels\": [{\"name\": \"a\", \"ssm_config\": {\"local_port\": 5432}}]}"))
+	if err == nil || !strings.Contains(err.Error(), "expected string, got number") {
+		t.Errorf("Expected a type error, got %v", err)
+	}
+
+	// The rest is still checked with the wrong types in it
+	config := `{"tunnels": [
+	{"name": "a", "ssm_config": {"local_port": 5440, "remote_port": "5432", "instance_name": "bastion"}},
+	{"name": "a", "ssm_config": {"local_port": "5441", "instance_name": ["bastion"]},
+		"k8s_config": {"local_port": "5441", "remote_port": "http", "service": "api"}}
+]}`
+	_, err = ParseTunnelTargets("tunny.json", []byte(config))
+	if err == nil {
+		t.Fatalf("Expected errors")
+	}
+	for _, want := range []string{
+		`tunny.json:2:45: tunnels[0].ssm_config.local_port: expected string, got number`,
+		`tunnels[1].ssm_config.instance_name: expected string, got array`,
+		`tunnels[1].name: name "a" is already used by tunnels[0]`,
+		`tunnels[1].k8s_config: ssm_config is already set`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error like %q in:\n%s", want, err)
+		}
+	}
+}
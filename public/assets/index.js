@@ -2,6 +2,39 @@ document.addEventListener("alpine:init", async () => {
     Alpine.store('top', {
         state: {},
         loaded: false,
+        // Answers being typed, kept out of state so a refresh doesn't wipe them
+        answers: {},
+        async answerPrompt(id) {
+            await fetch("/api/prompts/answer", {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify({ id: id, answer: this.answers[id] || "" }),
+            });
+            delete this.answers[id];
+            await this.fetchData();
+        },
+        // Every group the targets are in
+        groups() {
+            const groups = new Set();
+            for (const target of this.state.targets || []) {
+                for (const group of target.groups || []) {
+                    groups.add(group);
+                }
+            }
+            return [...groups].sort();
+        },
+        // Start or stop targets, action is "start" or "stop" and selection has names and/or groups
+        async changeTargets(action, selection) {
+            const response = await fetch("/api/targets/" + action, {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify(selection),
+            });
+            if (!response.ok) {
+                console.log("Couldn't " + action + " targets: " + await response.text());
+            }
+            await this.fetchData();
+        },
         async fetchData() {
             const response = await fetch("/api/state");
             const data = await response.json();
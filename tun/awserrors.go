@@ -0,0 +1,57 @@
+package tun
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Error codes from the sdk that mean the credentials are missing, expired or no good
+var credentialsErrorCodes = map[string]bool{
+	"NoCredentialProviders":       true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+	"SSOProviderInvalidToken":     true,
+	"InvalidGrantException":       true,
+	"UnauthorizedException":       true,
+}
+
+// Bits of text the aws cli prints when the credentials are the problem
+var credentialsErrorMessages = []string{
+	"sso session associated with this profile has expired",
+	"error loading sso token",
+	"token has expired and refresh failed",
+	"error when retrieving token from sso",
+	"unable to locate credentials",
+	"security token included in the request is expired",
+	"security token included in the request is invalid",
+	"expiredtoken",
+	"unrecognizedclientexception",
+}
+
+/*
+IsCredentialsError tells whether an error (from the sdk or the aws cli's output) is down to
+missing or expired credentials, typically an SSO session that needs logging into again.
+*/
+func IsCredentialsError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && credentialsErrorCodes[aerr.Code()] {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, known := range credentialsErrorMessages {
+		if strings.Contains(msg, known) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,36 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestIsCredentialsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"no credentials", credentials.ErrNoValidProvidersFoundInChain, true},
+		{"expired token", awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil), true},
+		{"wrapped sdk error", fmt.Errorf("describing instances: %w", awserr.New("InvalidClientTokenId", "bad", nil)), true},
+		{"other sdk error", awserr.New("AccessDeniedException", "not allowed", nil), false},
+		{"expired sso session from the cli", errors.New("exit status 255: Error when retrieving token from sso: Token has expired and refresh failed"), true},
+		{"missing credentials from the cli", errors.New("exit status 253: Unable to locate credentials. You can configure credentials by running \"aws configure\"."), true},
+		{"other cli error", errors.New("exit status 254: An error occurred (TargetNotConnected) when calling the StartSession operation"), false},
+		{"unrelated", errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := IsCredentialsError(test.err); actual != test.expected {
+				t.Errorf("Expected %v for %v, got %v", test.expected, test.err, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// How long a tunnel command gets to become ready when nothing else is said
+const defaultCommandStartupTimeout = 30 * time.Second
+
+// An external command that runs a tunnel, e.g. gcloud's IAP tunnel or cloudflared access
+type CommandTunnel struct {
+	// The command and its arguments
+	Args []string
+
+	// Added to tunny's own environment, NAME=value
+	Env []string
+
+	// The working directory, tunny's own when empty
+	Dir string
+
+	// How to tell the tunnel is up, the timeout defaults to 30s.
+	// With neither a pattern nor an address it's ready as soon as it's started.
+	Readiness Readiness
+
+	// Called once the tunnel is ready
+	OnReady func()
+
+	// Called with every line the command prints, as it's printed
+	OnOutput func(stream OutputStream, line string)
+
+	// Connect to KeepaliveAddress this often once it's ready, 0 turns it off
+	KeepaliveAddress  string
+	KeepaliveInterval time.Duration
+}
+
+/*
+StartCommandTunnel runs the command in its own process group, the whole group is stopped
+when ctx is done. A command that isn't ready in time is stopped and reported as a startup
+failure along with what it printed.
+
+The eventual error channel gets the command's error if it fails, and is closed once it
+has exited.
+*/
+func StartCommandTunnel(ctx context.Context, tunnel CommandTunnel) (ocmdErr <-chan error, startErr error) {
+	if len(tunnel.Args) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+
+	log.Printf("Starting command: \"%s\"\n", tunnel.Args)
+
+	// Set up the command, its lifetime is handled by startGroupProcess rather than the context
+	cmd := exec.Command(tunnel.Args[0], tunnel.Args[1:]...)
+	if tunnel.Env != nil {
+		cmd.Env = append(os.Environ(), tunnel.Env...)
+	}
+	cmd.Dir = tunnel.Dir
+
+	readiness := tunnel.Readiness
+	if readiness.Timeout <= 0 {
+		readiness.Timeout = defaultCommandStartupTimeout
+	}
+	watcher := newReadinessWatcher(readiness)
+	if readiness.OutputPattern == nil && readiness.ProbeAddress == "" {
+		watcher.markReady()
+	}
+
+	output := newOutputTail(50)
+	errBits := newOutputTail(50)
+	stdout := &lineWriter{onLine: func(line string) {
+		output.add(line)
+		watcher.line(line)
+		if tunnel.OnOutput != nil {
+			tunnel.OnOutput(Stdout, line)
+		}
+	}}
+	stderr := &lineWriter{onLine: func(line string) {
+		output.add(line)
+		errBits.add(line)
+		// Plenty of tools say they're ready on stderr
+		watcher.line(line)
+		if tunnel.OnOutput != nil {
+			tunnel.OnOutput(Stderr, line)
+		}
+	}}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Start the command
+	procCtx, stopProc := context.WithCancel(ctx)
+	proc, err := startGroupProcess(procCtx, cmd, defaultGracePeriod)
+	if err != nil {
+		stopProc()
+		return nil, err
+	}
+
+	cmdErr := make(chan error, 1)
+	ocmdErr = cmdErr
+
+	// This goroutine waits for the tunnel to be ready, and gives up on it if it takes too long
+	startupErr := make(chan error, 1)
+	go func() {
+		if err := watcher.wait(procCtx, proc.Done()); err != nil {
+			if procCtx.Err() == nil && err != errExitedBeforeReady {
+				startupErr <- err
+				stopProc()
+			}
+			return
+		}
+		if tunnel.OnReady != nil {
+			tunnel.OnReady()
+		}
+		if tunnel.KeepaliveInterval > 0 && tunnel.KeepaliveAddress != "" {
+			keepAlive(procCtx, tunnel.KeepaliveAddress, tunnel.KeepaliveInterval)
+		}
+	}()
+
+	// This goroutine will wait for the command to finish, and then close the cmdErr channel
+	go func() {
+		defer stopProc()
+		<-proc.Done()
+		stdout.Flush()
+		stderr.Flush()
+
+		select {
+		case err := <-startupErr:
+			log.Printf("Tunnel failed to start: %v", err)
+			cmdErr <- fmt.Errorf("startup failed, %v, output:\n%s", err, output.String())
+		default:
+			if err := proc.Err(); err != nil {
+				log.Printf("Command finished with error: %v", err)
+				log.Printf("Stderr: %s", errBits.String())
+				// Capture the stderr and wrap it along with the original error
+				cmdErr <- fmt.Errorf("%v: %s", err, errBits.String())
+			}
+		}
+		close(cmdErr)
+	}()
+
+	return
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandTunnelReadyFromStderr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := make(chan struct{})
+	eventual, err := StartCommandTunnel(ctx, CommandTunnel{
+		Args: []string{"sh", "-c", "echo \"listening on $TUNNEL_PORT\" >&2; sleep 100"},
+		Env:  []string{"TUNNEL_PORT=4242"},
+		Readiness: Readiness{
+			OutputPattern: regexp.MustCompile(`listening on 4242`),
+			Timeout:       5 * time.Second,
+		},
+		OnReady: func() { close(ready) },
+	})
+	if err != nil {
+		t.Fatalf("Error starting command: %s", err)
+	}
+
+	select {
+	case <-ready:
+	case err := <-eventual:
+		t.Fatalf("Command ended before it was ready: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Command never became ready")
+	}
+
+	cancel()
+	select {
+	case <-eventual:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Command wasn't stopped after cancelling")
+	}
+}
+
+func TestCommandTunnelStartupTimeout(t *testing.T) {
+	eventual, err := StartCommandTunnel(context.Background(), CommandTunnel{
+		Args: []string{"sh", "-c", "echo still thinking; sleep 100"},
+		Readiness: Readiness{
+			OutputPattern: regexp.MustCompile(`never printed`),
+			Timeout:       300 * time.Millisecond,
+		},
+		OnReady: func() { t.Errorf("Command shouldn't have been ready") },
+	})
+	if err != nil {
+		t.Fatalf("Error starting command: %s", err)
+	}
+
+	select {
+	case err := <-eventual:
+		if err == nil || !strings.Contains(err.Error(), "startup failed") || !strings.Contains(err.Error(), "still thinking") {
+			t.Errorf("Expected a startup failure with the output, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Command wasn't given up on")
+	}
+}
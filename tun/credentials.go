@@ -0,0 +1,126 @@
+package tun
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Everything needed to assume a role, also used as the cache key
+type AssumeRoleSpec struct {
+	RoleArn    string
+	ExternalId string
+	MfaSerial  string
+	Duration   time.Duration
+
+	// Where sts is, the real one when empty
+	StsEndpoint string
+}
+
+// Asked for an MFA code whenever an assumed role needs to be refreshed
+type MfaTokenProvider func(spec AssumeRoleSpec) (string, error)
+
+/*
+RoleCredentialCache hands out one set of assumed role credentials per AssumeRoleSpec.
+
+The credentials are refreshed lazily once they expire, and concurrent callers share
+a single refresh, so several targets using the same role only prompt for MFA once.
+*/
+type RoleCredentialCache struct {
+	lock  sync.Mutex
+	creds map[AssumeRoleSpec]*credentials.Credentials
+}
+
+func NewRoleCredentialCache() *RoleCredentialCache {
+	return &RoleCredentialCache{creds: make(map[AssumeRoleSpec]*credentials.Credentials)}
+}
+
+// Get (or create) the credentials for the given role, they're only actually fetched when first used
+func (c *RoleCredentialCache) Get(spec AssumeRoleSpec, tokenProvider MfaTokenProvider) (*credentials.Credentials, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if creds, ok := c.creds[spec]; ok {
+		return creds, nil
+	}
+
+	sess, err := newSession(DefaultRegion(), nil, AwsOverrides{StsEndpoint: spec.StsEndpoint})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := stscreds.NewCredentials(sess, spec.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+		if spec.ExternalId != "" {
+			p.ExternalID = aws.String(spec.ExternalId)
+		}
+		if spec.MfaSerial != "" {
+			p.SerialNumber = aws.String(spec.MfaSerial)
+			p.TokenProvider = func() (string, error) {
+				if tokenProvider == nil {
+					return "", fmt.Errorf("role %s requires an mfa code but nothing can ask for one", spec.RoleArn)
+				}
+				return tokenProvider(spec)
+			}
+		}
+		if spec.Duration > 0 {
+			p.Duration = spec.Duration
+		}
+		// Refresh a little early so a session doesn't get handed credentials about to expire
+		p.ExpiryWindow = 1 * time.Minute
+	})
+
+	c.creds[spec] = creds
+	return creds, nil
+}
+
+// Turn credentials into the environment variables the aws cli understands
+func credentialsEnv(creds *credentials.Credentials) ([]string, error) {
+	if creds == nil {
+		return nil, nil
+	}
+
+	value, err := creds.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + value.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + value.SecretAccessKey,
+	}
+	if value.SessionToken != "" {
+		env = append(env, "AWS_SESSION_TOKEN="+value.SessionToken)
+	}
+
+	return env, nil
+}
+
+// The region from the environment, the same way the aws cli picks it, us-west-2 otherwise
+func DefaultRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	return "us-west-2"
+}
+
+/*
+Make a session for the region, using the given credentials or the default chain when nil.
+Overridden endpoints are used, and anything not overridden can still be from the environment.
+*/
+func newSession(region string, creds *credentials.Credentials, overrides AwsOverrides) (*session.Session, error) {
+	overrides = overrides.Or(AwsOverridesFromEnv())
+
+	return session.NewSession(&aws.Config{
+		Region:           aws.String(region),
+		Credentials:      creds,
+		EndpointResolver: overrides.resolver(),
+	})
+}
@@ -0,0 +1,151 @@
+package tun
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Answers AssumeRole, counting the calls and checking what they were signed for
+type fakeSts struct {
+	lock    sync.Mutex
+	calls   int
+	lastMfa string
+}
+
+func (f *fakeSts) serve(t *testing.T, region string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "AssumeRole" {
+			t.Errorf("Unexpected sts request %v (%v)", r.Form, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/"+region+"/sts/") {
+			t.Errorf("Expected the request to be signed for %s, got %s", region, r.Header.Get("Authorization"))
+		}
+
+		f.lock.Lock()
+		f.calls++
+		f.lastMfa = r.Form.Get("TokenCode")
+		calls := f.calls
+		f.lock.Unlock()
+
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+	<AssumeRoleResult>
+		<Credentials>
+			<AccessKeyId>ASIA%d</AccessKeyId>
+			<SecretAccessKey>secret-for-%s</SecretAccessKey>
+			<SessionToken>token-%s</SessionToken>
+			<Expiration>%s</Expiration>
+		</Credentials>
+		<AssumedRoleUser><Arn>%s</Arn><AssumedRoleId>AROA1:tunny</AssumedRoleId></AssumedRoleUser>
+	</AssumeRoleResult>
+	<ResponseMetadata><RequestId>%d</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`, calls, r.Form.Get("ExternalId"), r.Form.Get("RoleArn"),
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339), r.Form.Get("RoleArn"), calls)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRoleCredentialCache(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_REGION", "eu-central-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	sts := &fakeSts{}
+	server := sts.serve(t, "eu-central-1")
+
+	cache := NewRoleCredentialCache()
+	spec := AssumeRoleSpec{RoleArn: "arn:aws:iam::1:role/db", ExternalId: "ext", StsEndpoint: server.URL}
+	first, err := cache.Get(spec, nil)
+	if err != nil {
+		t.Fatalf("Error getting credentials: %s", err)
+	}
+	second, _ := cache.Get(spec, nil)
+	if first != second {
+		t.Errorf("Expected the same role to share credentials")
+	}
+	other, _ := cache.Get(AssumeRoleSpec{RoleArn: "arn:aws:iam::1:role/api", StsEndpoint: server.URL}, nil)
+	if other == first {
+		t.Errorf("Expected another role to get credentials of its own")
+	}
+
+	// Nothing's fetched until they're used, and then only once while they're good
+	if sts.calls != 0 {
+		t.Errorf("Expected no sts calls before the credentials are used, got %d", sts.calls)
+	}
+	env, err := credentialsEnv(first)
+	if err != nil {
+		t.Fatalf("Error getting the credentials: %s", err)
+	}
+	if _, err := credentialsEnv(second); err != nil {
+		t.Fatalf("Error getting the credentials: %s", err)
+	}
+	if sts.calls != 1 {
+		t.Errorf("Expected one sts call for the shared credentials, got %d", sts.calls)
+	}
+	expected := []string{"AWS_ACCESS_KEY_ID=ASIA1", "AWS_SECRET_ACCESS_KEY=secret-for-ext", "AWS_SESSION_TOKEN=token-arn:aws:iam::1:role/db"}
+	if strings.Join(env, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+}
+
+func TestRoleCredentialCacheMfa(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_REGION", "us-east-2")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	sts := &fakeSts{}
+	server := sts.serve(t, "us-east-2")
+
+	spec := AssumeRoleSpec{RoleArn: "arn:aws:iam::1:role/admin", MfaSerial: "arn:aws:iam::1:mfa/me", StsEndpoint: server.URL}
+	asked := 0
+	creds, err := NewRoleCredentialCache().Get(spec, func(asking AssumeRoleSpec) (string, error) {
+		asked++
+		if asking != spec {
+			t.Errorf("Expected to be asked for %+v, got %+v", spec, asking)
+		}
+		return "123456", nil
+	})
+	if err != nil {
+		t.Fatalf("Error getting credentials: %s", err)
+	}
+	if _, err := creds.Get(); err != nil {
+		t.Fatalf("Error getting the credentials: %s", err)
+	}
+	if asked != 1 || sts.lastMfa != "123456" {
+		t.Errorf("Expected the mfa code to be asked for once and sent, asked %d times and sent %q", asked, sts.lastMfa)
+	}
+
+	// Nothing to ask with
+	creds, _ = NewRoleCredentialCache().Get(spec, nil)
+	if _, err := creds.Get(); err == nil || !strings.Contains(err.Error(), "requires an mfa code") {
+		t.Errorf("Expected an error about the mfa code, got %v", err)
+	}
+}
+
+func TestCredentialsEnv(t *testing.T) {
+	if env, err := credentialsEnv(nil); env != nil || err != nil {
+		t.Errorf("Expected nothing for no credentials, got %v, %v", env, err)
+	}
+
+	env, err := credentialsEnv(credentials.NewStaticCredentials("AKIA1", "secret", ""))
+	if err != nil {
+		t.Fatalf("Error getting the credentials: %s", err)
+	}
+	if strings.Join(env, " ") != "AWS_ACCESS_KEY_ID=AKIA1 AWS_SECRET_ACCESS_KEY=secret" {
+		t.Errorf("Expected no session token without one, got %v", env)
+	}
+
+	if _, err := credentialsEnv(credentials.NewStaticCredentials("", "", "")); err == nil {
+		t.Errorf("Expected empty credentials to be an error")
+	}
+}
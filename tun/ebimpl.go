@@ -0,0 +1,144 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
+)
+
+// An instance of a beanstalk environment to start an ssm session against, and how the environment is doing
+type BeanstalkTarget struct {
+	InstanceId string
+	// The region the environment was found in, sessions to the instance have to be started there
+	Region string
+
+	EnvironmentId   string
+	EnvironmentName string
+	ApplicationName string
+
+	// What the environment is doing, e.g. "Ready" or "Updating"
+	Status string
+	// The environment's health colour, e.g. "Green", and with enhanced health its status, e.g. "Ok"
+	Health       string
+	HealthStatus string
+}
+
+// The status and health in one line, for the monitor
+func (t *BeanstalkTarget) Describe() string {
+	health := t.Health
+	if t.HealthStatus != "" {
+		health = fmt.Sprintf("%s (%s)", t.Health, t.HealthStatus)
+	}
+	return fmt.Sprintf("%s, health %s", t.Status, health)
+}
+
+/*
+ResolveBeanstalkEnv looks the environment up with the beanstalk api in the one region and picks
+a running instance of it, rather than scanning every region's instances for beanstalk's tags.
+applicationName can be left empty unless several applications have an environment by that name.
+Environments that are terminating (or terminated) are refused.
+It's meant to be called every time a session starts, instances are replaced by deploys and scaling.
+*/
+func ResolveBeanstalkEnv(
+	ctx context.Context,
+	region string,
+	creds *credentials.Credentials,
+	overrides AwsOverrides,
+	applicationName string,
+	environmentName string,
+) (*BeanstalkTarget, error) {
+	sess, err := newSession(region, creds, overrides)
+	if err != nil {
+		return nil, err
+	}
+	eb := elasticbeanstalk.New(sess)
+
+	input := &elasticbeanstalk.DescribeEnvironmentsInput{
+		EnvironmentNames: aws.StringSlice([]string{environmentName}),
+		IncludeDeleted:   aws.Bool(false),
+	}
+	if applicationName != "" {
+		input.ApplicationName = aws.String(applicationName)
+	}
+	described, err := eb.DescribeEnvironmentsWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	var envs []*elasticbeanstalk.EnvironmentDescription
+	for _, env := range described.Environments {
+		if aws.StringValue(env.EnvironmentName) == environmentName {
+			envs = append(envs, env)
+		}
+	}
+	if len(envs) == 0 {
+		if applicationName != "" {
+			return nil, fmt.Errorf("no beanstalk environment %s in application %s in %s", environmentName, applicationName, region)
+		}
+		return nil, fmt.Errorf("no beanstalk environment %s in %s", environmentName, region)
+	}
+	if len(envs) > 1 {
+		applications := make([]string, 0, len(envs))
+		for _, env := range envs {
+			applications = append(applications, aws.StringValue(env.ApplicationName))
+		}
+		return nil, fmt.Errorf("there are beanstalk environments named %s in applications %s, say which with application_name",
+			environmentName, strings.Join(applications, ", "))
+	}
+	env := envs[0]
+
+	target := &BeanstalkTarget{
+		Region:          region,
+		EnvironmentId:   aws.StringValue(env.EnvironmentId),
+		EnvironmentName: aws.StringValue(env.EnvironmentName),
+		ApplicationName: aws.StringValue(env.ApplicationName),
+		Status:          aws.StringValue(env.Status),
+		Health:          aws.StringValue(env.Health),
+		HealthStatus:    aws.StringValue(env.HealthStatus),
+	}
+
+	switch target.Status {
+	case elasticbeanstalk.EnvironmentStatusTerminating, elasticbeanstalk.EnvironmentStatusTerminated:
+		return target, fmt.Errorf("beanstalk environment %s is %s, not tunneling into it", environmentName, strings.ToLower(target.Status))
+	}
+
+	resources, err := eb.DescribeEnvironmentResourcesWithContext(ctx, &elasticbeanstalk.DescribeEnvironmentResourcesInput{
+		EnvironmentId: env.EnvironmentId,
+	})
+	if err != nil {
+		return target, err
+	}
+
+	instanceIds := []*string{}
+	if resources.EnvironmentResources != nil {
+		for _, instance := range resources.EnvironmentResources.Instances {
+			instanceIds = append(instanceIds, instance.Id)
+		}
+	}
+	if len(instanceIds) == 0 {
+		return target, fmt.Errorf("beanstalk environment %s has no instances", environmentName)
+	}
+
+	// Beanstalk lists instances that are still starting or going away too, only a running one will do
+	instances, err := ec2.New(sess).DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIds,
+	})
+	if err != nil {
+		return target, err
+	}
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State != nil && aws.StringValue(instance.State.Name) == ec2.InstanceStateNameRunning {
+				target.InstanceId = aws.StringValue(instance.InstanceId)
+				return target, nil
+			}
+		}
+	}
+
+	return target, fmt.Errorf("none of the %d instances of beanstalk environment %s are running", len(instanceIds), environmentName)
+}
@@ -0,0 +1,138 @@
+package tun_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tunny/tun"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+type fakeBeanstalkEnv struct {
+	id          string
+	name        string
+	application string
+	status      string
+	health      string
+	// Instance ids and whether each is running
+	instances map[string]bool
+}
+
+// Answers the beanstalk and ec2 calls resolving an environment makes, from the envs given
+func fakeBeanstalk(t *testing.T, envs ...fakeBeanstalkEnv) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Bad request: %s", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/xml")
+		switch r.Form.Get("Action") {
+		case "DescribeEnvironments":
+			members := ""
+			for _, env := range envs {
+				if env.name != r.Form.Get("EnvironmentNames.member.1") {
+					continue
+				}
+				if app := r.Form.Get("ApplicationName"); app != "" && app != env.application {
+					continue
+				}
+				members += fmt.Sprintf(`<member><EnvironmentId>%s</EnvironmentId><EnvironmentName>%s</EnvironmentName>`+
+					`<ApplicationName>%s</ApplicationName><Status>%s</Status><Health>%s</Health></member>`,
+					env.id, env.name, env.application, env.status, env.health)
+			}
+			fmt.Fprintf(w, `<DescribeEnvironmentsResponse xmlns="http://elasticbeanstalk.amazonaws.com/docs/2010-12-01/">
+	<DescribeEnvironmentsResult><Environments>%s</Environments></DescribeEnvironmentsResult>
+</DescribeEnvironmentsResponse>`, members)
+		case "DescribeEnvironmentResources":
+			members := ""
+			for _, env := range envs {
+				if env.id == r.Form.Get("EnvironmentId") {
+					for instance := range env.instances {
+						members += fmt.Sprintf("<member><Id>%s</Id></member>", instance)
+					}
+				}
+			}
+			fmt.Fprintf(w, `<DescribeEnvironmentResourcesResponse xmlns="http://elasticbeanstalk.amazonaws.com/docs/2010-12-01/">
+	<DescribeEnvironmentResourcesResult><EnvironmentResources><Instances>%s</Instances></EnvironmentResources></DescribeEnvironmentResourcesResult>
+</DescribeEnvironmentResourcesResponse>`, members)
+		case "DescribeInstances":
+			items := ""
+			for _, env := range envs {
+				for instance, running := range env.instances {
+					state := "stopped"
+					if running {
+						state = "running"
+					}
+					items += fmt.Sprintf("<item><instanceId>%s</instanceId><instanceState><code>0</code><name>%s</name></instanceState></item>", instance, state)
+				}
+			}
+			fmt.Fprintf(w, `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+	<requestId>1</requestId>
+	<reservationSet><item><reservationId>r-1</reservationId><instancesSet>%s</instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`, items)
+		default:
+			t.Errorf("Unexpected action %q", r.Form.Get("Action"))
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolveBeanstalkEnv(t *testing.T) {
+	server := fakeBeanstalk(t,
+		fakeBeanstalkEnv{id: "e-1", name: "api-prod", application: "api", status: "Ready", health: "Green",
+			instances: map[string]bool{"i-stopped": false, "i-running": true}},
+		fakeBeanstalkEnv{id: "e-2", name: "worker", application: "jobs", status: "Ready", health: "Yellow",
+			instances: map[string]bool{"i-worker": true}},
+		fakeBeanstalkEnv{id: "e-3", name: "worker", application: "reports", status: "Ready", health: "Green",
+			instances: map[string]bool{"i-reports": true}},
+		fakeBeanstalkEnv{id: "e-4", name: "old", application: "api", status: "Terminating", health: "Grey",
+			instances: map[string]bool{"i-old": true}},
+	)
+	overrides := tun.AwsOverrides{BeanstalkEndpoint: server.URL, Ec2Endpoint: server.URL}
+	creds := credentials.NewStaticCredentials("AKIAFAKE", "fake", "")
+	ctx := context.Background()
+
+	env, err := tun.ResolveBeanstalkEnv(ctx, "eu-central-1", creds, overrides, "", "api-prod")
+	if err != nil {
+		t.Fatalf("Error resolving api-prod: %s", err)
+	}
+	if env.InstanceId != "i-running" || env.Region != "eu-central-1" {
+		t.Errorf("Expected the running instance in eu-central-1, got %q in %q", env.InstanceId, env.Region)
+	}
+	if env.Describe() != "Ready, health Green" {
+		t.Errorf("Unexpected description %q", env.Describe())
+	}
+
+	_, err = tun.ResolveBeanstalkEnv(ctx, "us-west-2", creds, overrides, "", "worker")
+	if err == nil || !strings.Contains(err.Error(), "application_name") {
+		t.Errorf("Expected an ambiguous environment error, got %v", err)
+	}
+
+	env, err = tun.ResolveBeanstalkEnv(ctx, "us-west-2", creds, overrides, "reports", "worker")
+	if err != nil {
+		t.Fatalf("Error resolving worker in reports: %s", err)
+	}
+	if env.EnvironmentId != "e-3" {
+		t.Errorf("Expected the reports environment, got %s", env.EnvironmentId)
+	}
+
+	env, err = tun.ResolveBeanstalkEnv(ctx, "us-west-2", creds, overrides, "", "old")
+	if err == nil || !strings.Contains(err.Error(), "terminating") {
+		t.Errorf("Expected a terminating environment to be refused, got %v", err)
+	}
+	if env == nil || env.Status != "Terminating" {
+		t.Errorf("Expected the terminating environment to still be described, got %+v", env)
+	}
+
+	_, err = tun.ResolveBeanstalkEnv(ctx, "us-west-2", creds, overrides, "", "missing")
+	if err == nil {
+		t.Errorf("Expected a missing environment to fail")
+	}
+}
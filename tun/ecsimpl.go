@@ -0,0 +1,101 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// A running container that an ssm session can be started against
+type EcsTaskTarget struct {
+	// What to pass to start-session's --target, ecs:<cluster>_<taskid>_<runtimeid>
+	SsmTarget string
+
+	TaskArn   string
+	Container string
+}
+
+// The last part of an arn (or the whole thing if it isn't one)
+func arnName(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+/*
+ResolveEcsTarget picks a running task of the service and builds the ssm target for one of
+its containers (the named one, or the first that can be reached when container is empty).
+It's meant to be called again every time a session starts, tasks come and go with deploys.
+*/
+func ResolveEcsTarget(
+	ctx context.Context,
+	region string,
+	creds *credentials.Credentials,
+	overrides AwsOverrides,
+	cluster string,
+	service string,
+	container string,
+) (*EcsTaskTarget, error) {
+	sess, err := newSession(region, creds, overrides)
+	if err != nil {
+		return nil, err
+	}
+	svc := ecs.New(sess)
+
+	listed, err := svc.ListTasksWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(listed.TaskArns) == 0 {
+		return nil, fmt.Errorf("no running tasks for service %s in cluster %s", service, cluster)
+	}
+
+	described, err := svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(cluster),
+		Tasks:   listed.TaskArns,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pickEcsContainer(cluster, service, container, described.Tasks)
+}
+
+// The ssm target for the container (or the first that can be reached) of the first running task that has it
+func pickEcsContainer(cluster string, service string, container string, tasks []*ecs.Task) (*EcsTaskTarget, error) {
+	for _, task := range tasks {
+		if aws.StringValue(task.LastStatus) != ecs.DesiredStatusRunning {
+			continue
+		}
+
+		for _, taskContainer := range task.Containers {
+			if container != "" && aws.StringValue(taskContainer.Name) != container {
+				continue
+			}
+			if aws.StringValue(taskContainer.RuntimeId) == "" {
+				continue
+			}
+
+			return &EcsTaskTarget{
+				SsmTarget: fmt.Sprintf(
+					"ecs:%s_%s_%s",
+					arnName(cluster),
+					arnName(aws.StringValue(task.TaskArn)),
+					aws.StringValue(taskContainer.RuntimeId)),
+				TaskArn:   aws.StringValue(task.TaskArn),
+				Container: aws.StringValue(taskContainer.Name),
+			}, nil
+		}
+	}
+
+	if container != "" {
+		return nil, fmt.Errorf("no running task of service %s has a running container named %s", service, container)
+	}
+	return nil, fmt.Errorf("no running task of service %s has a running container", service)
+}
@@ -0,0 +1,61 @@
+package tun
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestPickEcsContainer(t *testing.T) {
+	task := func(id string, status string, containers ...*ecs.Container) *ecs.Task {
+		return &ecs.Task{
+			TaskArn:    aws.String("arn:aws:ecs:eu-west-1:1:task/prod/" + id),
+			LastStatus: aws.String(status),
+			Containers: containers,
+		}
+	}
+	container := func(name string, runtimeId string) *ecs.Container {
+		c := &ecs.Container{Name: aws.String(name)}
+		if runtimeId != "" {
+			c.RuntimeId = aws.String(runtimeId)
+		}
+		return c
+	}
+	tasks := []*ecs.Task{
+		task("stopping", "DEPROVISIONING", container("api", "old-1")),
+		task("0123abcd", "RUNNING", container("sidecar", ""), container("api", "0123abcd-456"), container("worker", "0123abcd-789")),
+	}
+	cluster := "arn:aws:ecs:eu-west-1:1:cluster/prod"
+
+	for _, test := range []struct {
+		container string
+		target    string
+		err       string
+	}{
+		// The first container that can be reached, the sidecar hasn't started
+		{container: "", target: "ecs:prod_0123abcd_0123abcd-456"},
+		{container: "worker", target: "ecs:prod_0123abcd_0123abcd-789"},
+		{container: "cron", err: "has a running container named cron"},
+	} {
+		picked, err := pickEcsContainer(cluster, "api", test.container, tasks)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error like %q for %q, got %v", test.err, test.container, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error picking %q: %s", test.container, err)
+			continue
+		}
+		if picked.SsmTarget != test.target || !strings.HasSuffix(picked.TaskArn, "/0123abcd") {
+			t.Errorf("Expected %s for %q, got %+v", test.target, test.container, picked)
+		}
+	}
+
+	if _, err := pickEcsContainer(cluster, "api", "", tasks[:1]); err == nil {
+		t.Errorf("Expected no target when no task is running")
+	}
+}
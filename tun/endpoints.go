@@ -0,0 +1,145 @@
+package tun
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+/*
+AwsOverrides points tunny at something other than the real AWS, e.g. localstack or a fake
+on a disconnected machine. Empty fields fall back to the environment and then to the real
+endpoints and binaries. It's comparable so it can be part of cache keys.
+*/
+type AwsOverrides struct {
+	// Endpoint urls for each service
+	Ec2Endpoint            string
+	SsmEndpoint            string
+	StsEndpoint            string
+	RdsEndpoint            string
+	BeanstalkEndpoint      string
+	SecretsManagerEndpoint string
+	EcsEndpoint            string
+
+	// Used for every service without its own endpoint, only ever set from AWS_ENDPOINT_URL
+	DefaultEndpoint string
+
+	// The aws cli to run, "aws" from the PATH by default
+	AwsCliPath string
+
+	// The session-manager-plugin the aws cli should run. The cli looks for it by name on the
+	// PATH, so its directory goes first on the PATH and it has to keep that name.
+	PluginPath string
+}
+
+/*
+The overrides from the environment: AWS_ENDPOINT_URL and AWS_ENDPOINT_URL_<SERVICE>, the same
+variables newer aws clis and sdks understand, plus TUNNY_AWS_CLI and TUNNY_SESSION_MANAGER_PLUGIN.
+*/
+func AwsOverridesFromEnv() AwsOverrides {
+	return AwsOverrides{
+		Ec2Endpoint:            os.Getenv("AWS_ENDPOINT_URL_EC2"),
+		SsmEndpoint:            os.Getenv("AWS_ENDPOINT_URL_SSM"),
+		StsEndpoint:            os.Getenv("AWS_ENDPOINT_URL_STS"),
+		RdsEndpoint:            os.Getenv("AWS_ENDPOINT_URL_RDS"),
+		BeanstalkEndpoint:      os.Getenv("AWS_ENDPOINT_URL_ELASTIC_BEANSTALK"),
+		SecretsManagerEndpoint: os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER"),
+		EcsEndpoint:            os.Getenv("AWS_ENDPOINT_URL_ECS"),
+		DefaultEndpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+		AwsCliPath:             os.Getenv("TUNNY_AWS_CLI"),
+		PluginPath:             os.Getenv("TUNNY_SESSION_MANAGER_PLUGIN"),
+	}
+}
+
+// The overrides with anything left empty taken from fallback
+func (o AwsOverrides) Or(fallback AwsOverrides) AwsOverrides {
+	or := func(value string, other string) string {
+		if value != "" {
+			return value
+		}
+		return other
+	}
+
+	return AwsOverrides{
+		Ec2Endpoint:            or(o.Ec2Endpoint, fallback.Ec2Endpoint),
+		SsmEndpoint:            or(o.SsmEndpoint, fallback.SsmEndpoint),
+		StsEndpoint:            or(o.StsEndpoint, fallback.StsEndpoint),
+		RdsEndpoint:            or(o.RdsEndpoint, fallback.RdsEndpoint),
+		BeanstalkEndpoint:      or(o.BeanstalkEndpoint, fallback.BeanstalkEndpoint),
+		SecretsManagerEndpoint: or(o.SecretsManagerEndpoint, fallback.SecretsManagerEndpoint),
+		EcsEndpoint:            or(o.EcsEndpoint, fallback.EcsEndpoint),
+		DefaultEndpoint:        or(o.DefaultEndpoint, fallback.DefaultEndpoint),
+		AwsCliPath:             or(o.AwsCliPath, fallback.AwsCliPath),
+		PluginPath:             or(o.PluginPath, fallback.PluginPath),
+	}
+}
+
+// The endpoint url for a service (by its sdk endpoints id), empty for the real one
+func (o AwsOverrides) endpointFor(service string) string {
+	var endpoint string
+	switch service {
+	case endpoints.Ec2ServiceID:
+		endpoint = o.Ec2Endpoint
+	case endpoints.SsmServiceID:
+		endpoint = o.SsmEndpoint
+	case endpoints.StsServiceID:
+		endpoint = o.StsEndpoint
+	case endpoints.RdsServiceID:
+		endpoint = o.RdsEndpoint
+	case elasticbeanstalk.EndpointsID:
+		endpoint = o.BeanstalkEndpoint
+	case secretsmanager.EndpointsID:
+		endpoint = o.SecretsManagerEndpoint
+	case ecs.EndpointsID:
+		endpoint = o.EcsEndpoint
+	}
+
+	if endpoint == "" {
+		return o.DefaultEndpoint
+	}
+	return endpoint
+}
+
+// An sdk endpoint resolver that sends the overridden services to their overrides
+func (o AwsOverrides) resolver() endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if endpoint := o.endpointFor(service); endpoint != "" {
+			return endpoints.ResolvedEndpoint{URL: endpoint, SigningRegion: region}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
+
+/*
+Start an aws cli command line for a service: the cli to run, and --endpoint-url when the
+service is overridden.
+*/
+func (o AwsOverrides) cliArgs(service string, args ...string) []string {
+	cli := o.AwsCliPath
+	if cli == "" {
+		cli = "aws"
+	}
+
+	cliArgs := append([]string{cli}, args...)
+	if endpoint := o.endpointFor(service); endpoint != "" {
+		cliArgs = append(cliArgs, "--endpoint-url", endpoint)
+	}
+	return cliArgs
+}
+
+// What to add to the aws cli's environment so it finds the plugin, nil when nothing needs adding
+func (o AwsOverrides) cliEnv() []string {
+	if o.PluginPath == "" {
+		return nil
+	}
+
+	path := filepath.Dir(o.PluginPath)
+	if current := os.Getenv("PATH"); current != "" {
+		path += string(os.PathListSeparator) + current
+	}
+	return []string{"PATH=" + path}
+}
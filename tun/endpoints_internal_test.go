@@ -0,0 +1,39 @@
+package tun
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+func TestAwsOverridesEndpointFor(t *testing.T) {
+	for _, variable := range []string{"EC2", "SSM", "STS", "RDS", "ELASTIC_BEANSTALK", "SECRETS_MANAGER", "ECS"} {
+		t.Setenv("AWS_ENDPOINT_URL_"+variable, "http://env-"+variable)
+	}
+	t.Setenv("AWS_ENDPOINT_URL", "http://env-default")
+
+	// The config's win over the environment's
+	overrides := AwsOverrides{StsEndpoint: "http://config-sts", RdsEndpoint: "http://config-rds"}.Or(AwsOverridesFromEnv())
+	for service, expected := range map[string]string{
+		endpoints.Ec2ServiceID:       "http://env-EC2",
+		endpoints.SsmServiceID:       "http://env-SSM",
+		endpoints.StsServiceID:       "http://config-sts",
+		endpoints.RdsServiceID:       "http://config-rds",
+		elasticbeanstalk.EndpointsID: "http://env-ELASTIC_BEANSTALK",
+		secretsmanager.EndpointsID:   "http://env-SECRETS_MANAGER",
+		ecs.EndpointsID:              "http://env-ECS",
+		"eks":                        "http://env-default",
+	} {
+		if endpoint := overrides.endpointFor(service); endpoint != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, service, endpoint)
+		}
+	}
+
+	t.Setenv("AWS_ENDPOINT_URL_RDS", "")
+	if endpoint := AwsOverridesFromEnv().endpointFor(endpoints.RdsServiceID); endpoint != "http://env-default" {
+		t.Errorf("Expected rds to fall back to AWS_ENDPOINT_URL, got %s", endpoint)
+	}
+}
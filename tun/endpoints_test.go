@@ -0,0 +1,183 @@
+//go:build linux
+
+package tun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tunny/tun"
+)
+
+// Answers ListTasks and DescribeTasks with one running task of the service, checking the region
+func fakeEcs(t *testing.T, region string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/"+region+"/ecs/") {
+			t.Errorf("Expected the request to be signed for %s, got %s", region, r.Header.Get("Authorization"))
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonEC2ContainerServiceV20141113.ListTasks":
+			json.NewEncoder(w).Encode(map[string]any{
+				"taskArns": []string{"arn:aws:ecs:" + region + ":1:task/prod/0123abcd"},
+			})
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			json.NewEncoder(w).Encode(map[string]any{"tasks": []map[string]any{{
+				"taskArn":    "arn:aws:ecs:" + region + ":1:task/prod/0123abcd",
+				"lastStatus": "RUNNING",
+				"containers": []map[string]any{
+					{"name": "sidecar"},
+					{"name": "api", "runtimeId": "0123abcd-456"},
+				},
+			}}})
+		default:
+			t.Errorf("Unexpected ecs call %q", r.Header.Get("X-Amz-Target"))
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+/*
+A stand in for the aws cli, it writes out its arguments and where the plugin would be found,
+then says what the session manager plugin says once it's listening.
+*/
+func writeFakeAwsCli(t *testing.T) (cli string, argsFile string) {
+	dir := t.TempDir()
+	cli = filepath.Join(dir, "fake-aws")
+	argsFile = filepath.Join(dir, "args")
+
+	contents := "#!/bin/sh\n" +
+		"echo \"$@\" > " + argsFile + ".tmp\n" +
+		"command -v session-manager-plugin >> " + argsFile + ".tmp\n" +
+		"mv " + argsFile + ".tmp " + argsFile + "\n" +
+		"echo 'Waiting for connections...'\n" +
+		"exec sleep 100\n"
+	if err := os.WriteFile(cli, []byte(contents), 0755); err != nil {
+		t.Fatalf("Error writing fake aws cli: %s", err)
+	}
+	return cli, argsFile
+}
+
+func TestDiscoveryAndSessionAgainstFakes(t *testing.T) {
+	beanstalk := fakeBeanstalk(t, fakeBeanstalkEnv{
+		id: "e-1", name: "api-prod", application: "api", status: "Ready", health: "Green",
+		instances: map[string]bool{"i-0fa4e0000000000ab": true},
+	})
+	t.Setenv("AWS_ENDPOINT_URL_ELASTIC_BEANSTALK", beanstalk.URL)
+	t.Setenv("AWS_ENDPOINT_URL_EC2", beanstalk.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	// The beanstalk and ec2 endpoints come from the environment
+	env, err := tun.ResolveBeanstalkEnv(context.Background(), "us-west-2", nil, tun.AwsOverrides{}, "", "api-prod")
+	if err != nil {
+		t.Fatalf("Error resolving the beanstalk environment: %s", err)
+	}
+
+	// The ssm endpoint and binaries come from the options
+	cli, argsFile := writeFakeAwsCli(t)
+	pluginDir := t.TempDir()
+	plugin := filepath.Join(pluginDir, "session-manager-plugin")
+	if err := os.WriteFile(plugin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Error writing fake plugin: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ready := make(chan struct{})
+	eventual, err := tun.StartSSMProxy(ctx, env.InstanceId, freePort(t), "db.internal", "5432", &tun.SsmOptions{
+		Overrides: tun.AwsOverrides{
+			SsmEndpoint: "http://localhost:4566",
+			AwsCliPath:  cli,
+			PluginPath:  plugin,
+		},
+		OnReady: func() { close(ready) },
+	})
+	if err != nil {
+		t.Fatalf("Error starting proxy: %s", err)
+	}
+
+	select {
+	case <-ready:
+	case err := <-eventual:
+		t.Fatalf("Session ended before it was ready: %v", err)
+	case <-ctx.Done():
+		t.Fatalf("Session never became ready")
+	}
+
+	contents, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Fake cli didn't write its arguments: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the arguments and the plugin path, got %q", contents)
+	}
+	for _, expected := range []string{"ssm start-session", "--target i-0fa4e0000000000ab", "--endpoint-url http://localhost:4566"} {
+		if !strings.Contains(lines[0], expected) {
+			t.Errorf("Expected %q in the cli arguments, got %q", expected, lines[0])
+		}
+	}
+	if lines[1] != plugin {
+		t.Errorf("Expected the cli to find the plugin at %s, got %q", plugin, lines[1])
+	}
+}
+
+func TestEcsSessionInTheServicesRegion(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_REGION", "us-west-2")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	ecs := fakeEcs(t, "eu-north-1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	task, err := tun.ResolveEcsTarget(ctx, "eu-north-1", nil, tun.AwsOverrides{EcsEndpoint: ecs.URL}, "prod", "api", "")
+	if err != nil {
+		t.Fatalf("Error resolving the task: %s", err)
+	}
+	if task.SsmTarget != "ecs:prod_0123abcd_0123abcd-456" || task.Container != "api" {
+		t.Errorf("Expected the first reachable container, got %+v", task)
+	}
+
+	cli, argsFile := writeFakeAwsCli(t)
+	ready := make(chan struct{})
+	eventual, err := tun.StartSSMProxy(ctx, task.SsmTarget, freePort(t), "localhost", "8080", &tun.SsmOptions{
+		Overrides: tun.AwsOverrides{AwsCliPath: cli},
+		Region:    "eu-north-1",
+		OnReady:   func() { close(ready) },
+	})
+	if err != nil {
+		t.Fatalf("Error starting proxy: %s", err)
+	}
+
+	select {
+	case <-ready:
+	case err := <-eventual:
+		t.Fatalf("Session ended before it was ready: %v", err)
+	case <-ctx.Done():
+		t.Fatalf("Session never became ready")
+	}
+
+	contents, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Fake cli didn't write its arguments: %s", err)
+	}
+	for _, expected := range []string{"ssm start-session --region eu-north-1", "--target ecs:prod_0123abcd_0123abcd-456"} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf("Expected %q in the cli arguments, got %q", expected, contents)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package tun
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+InstanceConnectAuth authenticates with a throwaway key instead of one on disk.
+Every time ssh asks for keys a fresh ed25519 key pair is made in memory and pushed to the
+instance with ec2-instance-connect:SendSSHPublicKey. A pushed key is only good for 60 seconds,
+so reconnecting pushes a new one rather than reusing the last.
+*/
+func InstanceConnectAuth(
+	region string,
+	creds *credentials.Credentials,
+	instanceId string,
+	osUser string,
+) (ssh.AuthMethod, error) {
+	sess, err := newSession(region, creds, AwsOverrides{})
+	if err != nil {
+		return nil, err
+	}
+	svc := ec2instanceconnect.New(sess)
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		sshPublicKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := svc.SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+			InstanceId:     aws.String(instanceId),
+			InstanceOSUser: aws.String(osUser),
+			SSHPublicKey:   aws.String(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error pushing key to %s with instance connect: %w", instanceId, err)
+		}
+		if output.Success != nil && !*output.Success {
+			return nil, fmt.Errorf("instance connect didn't accept the key for %s", instanceId)
+		}
+
+		log.Printf("Pushed an ephemeral key for %s@%s", osUser, instanceId)
+		return []ssh.Signer{signer}, nil
+	}), nil
+}
@@ -0,0 +1,150 @@
+package tun_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"tunny/tun"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The keys pushed to a fake ec2-instance-connect, it answers with an error when failWith is set
+type fakeInstanceConnect struct {
+	lock     sync.Mutex
+	pushed   []map[string]string
+	failWith string
+}
+
+func (f *fakeInstanceConnect) serve(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "AWSEC2InstanceConnectService.SendSSHPublicKey" {
+			t.Errorf("Unexpected instance connect call %q", target)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("Bad instance connect request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.failWith != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": f.failWith, "message": "no good"})
+			return
+		}
+		f.pushed = append(f.pushed, input)
+		json.NewEncoder(w).Encode(map[string]any{"RequestId": "1", "Success": true})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// The last key pushed, in authorized_keys form
+func (f *fakeInstanceConnect) lastKey() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.pushed) == 0 {
+		return ""
+	}
+	return f.pushed[len(f.pushed)-1]["SSHPublicKey"]
+}
+
+// Run an ssh handshake that only lets in the key last pushed to instance connect
+func connectWithPushedKey(t *testing.T, auth ssh.AuthMethod, pushes *fakeInstanceConnect, hostKey ssh.Signer) error {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "ec2-user" && strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) == pushes.lastKey() {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	clientSide, serverSide := connectedPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, _, _, err := ssh.NewServerConn(serverSide, config); err == nil {
+			conn.Close()
+		}
+	}()
+	defer func() {
+		serverSide.Close()
+		<-done
+	}()
+
+	client, err := tun.NewSSHClient(clientSide, "i-0123456789abcdef0:22", &ssh.ClientConfig{
+		User:            "ec2-user",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		return err
+	}
+	// The server may have hung up already
+	client.Close()
+	return nil
+}
+
+func TestInstanceConnectAuth(t *testing.T) {
+	pushes := &fakeInstanceConnect{}
+	t.Setenv("AWS_ENDPOINT_URL", pushes.serve(t).URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(privateKey)
+
+	auth, err := tun.InstanceConnectAuth("eu-west-1", nil, "i-0123456789abcdef0", "ec2-user")
+	if err != nil {
+		t.Fatalf("Error making the auth method: %s", err)
+	}
+	if err := connectWithPushedKey(t, auth, pushes, hostKey); err != nil {
+		t.Fatalf("Expected to get in with the pushed key: %s", err)
+	}
+	if err := connectWithPushedKey(t, auth, pushes, hostKey); err != nil {
+		t.Fatalf("Expected to get in again with a new key: %s", err)
+	}
+
+	if len(pushes.pushed) != 2 {
+		t.Fatalf("Expected a key pushed for each connection, got %d", len(pushes.pushed))
+	}
+	first, second := pushes.pushed[0], pushes.pushed[1]
+	if first["InstanceId"] != "i-0123456789abcdef0" || first["InstanceOSUser"] != "ec2-user" || !strings.HasPrefix(first["SSHPublicKey"], "ssh-ed25519 ") {
+		t.Errorf("Expected an ed25519 key for ec2-user on the instance, got %v", first)
+	}
+	if first["SSHPublicKey"] == second["SSHPublicKey"] {
+		t.Errorf("Expected a fresh key for every connection")
+	}
+}
+
+func TestInstanceConnectAuthPushFails(t *testing.T) {
+	pushes := &fakeInstanceConnect{failWith: "EC2InstanceNotFoundException"}
+	t.Setenv("AWS_ENDPOINT_URL", pushes.serve(t).URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAFAKE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(privateKey)
+
+	auth, err := tun.InstanceConnectAuth("eu-west-1", nil, "i-0123456789abcdef0", "ec2-user")
+	if err != nil {
+		t.Fatalf("Error making the auth method: %s", err)
+	}
+	err = connectWithPushedKey(t, auth, pushes, hostKey)
+	if err == nil || !strings.Contains(err.Error(), "EC2InstanceNotFoundException") {
+		t.Errorf("Expected the failed push to stop the connection, got %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// How often a forwarded pod is checked on, so a rescheduled pod is noticed
+const defaultPodCheckInterval = 5 * time.Second
+
+// What a k8s port forward goes to, exactly one of Pod, Deployment, Service or Selector
+type K8sSelector struct {
+	Pod        string
+	Deployment string
+	Service    string
+	// A label selector, e.g. "app=api,tier=backend"
+	Selector string
+}
+
+func (s K8sSelector) String() string {
+	switch {
+	case s.Pod != "":
+		return "pod/" + s.Pod
+	case s.Deployment != "":
+		return "deployment/" + s.Deployment
+	case s.Service != "":
+		return "service/" + s.Service
+	default:
+		return "pods matching " + s.Selector
+	}
+}
+
+// A kubernetes api server to talk to, and the namespace to use when none is given
+type K8sCluster struct {
+	Config    *rest.Config
+	Client    kubernetes.Interface
+	Namespace string
+}
+
+/*
+LoadK8sCluster reads a kubeconfig the way kubectl does: the given file, or KUBECONFIG,
+or ~/.kube/config. An empty context means the kubeconfig's current one.
+*/
+func LoadK8sCluster(kubeconfig string, kubeContext string) (*K8sCluster, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules,
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading kubeconfig: %w", err)
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, fmt.Errorf("error loading kubeconfig: %w", err)
+	}
+
+	return NewK8sCluster(config, namespace)
+}
+
+// Talk to the api server described by config
+func NewK8sCluster(config *rest.Config, namespace string) (*K8sCluster, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	return &K8sCluster{Config: config, Client: client, Namespace: namespace}, nil
+}
+
+// A pod picked for a port forward, and the port on it that was asked for
+type K8sPodTarget struct {
+	Namespace string
+	Pod       string
+	Port      int
+}
+
+/*
+ResolveK8sPod picks a running pod for the selector and works out which of its ports to
+forward to. For a service, port is the service's port (number or name) and it's mapped to
+the pod's target port, the same as kubectl port-forward svc/... does.
+It's meant to be called again every time a forward starts, pods come and go.
+*/
+func (c *K8sCluster) ResolveK8sPod(
+	ctx context.Context,
+	namespace string,
+	selector K8sSelector,
+	port string,
+) (*K8sPodTarget, error) {
+	if namespace == "" {
+		namespace = c.Namespace
+	}
+	pods := c.Client.CoreV1().Pods(namespace)
+
+	var pod *corev1.Pod
+	var service *corev1.Service
+	if selector.Pod != "" {
+		found, err := pods.Get(ctx, selector.Pod, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if !podRunning(found) {
+			return nil, fmt.Errorf("pod %s is %s, not running", found.Name, found.Status.Phase)
+		}
+		pod = found
+	} else {
+		var labelSelector labels.Selector
+		switch {
+		case selector.Deployment != "":
+			deployment, err := c.Client.AppsV1().Deployments(namespace).Get(ctx, selector.Deployment, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			labelSelector, err = metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+			if err != nil {
+				return nil, err
+			}
+		case selector.Service != "":
+			var err error
+			service, err = c.Client.CoreV1().Services(namespace).Get(ctx, selector.Service, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if len(service.Spec.Selector) == 0 {
+				return nil, fmt.Errorf("service %s has no selector, there are no pods to forward to", service.Name)
+			}
+			labelSelector = labels.SelectorFromSet(service.Spec.Selector)
+		case selector.Selector != "":
+			var err error
+			labelSelector, err = labels.Parse(selector.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("bad selector %q: %w", selector.Selector, err)
+			}
+		default:
+			return nil, fmt.Errorf("one of pod, deployment, service or selector is needed")
+		}
+
+		listed, err := pods.List(ctx, metav1.ListOptions{LabelSelector: labelSelector.String()})
+		if err != nil {
+			return nil, err
+		}
+		pod = pickPod(listed.Items)
+		if pod == nil {
+			return nil, fmt.Errorf("no running pods for %s in namespace %s", selector, namespace)
+		}
+	}
+
+	podPort, err := resolvePodPort(pod, service, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &K8sPodTarget{Namespace: namespace, Pod: pod.Name, Port: podPort}, nil
+}
+
+func podRunning(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// A running pod, preferring ones that are ready, nil when there isn't one
+func pickPod(pods []corev1.Pod) *corev1.Pod {
+	var running *corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if !podRunning(pod) {
+			continue
+		}
+		if podReady(pod) {
+			return pod
+		}
+		if running == nil {
+			running = pod
+		}
+	}
+	return running
+}
+
+/*
+The port on the pod to forward to. Without a service it's port itself, or the container port
+with that name. With one, port is the service port and its target port is looked up instead.
+*/
+func resolvePodPort(pod *corev1.Pod, service *corev1.Service, port string) (int, error) {
+	target := intstr.Parse(port)
+
+	if service != nil {
+		found := false
+		for _, servicePort := range service.Spec.Ports {
+			if (target.Type == intstr.Int && int(servicePort.Port) == target.IntValue()) ||
+				(target.Type == intstr.String && servicePort.Name == target.StrVal) {
+				target = servicePort.TargetPort
+				if target.Type == intstr.Int && target.IntValue() == 0 {
+					// Not set means the same as the service's port
+					target = intstr.FromInt(int(servicePort.Port))
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("service %s has no port %s", service.Name, port)
+		}
+	}
+
+	if target.Type == intstr.Int {
+		return target.IntValue(), nil
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			if containerPort.Name == target.StrVal {
+				return int(containerPort.ContainerPort), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("pod %s has no port named %s", pod.Name, target.StrVal)
+}
+
+// Options for StartK8sPortForward, the zero value is fine
+type K8sForwardOptions struct {
+	// How often the pod is checked on, 5s by default
+	PodCheckInterval time.Duration
+
+	// Called with every line the port forward prints
+	OnOutput func(stream OutputStream, line string)
+}
+
+/*
+StartK8sPortForward forwards localPort to the pod through the api server's portforward
+subresource. The local port is listening by the time it returns.
+
+The eventual error channel gets an error when the connection to the api server is lost,
+or when the pod goes away (deleted, evicted, rescheduled), so the target can be resolved
+again. It's closed once the forward has stopped.
+*/
+func (c *K8sCluster) StartK8sPortForward(
+	ctx context.Context,
+	target *K8sPodTarget,
+	localPort string,
+	opts *K8sForwardOptions,
+) (eventualErr <-chan error, startErr error) {
+	if opts == nil {
+		opts = &K8sForwardOptions{}
+	}
+	checkInterval := opts.PodCheckInterval
+	if checkInterval <= 0 {
+		checkInterval = defaultPodCheckInterval
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(c.Config)
+	if err != nil {
+		return nil, err
+	}
+	url := c.Client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(target.Namespace).
+		Name(target.Pod).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	var out, errOut io.Writer
+	if opts.OnOutput != nil {
+		out = &lineWriter{onLine: func(line string) { opts.OnOutput(Stdout, line) }}
+		errOut = &lineWriter{onLine: func(line string) { opts.OnOutput(Stderr, line) }}
+	}
+
+	stopChan := make(chan struct{})
+	readyChan := make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(
+		dialer,
+		[]string{"localhost"},
+		[]string{fmt.Sprintf("%s:%d", localPort, target.Port)},
+		stopChan,
+		readyChan,
+		out,
+		errOut)
+	if err != nil {
+		return nil, err
+	}
+
+	forwardDone := make(chan error, 1)
+	go func() {
+		forwardDone <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+	case err := <-forwardDone:
+		if err == nil {
+			err = fmt.Errorf("port forward stopped before it was ready")
+		}
+		return nil, fmt.Errorf("error forwarding to pod %s: %w", target.Pod, err)
+	case <-ctx.Done():
+		close(stopChan)
+		<-forwardDone
+		return nil, ctx.Err()
+	}
+
+	errChan := make(chan error, 1)
+	eventualErr = errChan
+
+	go func() {
+		defer close(errChan)
+
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		var failure error
+	watching:
+		for {
+			select {
+			case <-ctx.Done():
+				break watching
+			case err := <-forwardDone:
+				if ctx.Err() == nil {
+					if err == nil {
+						err = fmt.Errorf("port forward stopped")
+					}
+					errChan <- fmt.Errorf("port forward to pod %s lost: %w", target.Pod, err)
+				}
+				return
+			case <-ticker.C:
+				if failure = c.checkPod(ctx, target); failure != nil {
+					break watching
+				}
+			}
+		}
+
+		close(stopChan)
+		<-forwardDone
+		if failure != nil && ctx.Err() == nil {
+			errChan <- failure
+		}
+	}()
+
+	return eventualErr, nil
+}
+
+/*
+Whether the pod being forwarded to is still around and running. The api server being
+unreachable for a moment isn't treated as the pod being gone, the forward itself breaks
+if it's any more than that.
+*/
+func (c *K8sCluster) checkPod(ctx context.Context, target *K8sPodTarget) error {
+	pod, err := c.Client.CoreV1().Pods(target.Namespace).Get(ctx, target.Pod, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("pod %s is gone", target.Pod)
+	} else if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error checking on pod %s: %s", target.Pod, err)
+		}
+		return nil
+	}
+	if pod.DeletionTimestamp != nil {
+		return fmt.Errorf("pod %s is being deleted", target.Pod)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return fmt.Errorf("pod %s is %s, not running", target.Pod, pod.Status.Phase)
+	}
+	return nil
+}
+
+// namespace/pod:port, for messages
+func (t *K8sPodTarget) String() string {
+	return t.Namespace + "/" + t.Pod + ":" + strconv.Itoa(t.Port)
+}
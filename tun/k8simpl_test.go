@@ -0,0 +1,302 @@
+package tun_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tunny/tun"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+)
+
+/*
+fakeApiServer serves just enough of the kubernetes api for a port forward: getting a
+service, listing and getting pods, and the portforward subresource (over spdy, the way the
+kubelet does it). Every pod forwards to its own echo server, whatever port is asked for.
+*/
+type fakeApiServer struct {
+	t *testing.T
+
+	lock     sync.Mutex
+	service  *corev1.Service
+	pods     map[string]*corev1.Pod
+	echoes   map[string]string
+	lastPort string
+}
+
+func newFakeApiServer(t *testing.T, service *corev1.Service) (*fakeApiServer, *rest.Config) {
+	fake := &fakeApiServer{
+		t:       t,
+		service: service,
+		pods:    make(map[string]*corev1.Pod),
+		echoes:  make(map[string]string),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+
+	return fake, &rest.Config{Host: server.URL}
+}
+
+// Add a running, ready pod carrying the service's labels
+func (f *fakeApiServer) addPod(name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pods[name] = &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "db", Labels: f.service.Spec.Selector},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "postgres",
+			Ports: []corev1.ContainerPort{{Name: "pg", ContainerPort: 5432}},
+		}}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	f.echoes[name] = startEchoServer(f.t, name)
+}
+
+// The pod gets rescheduled, it's simply gone
+func (f *fakeApiServer) removePod(name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.pods, name)
+}
+
+func (f *fakeApiServer) writeJson(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (f *fakeApiServer) notFound(w http.ResponseWriter, what string) {
+	f.writeJson(w, http.StatusNotFound, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   metav1.StatusReasonNotFound,
+		Code:     http.StatusNotFound,
+		Message:  what + " not found",
+	})
+}
+
+func (f *fakeApiServer) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/db/")
+	parts := strings.Split(path, "/")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case len(parts) == 2 && parts[0] == "services":
+		if parts[1] != f.service.Name {
+			f.notFound(w, "service "+parts[1])
+			return
+		}
+		f.writeJson(w, http.StatusOK, f.service)
+	case len(parts) == 1 && parts[0] == "pods":
+		list := &corev1.PodList{TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"}}
+		for _, pod := range f.pods {
+			list.Items = append(list.Items, *pod)
+		}
+		f.writeJson(w, http.StatusOK, list)
+	case len(parts) == 2 && parts[0] == "pods":
+		pod, ok := f.pods[parts[1]]
+		if !ok {
+			f.notFound(w, "pod "+parts[1])
+			return
+		}
+		f.writeJson(w, http.StatusOK, pod)
+	case len(parts) == 3 && parts[0] == "pods" && parts[2] == "portforward":
+		echo, ok := f.echoes[parts[1]]
+		if _, running := f.pods[parts[1]]; !ok || !running {
+			f.notFound(w, "pod "+parts[1])
+			return
+		}
+		f.lock.Unlock()
+		f.portForward(w, r, echo)
+		f.lock.Lock()
+	default:
+		f.t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		f.notFound(w, r.URL.Path)
+	}
+}
+
+func (f *fakeApiServer) portForward(w http.ResponseWriter, r *http.Request, echo string) {
+	if _, err := httpstream.Handshake(r, w, []string{"portforward.k8s.io"}); err != nil {
+		return
+	}
+
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		if stream.Headers().Get(corev1.StreamType) != corev1.StreamTypeData {
+			// Nothing ever goes wrong, the error stream stays empty
+			go func() {
+				<-replySent
+				stream.Close()
+			}()
+			return nil
+		}
+
+		f.lock.Lock()
+		f.lastPort = stream.Headers().Get(corev1.PortHeader)
+		f.lock.Unlock()
+
+		go func() {
+			<-replySent
+			defer stream.Close()
+
+			backend, err := net.Dial("tcp", echo)
+			if err != nil {
+				return
+			}
+			defer backend.Close()
+
+			go io.Copy(backend, stream)
+			io.Copy(stream, backend)
+		}()
+		return nil
+	})
+	if conn == nil {
+		return
+	}
+	<-conn.CloseChan()
+}
+
+func TestK8sServicePortForwardFollowsPods(t *testing.T) {
+	service := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "postgres", Namespace: "db"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "postgres"},
+			Ports:    []corev1.ServicePort{{Name: "sql", Port: 15432, TargetPort: intstr.FromString("pg")}},
+		},
+	}
+	fake, config := newFakeApiServer(t, service)
+	fake.addPod("postgres-1")
+
+	cluster, err := tun.NewK8sCluster(config, "db")
+	if err != nil {
+		t.Fatalf("Error making cluster: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	selector := tun.K8sSelector{Service: "postgres"}
+	localPort := freePort(t)
+	opts := &tun.K8sForwardOptions{PodCheckInterval: 100 * time.Millisecond}
+
+	target, err := cluster.ResolveK8sPod(ctx, "", selector, "15432")
+	if err != nil {
+		t.Fatalf("Error resolving pod: %s", err)
+	}
+	if target.Pod != "postgres-1" || target.Port != 5432 {
+		t.Fatalf("Expected postgres-1 on the pg port, got %s", target)
+	}
+
+	eventual, err := cluster.StartK8sPortForward(ctx, target, localPort, opts)
+	if err != nil {
+		t.Fatalf("Error starting port forward: %s", err)
+	}
+
+	expectEcho := func(name string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", "localhost:"+localPort)
+		if err != nil {
+			t.Fatalf("Error connecting to forward: %s", err)
+		}
+		got, err := echoThrough(conn, "hello")
+		if err != nil {
+			t.Fatalf("Error going through forward: %s", err)
+		}
+		if want := name + ": hello\n"; got != want {
+			t.Fatalf("Expected %q, got %q", want, got)
+		}
+	}
+	expectEcho("postgres-1")
+
+	fake.lock.Lock()
+	if fake.lastPort != "5432" {
+		t.Errorf("Expected the forward to ask for port 5432, got %q", fake.lastPort)
+	}
+	fake.lock.Unlock()
+
+	// The pod is rescheduled, the forward has to notice and end
+	fake.addPod("postgres-2")
+	fake.removePod("postgres-1")
+
+	select {
+	case err := <-eventual:
+		if err == nil || !strings.Contains(err.Error(), "postgres-1") {
+			t.Fatalf("Expected an error about the old pod, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Forward never noticed the pod going away")
+	}
+	if _, open := <-eventual; open {
+		t.Fatalf("Expected the eventual error channel to be closed")
+	}
+
+	// Starting again lands on the new pod, on the same local port
+	target, err = cluster.ResolveK8sPod(ctx, "", selector, "sql")
+	if err != nil {
+		t.Fatalf("Error resolving pod again: %s", err)
+	}
+	if target.Pod != "postgres-2" {
+		t.Fatalf("Expected postgres-2, got %s", target)
+	}
+
+	if _, err := cluster.StartK8sPortForward(ctx, target, localPort, opts); err != nil {
+		t.Fatalf("Error restarting port forward: %s", err)
+	}
+	expectEcho("postgres-2")
+}
+
+func TestK8sResolveErrors(t *testing.T) {
+	service := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "postgres", Namespace: "db"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "postgres"},
+			Ports:    []corev1.ServicePort{{Port: 5432}},
+		},
+	}
+	_, config := newFakeApiServer(t, service)
+
+	cluster, err := tun.NewK8sCluster(config, "db")
+	if err != nil {
+		t.Fatalf("Error making cluster: %s", err)
+	}
+
+	tests := []struct {
+		selector tun.K8sSelector
+		port     string
+		expected string
+	}{
+		{tun.K8sSelector{Service: "postgres"}, "5432", "no running pods"},
+		{tun.K8sSelector{Service: "mysql"}, "3306", "not found"},
+		{tun.K8sSelector{Pod: "postgres-0"}, "5432", "not found"},
+		{tun.K8sSelector{}, "5432", "one of pod, deployment, service or selector"},
+	}
+
+	for _, test := range tests {
+		_, err := cluster.ResolveK8sPod(context.Background(), "", test.selector, test.port)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Resolving %s: expected an error containing %q, got %v", test.selector, test.expected, err)
+		}
+	}
+}
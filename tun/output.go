@@ -0,0 +1,118 @@
+package tun
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// An io.Writer that hands every complete line written to it to onLine
+type lineWriter struct {
+	lock    sync.Mutex
+	partial []byte
+	onLine  func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.partial[:idx]), "\r")
+		w.partial = w.partial[idx+1:]
+		w.onLine(line)
+	}
+
+	return len(p), nil
+}
+
+// Hand over whatever is left without a trailing newline, once nothing else will be written
+func (w *lineWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.partial) > 0 {
+		line := strings.TrimRight(string(w.partial), "\r")
+		w.partial = nil
+		w.onLine(line)
+	}
+}
+
+// Keeps the last few lines of a process's output around for error messages
+type outputTail struct {
+	lock  sync.Mutex
+	max   int
+	lines []string
+}
+
+func newOutputTail(max int) *outputTail {
+	return &outputTail{max: max}
+}
+
+func (t *outputTail) add(line string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+func (t *outputTail) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return strings.Join(t.lines, "\n")
+}
+
+// Which of a process's outputs a line came from
+type OutputStream string
+
+const (
+	Stdout OutputStream = "stdout"
+	Stderr OutputStream = "stderr"
+)
+
+// How a line of output should be shown
+type OutputLevel int
+
+const (
+	OutputInfo OutputLevel = iota
+	OutputError
+)
+
+// Bits of text that make a line an error no matter where it came from
+var errorOutputHints = []string{
+	"error",
+	"failed",
+	"exception",
+	"cannot",
+	"unable",
+	"denied",
+	"timed out",
+}
+
+/*
+ClassifyOutputLine guesses how important a line from the aws cli or the session manager
+plugin is. Its normal chatter ("Starting session", "Connection accepted") is info, anything
+that reads like a failure is an error, and other stderr output is treated as an error too.
+*/
+func ClassifyOutputLine(stream OutputStream, line string) OutputLevel {
+	lower := strings.ToLower(line)
+	for _, hint := range errorOutputHints {
+		if strings.Contains(lower, hint) {
+			return OutputError
+		}
+	}
+
+	if stream == Stderr {
+		return OutputError
+	}
+	return OutputInfo
+}
@@ -0,0 +1,48 @@
+package tun
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineWriterSplitsLines(t *testing.T) {
+	var lines []string
+	writer := &lineWriter{onLine: func(line string) {
+		lines = append(lines, line)
+	}}
+
+	writer.Write([]byte("Starting session with Session"))
+	writer.Write([]byte("Id: someone-0123\r\nPort 8081 opened\n\nWaiting"))
+	writer.Write([]byte(" for connections..."))
+	writer.Flush()
+
+	expected := []string{
+		"Starting session with SessionId: someone-0123",
+		"Port 8081 opened",
+		"",
+		"Waiting for connections...",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestClassifyOutputLine(t *testing.T) {
+	cases := []struct {
+		stream   OutputStream
+		line     string
+		expected OutputLevel
+	}{
+		{Stdout, "Connection accepted for session [someone-0123]", OutputInfo},
+		{Stdout, "Waiting for connections...", OutputInfo},
+		{Stdout, "Connection to destination port failed, check SSM Agent logs.", OutputError},
+		{Stderr, "An error occurred (TargetNotConnected) when calling the StartSession operation", OutputError},
+		{Stderr, "something unexpected", OutputError},
+	}
+
+	for _, c := range cases {
+		if level := ClassifyOutputLine(c.stream, c.line); level != c.expected {
+			t.Errorf("%s %q: expected %d, got %d", c.stream, c.line, c.expected, level)
+		}
+	}
+}
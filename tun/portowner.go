@@ -0,0 +1,27 @@
+package tun
+
+import "fmt"
+
+// A process listening on a local port
+type PortOwner struct {
+	Pid int
+	// The program's name, e.g. session-manager-plugin
+	Name string
+	// Its whole command line
+	Command string
+
+	// Whether what started it is gone (it and the aws cli between it and tunny don't count)
+	Orphaned bool
+}
+
+func (o *PortOwner) String() string {
+	return fmt.Sprintf("%s (pid %d)", o.Name, o.Pid)
+}
+
+/*
+Whether it's a tunny or session-manager-plugin that an earlier run left behind, so it's safe to
+kill. A plugin that a running tunny started isn't, it's that tunny's.
+*/
+func (o *PortOwner) IsLeftover() bool {
+	return o.Orphaned && (o.Name == "tunny" || o.Name == "session-manager-plugin")
+}
@@ -0,0 +1,224 @@
+//go:build linux
+
+package tun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+FindPortOwner finds the process listening on the local port through /proc: the listening
+socket's inode from /proc/net/tcp (and tcp6), then the process with a file descriptor for it.
+It's nil when nothing's listening or the owner can't be seen, e.g. it's another user's.
+*/
+func FindPortOwner(port string) (*PortOwner, error) {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't a port number", port)
+	}
+
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := listeningInodes(table, uint16(number), inodes); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if len(inodes) == 0 {
+		return nil, nil
+	}
+
+	pids, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range pids {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		// Other users' processes can't be looked into
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+				return portOwner(pid)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// The state of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+// Add the inodes of the sockets in a /proc/net/tcp table listening on the port
+func listeningInodes(table string, port uint16, inodes map[string]bool) error {
+	file, err := os.Open(table)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// The header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		_, localPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		if number, err := strconv.ParseUint(localPort, 16, 16); err == nil && uint16(number) == port {
+			inodes[fields[9]] = true
+		}
+	}
+	return scanner.Err()
+}
+
+func portOwner(pid int) (*PortOwner, error) {
+	name, command, err := processCommand(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &PortOwner{Pid: pid, Name: name, Command: command, Orphaned: orphaned(pid)}, nil
+}
+
+// The program's name and whole command line, the aws cli is named aws even when run by python
+func processCommand(pid int) (string, string, error) {
+	contents, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return "", "", err
+	}
+	args := strings.Split(strings.TrimRight(string(contents), "\x00"), "\x00")
+	if len(args) == 0 || args[0] == "" {
+		// A kernel thread, or a zombie
+		return "", "", fmt.Errorf("process %d has no command line", pid)
+	}
+
+	name := filepath.Base(args[0])
+	if strings.HasPrefix(name, "python") && len(args) > 1 && filepath.Base(args[1]) == "aws" {
+		name = "aws"
+	}
+	return name, strings.Join(args, " "), nil
+}
+
+// The process's parent's pid, from /proc/<pid>/stat
+func parentPid(pid int) (int, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The state and then the parent come right after the parenthesised command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("can't read the parent of process %d", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+/*
+Whether what started the process has gone. A process some tunny wrote down (see
+CleanupProcesses), or one in its group, is orphaned once that tunny isn't running. Otherwise it's
+orphaned when it's been handed to init or a subreaper like systemd --user. The aws cli (which
+starts session-manager-plugin) is passed over, so a plugin is orphaned once the tunny that ran
+the cli is gone.
+*/
+func orphaned(pid int) bool {
+	if tracked, ok := trackedBy(pid); ok {
+		return tracked.TunnyPid != os.Getpid() && !isRunning(tracked.TunnyPid, tracked.TunnyStartTime)
+	}
+
+	for {
+		parent, err := parentPid(pid)
+		if err != nil {
+			return false
+		}
+		if parent <= 1 {
+			return true
+		}
+		name, _, err := processCommand(parent)
+		if err != nil {
+			// Exited and waiting to be reaped
+			return true
+		}
+		if name == "systemd" {
+			// The user's service manager, the subreaper that takes in orphans on most desktops
+			return true
+		}
+		if name != "aws" && name != "session-manager-plugin" {
+			return false
+		}
+		pid = parent
+	}
+}
+
+// The tunny that wrote down the process, or the group it's in, from the files in ProcessStateDir
+func trackedBy(pid int) (trackedProcesses, bool) {
+	stat, err := readProcessStat(pid)
+	if err != nil {
+		return trackedProcesses{}, false
+	}
+	files, err := filepath.Glob(filepath.Join(ProcessStateDir(), "*.json"))
+	if err != nil {
+		return trackedProcesses{}, false
+	}
+	for _, filename := range files {
+		tracked, err := readTrackedProcesses(filename)
+		if err != nil {
+			continue
+		}
+		for _, process := range tracked.Processes {
+			if process.Pid == pid && process.StartTime == stat.startTime {
+				return tracked, true
+			}
+			// The leader's start time shows the group id hasn't been reused, see groupMembers
+			if stat.group == process.Pid && stat.startTime >= process.StartTime {
+				if leader, err := readProcessStat(process.Pid); err == nil && leader.startTime != process.StartTime {
+					continue
+				}
+				return tracked, true
+			}
+		}
+	}
+	return trackedProcesses{}, false
+}
+
+// Kill asks the process to exit, and makes it if it hasn't within a few seconds
+func (o *PortOwner) Kill() error {
+	if err := syscall.Kill(o.Pid, syscall.SIGTERM); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(defaultGracePeriod)
+	for time.Now().Before(deadline) {
+		if _, _, err := processCommand(o.Pid); err != nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := syscall.Kill(o.Pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package tun
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindPortOwner(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	owner, err := FindPortOwner(port)
+	if err != nil {
+		t.Fatalf("Error finding the owner of %s: %s", port, err)
+	}
+	if owner == nil || owner.Pid != os.Getpid() {
+		t.Fatalf("Expected the test to own port %s, got %v", port, owner)
+	}
+	if owner.Orphaned || owner.IsLeftover() {
+		t.Errorf("Expected the test not to be a leftover, its go test is still running: %+v", owner)
+	}
+
+	listener.Close()
+	owner, err = FindPortOwner(port)
+	if err != nil || owner != nil {
+		t.Errorf("Expected no owner once the port's closed, got %v, %v", owner, err)
+	}
+}
+
+func TestPortOwnerIsLeftover(t *testing.T) {
+	for _, owner := range []PortOwner{
+		{Name: "session-manager-plugin", Orphaned: true},
+		{Name: "tunny", Orphaned: true},
+	} {
+		if !owner.IsLeftover() {
+			t.Errorf("Expected %+v to be a leftover", owner)
+		}
+	}
+	for _, owner := range []PortOwner{
+		{Name: "session-manager-plugin"},
+		{Name: "postgres", Orphaned: true},
+	} {
+		if owner.IsLeftover() {
+			t.Errorf("Expected %+v not to be a leftover", owner)
+		}
+	}
+}
+
+func TestOrphaned(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	// A fake plugin and its child, in their own group like tunny starts them
+	script, childPidFile := writeFakePlugin(t, "", "wait")
+	plugin := exec.Command(script)
+	setProcessGroup(plugin)
+	if err := plugin.Start(); err != nil {
+		t.Fatalf("Error starting fake plugin: %s", err)
+	}
+	defer killGroup(plugin.Process.Pid)
+	go plugin.Wait()
+	childPid := readChildPid(t, childPidFile)
+	pluginStart, err := processStartTime(plugin.Process.Pid)
+	if err != nil {
+		t.Fatalf("Error getting the start time: %s", err)
+	}
+	processes := []TrackedProcess{{Pid: plugin.Process.Pid, StartTime: pluginStart, Name: "fake-plugin"}}
+
+	// Written down by a tunny that's still running, the test's parent stands in for it
+	parentStart, err := processStartTime(os.Getppid())
+	if err != nil {
+		t.Fatalf("Error getting the start time: %s", err)
+	}
+	filename := writeTrackedProcesses(t, "tunny", trackedProcesses{TunnyPid: os.Getppid(), TunnyStartTime: parentStart, Processes: processes})
+	if orphaned(plugin.Process.Pid) || orphaned(childPid) {
+		t.Errorf("Expected the processes of a running tunny not to be orphaned")
+	}
+
+	// And by one that's gone
+	os.Remove(filename)
+	writeTrackedProcesses(t, "tunny", trackedProcesses{TunnyPid: os.Getppid(), TunnyStartTime: 1, Processes: processes})
+	if !orphaned(plugin.Process.Pid) || !orphaned(childPid) {
+		t.Errorf("Expected the processes of a tunny that's gone to be orphaned")
+	}
+}
+
+func TestPluginNotStartedByTunnyIsntOrphaned(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("No sleep to stand in for the plugin")
+	}
+	plugin := filepath.Join(t.TempDir(), "session-manager-plugin")
+	if err := os.Symlink(sleep, plugin); err != nil {
+		t.Fatalf("Error linking the fake plugin: %s", err)
+	}
+	cmd := exec.Command(plugin, "100")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting fake plugin: %s", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	// Like a session the user started in another terminal, what started it is still there
+	if orphaned(cmd.Process.Pid) {
+		t.Errorf("Expected a plugin whose parent is still running not to be orphaned")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package tun
+
+import "fmt"
+
+// Only Linux has /proc to look the owner up in, elsewhere it's unknown
+func FindPortOwner(port string) (*PortOwner, error) {
+	return nil, nil
+}
+
+func (o *PortOwner) Kill() error {
+	return fmt.Errorf("killing %s isn't supported here", o)
+}
@@ -0,0 +1,59 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Where the aws cli that ssm sessions run is, the same one StartSSMProxy would pick
+func FindAwsCli(overrides AwsOverrides) (string, error) {
+	overrides = overrides.Or(AwsOverridesFromEnv())
+	return exec.LookPath(overrides.cliArgs("")[0])
+}
+
+// Where the session-manager-plugin the aws cli would run is
+func FindSessionManagerPlugin(overrides AwsOverrides) (string, error) {
+	overrides = overrides.Or(AwsOverridesFromEnv())
+	if overrides.PluginPath == "" {
+		return exec.LookPath("session-manager-plugin")
+	}
+
+	info, err := os.Stat(overrides.PluginPath)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return "", fmt.Errorf("%s isn't executable", overrides.PluginPath)
+	}
+	return overrides.PluginPath, nil
+}
+
+// Check the credentials actually work by asking sts who they belong to, returns the arn
+func CheckAwsCredentials(ctx context.Context, creds *credentials.Credentials, overrides AwsOverrides) (string, error) {
+	sess, err := newSession(DefaultRegion(), creds, overrides)
+	if err != nil {
+		return "", err
+	}
+
+	identity, err := sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(identity.Arn), nil
+}
+
+// Check nothing is listening on the local port already, by listening on it for a moment
+func CheckLocalPort(port string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
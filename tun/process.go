@@ -0,0 +1,137 @@
+package tun
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long a process group gets to exit after SIGTERM before it's sent SIGKILL
+const defaultGracePeriod = 3 * time.Second
+
+/*
+groupProcess is a child process started in its own process group, so it can be taken
+down together with anything it spawned (the aws cli starts session-manager-plugin).
+
+The group id is the leader's pid, which can't be handed out again until the leader has
+been reaped by us, and the group id itself isn't reused while any member is alive. So the
+group is only ever signalled before the leader's reaped, and never hits an unrelated process.
+*/
+type groupProcess struct {
+	cmd *exec.Cmd
+
+	// How long to wait between SIGTERM and SIGKILL
+	grace time.Duration
+
+	// Closed once the leader has been reaped, waitErr is set before that
+	done    chan struct{}
+	waitErr error
+
+	// Held while signalling the group, reaping is set once it mustn't be signalled anymore
+	lock    sync.Mutex
+	reaping bool
+}
+
+/*
+Start the command in a new process group. The group is terminated when ctx is done,
+and anything left in the group after the leader exits is cleaned up as well.
+
+If the command can't be started, nothing is left running and no goroutines are started.
+*/
+func startGroupProcess(ctx context.Context, cmd *exec.Cmd, grace time.Duration) (*groupProcess, error) {
+	setProcessGroup(cmd)
+	// Grandchildren can hold the output pipes open after the leader exits, don't wait on them forever
+	if cmd.WaitDelay == 0 {
+		cmd.WaitDelay = grace
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Written down until the group's gone, in case tunny doesn't get to stop it
+	_tracker.add(ctx, cmd)
+
+	proc := &groupProcess{
+		cmd:   cmd,
+		grace: grace,
+		done:  make(chan struct{}),
+	}
+
+	// Reap the leader, once whatever it left of its group has been killed
+	go func() {
+		// Where the leader can't be waited on without reaping it, the group's killed just after
+		if err := waitForExit(cmd.Process.Pid); err == nil {
+			proc.finishGroup()
+			proc.waitErr = cmd.Wait()
+		} else {
+			proc.waitErr = cmd.Wait()
+			proc.finishGroup()
+		}
+		close(proc.done)
+	}()
+
+	// Take the whole group down when we're told to
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Printf("Context done, stopping process group %d", cmd.Process.Pid)
+			proc.stop()
+		case <-proc.done:
+		}
+		_tracker.remove(cmd.Process.Pid)
+	}()
+
+	return proc, nil
+}
+
+// Send the group a signal, unless the leader's been (or is being) reaped and its pid could be reused
+func (p *groupProcess) signal(send func(int) error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.reaping {
+		return nil
+	}
+	return send(p.cmd.Process.Pid)
+}
+
+// The leader has exited, whatever's left of the group gets no grace
+func (p *groupProcess) finishGroup() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := killGroup(p.cmd.Process.Pid); err != nil {
+		log.Printf("> Error cleaning up process group %d: %s", p.cmd.Process.Pid, err)
+	}
+	p.reaping = true
+}
+
+// SIGTERM the group, then SIGKILL it if the leader hasn't exited within the grace period
+func (p *groupProcess) stop() {
+	pid := p.cmd.Process.Pid
+
+	if err := p.signal(terminateGroup); err != nil {
+		log.Printf("> Error terminating process group %d: %s", pid, err)
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(p.grace):
+		log.Printf("Process group %d still running after %s, killing it", pid, p.grace)
+		if err := p.signal(killGroup); err != nil {
+			log.Printf("> Error killing process group %d: %s", pid, err)
+		}
+	}
+
+	<-p.done
+}
+
+// Closed once the process has exited and been reaped
+func (p *groupProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+// The result of waiting on the process, only valid once Done is closed
+func (p *groupProcess) Err() error {
+	return p.waitErr
+}
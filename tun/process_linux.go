@@ -0,0 +1,27 @@
+//go:build linux
+
+package tun
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// waitid's idtype for waiting on one pid
+const _P_PID = 1
+
+// Block until the process has exited, but leave it to be reaped by cmd.Wait
+func waitForExit(pid int) error {
+	// A siginfo_t, which isn't looked at
+	var info [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, _P_PID, uintptr(pid), uintptr(unsafe.Pointer(&info)), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+var errWaitUnsupported = errors.New("waiting without reaping isn't supported here")
+
+// Only Linux can wait on a process without reaping it, elsewhere cmd.Wait has to do both
+func waitForExit(pid int) error {
+	return errWaitUnsupported
+}
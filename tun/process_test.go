@@ -0,0 +1,150 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+A stand in for `aws ssm start-session`: it starts a child that ignores SIGTERM (like a
+stubborn session-manager-plugin), writes the child's pid out and then does whatever
+the leader part of the script says. The setup part runs before the child is started.
+*/
+func writeFakePlugin(t *testing.T, setup string, leader string) (script string, childPidFile string) {
+	dir := t.TempDir()
+	script = filepath.Join(dir, "fake-plugin")
+	childPidFile = filepath.Join(dir, "child.pid")
+
+	contents := "#!/bin/sh\n" +
+		setup + "\n" +
+		"sh -c 'trap \"\" TERM; exec sleep 100' &\n" +
+		"echo $! > " + childPidFile + "\n" +
+		leader + "\n"
+
+	if err := os.WriteFile(script, []byte(contents), 0755); err != nil {
+		t.Fatalf("Error writing fake plugin: %s", err)
+	}
+
+	return script, childPidFile
+}
+
+// Wait for the fake plugin to write out its child's pid
+func readChildPid(t *testing.T, childPidFile string) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		contents, err := os.ReadFile(childPidFile)
+		if err == nil && strings.HasSuffix(string(contents), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+			if err != nil {
+				t.Fatalf("Bad child pid %q: %s", contents, err)
+			}
+			return pid
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("Fake plugin never wrote its child pid")
+	return 0
+}
+
+// A zombie counts as dead, nobody might be around to reap it in a container
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+
+	// The state comes right after the parenthesised command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func waitForDeath(t *testing.T, pid int, within time.Duration) {
+	deadline := time.Now().Add(within)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Errorf("Process %d is still alive after %s", pid, within)
+	// Don't leave it behind for the next test run
+	exec.Command("kill", "-KILL", strconv.Itoa(pid)).Run()
+}
+
+func TestGroupProcessEscalatesToKill(t *testing.T) {
+	// The leader ignores SIGTERM too, so nothing goes until the SIGKILL
+	script, childPidFile := writeFakePlugin(t, "trap '' TERM", "wait")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proc, err := startGroupProcess(ctx, exec.Command(script), 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error starting fake plugin: %s", err)
+	}
+
+	childPid := readChildPid(t, childPidFile)
+	if !processAlive(childPid) {
+		t.Fatalf("Child %d should be running before we cancel", childPid)
+	}
+
+	cancelled := time.Now()
+	cancel()
+
+	select {
+	case <-proc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leader wasn't reaped after cancelling")
+	}
+
+	if waited := time.Since(cancelled); waited < 500*time.Millisecond {
+		t.Errorf("Leader went after %s, it should have taken the SIGKILL after the grace period", waited)
+	}
+
+	waitForDeath(t, childPid, 3*time.Second)
+}
+
+func TestGroupProcessCleansUpAfterLeaderExits(t *testing.T) {
+	script, childPidFile := writeFakePlugin(t, "", "exit 3")
+
+	proc, err := startGroupProcess(context.Background(), exec.Command(script), 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error starting fake plugin: %s", err)
+	}
+
+	childPid := readChildPid(t, childPidFile)
+
+	select {
+	case <-proc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leader wasn't reaped after exiting")
+	}
+
+	if exitErr, ok := proc.Err().(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("Expected exit code 3, got %v", proc.Err())
+	}
+
+	waitForDeath(t, childPid, 3*time.Second)
+}
+
+func TestGroupProcessStartFailure(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "not-a-plugin")
+
+	proc, err := startGroupProcess(context.Background(), exec.Command(missing), time.Second)
+	if err == nil {
+		t.Fatalf("Expected an error starting a missing binary")
+	}
+	if proc != nil {
+		t.Errorf("Expected no process when start fails, got %v", proc)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package tun
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Send a signal to every process in the group led by pid, a group that's already gone is fine
+func signalGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+func terminateGroup(pid int) error {
+	return signalGroup(pid, syscall.SIGTERM)
+}
+
+func killGroup(pid int) error {
+	return signalGroup(pid, syscall.SIGKILL)
+}
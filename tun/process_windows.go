@@ -0,0 +1,41 @@
+//go:build windows
+
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// Windows has no SIGTERM to send, so the tree is taken down with taskkill either way
+func terminateGroup(pid int) error {
+	return killGroup(pid)
+}
+
+func killGroup(pid int) error {
+	stdErrBuff := &bytes.Buffer{}
+
+	// The `/T` option is used to terminate all child processes along with the parent process, commonly known as a tree kill.
+	cmd := exec.Command("taskkill", "/PID", strconv.Itoa(pid), "/T", "/F")
+	cmd.Stderr = stdErrBuff
+
+	if err := cmd.Run(); err != nil {
+		// 128 is taskkill's "process not found", the tree is already gone
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 128 {
+			return nil
+		}
+		return fmt.Errorf("error killing process (stderr below): %s\n%s", err, stdErrBuff.String())
+	}
+
+	return nil
+}
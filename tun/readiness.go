@@ -0,0 +1,127 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The process went away before it was ready, its own exit status says more than we can
+var errExitedBeforeReady = errors.New("exited before it was ready")
+
+// How often the local port is probed while waiting for a tunnel to come up
+const readinessProbeInterval = 250 * time.Millisecond
+
+// How to tell that a freshly started tunnel is actually usable
+type Readiness struct {
+	// A line of output that means it's ready, nil to not watch the output
+	OutputPattern *regexp.Regexp
+
+	// An address to probe until it accepts connections, empty to not probe
+	ProbeAddress string
+
+	// How long to wait for either of the above
+	Timeout time.Duration
+}
+
+// Tracks one tunnel coming up, whichever of the output or the probe gets there first wins
+type readinessWatcher struct {
+	readiness Readiness
+
+	once  sync.Once
+	ready chan struct{}
+}
+
+func newReadinessWatcher(readiness Readiness) *readinessWatcher {
+	return &readinessWatcher{readiness: readiness, ready: make(chan struct{})}
+}
+
+func (w *readinessWatcher) markReady() {
+	w.once.Do(func() { close(w.ready) })
+}
+
+// Feed a line of the tunnel's output to the watcher
+func (w *readinessWatcher) line(line string) {
+	if w.readiness.OutputPattern != nil && w.readiness.OutputPattern.MatchString(line) {
+		w.markReady()
+	}
+}
+
+/*
+Wait until the tunnel is ready, the process exits (exited is closed) or the timeout passes.
+A nil error means it's ready.
+*/
+func (w *readinessWatcher) wait(ctx context.Context, exited <-chan struct{}) error {
+	probeCtx, cancelProbe := context.WithCancel(ctx)
+	defer cancelProbe()
+
+	if w.readiness.ProbeAddress != "" {
+		go w.probe(probeCtx)
+	}
+
+	var timeout <-chan time.Time
+	if w.readiness.Timeout > 0 {
+		timer := time.NewTimer(w.readiness.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-exited:
+		return errExitedBeforeReady
+	case <-timeout:
+		return fmt.Errorf("not ready after %s", w.readiness.Timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Keep trying to connect to the probe address until it works
+func (w *readinessWatcher) probe(ctx context.Context) {
+	dialer := &net.Dialer{Timeout: readinessProbeInterval}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", w.readiness.ProbeAddress)
+		if err == nil {
+			conn.Close()
+			w.markReady()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(readinessProbeInterval):
+		}
+	}
+}
+
+/*
+Connect to the address every interval until ctx is done. Each connection goes through
+the tunnel, which is enough traffic to keep an ssm session from hitting its idle timeout.
+*/
+func keepAlive(ctx context.Context, address string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	dialer := &net.Dialer{Timeout: interval}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err != nil {
+				log.Printf("Keepalive to %s failed: %s", address, err)
+				continue
+			}
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package tun
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestReadinessFromOutput(t *testing.T) {
+	watcher := newReadinessWatcher(Readiness{
+		OutputPattern: ssmReadyPattern,
+		Timeout:       2 * time.Second,
+	})
+
+	go func() {
+		watcher.line("Starting session with SessionId: someone-0123456789")
+		watcher.line("Port 8081 opened for sessionId someone-0123456789.")
+		watcher.line("Waiting for connections...")
+	}()
+
+	if err := watcher.wait(context.Background(), make(chan struct{})); err != nil {
+		t.Errorf("Expected ready, got %s", err)
+	}
+}
+
+func TestReadinessFromProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+
+	watcher := newReadinessWatcher(Readiness{
+		OutputPattern: regexp.MustCompile(`never printed`),
+		ProbeAddress:  listener.Addr().String(),
+		Timeout:       2 * time.Second,
+	})
+
+	if err := watcher.wait(context.Background(), make(chan struct{})); err != nil {
+		t.Errorf("Expected ready, got %s", err)
+	}
+}
+
+func TestReadinessTimesOut(t *testing.T) {
+	// Grab a port and let it go, so nothing is listening on it
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	watcher := newReadinessWatcher(Readiness{
+		OutputPattern: ssmReadyPattern,
+		ProbeAddress:  address,
+		Timeout:       600 * time.Millisecond,
+	})
+	watcher.line("Starting session with SessionId: someone-0123456789")
+
+	if err := watcher.wait(context.Background(), make(chan struct{})); err == nil {
+		t.Errorf("Expected a timeout, but it was ready")
+	}
+}
+
+func TestReadinessProcessExited(t *testing.T) {
+	watcher := newReadinessWatcher(Readiness{OutputPattern: ssmReadyPattern, Timeout: 2 * time.Second})
+
+	exited := make(chan struct{})
+	close(exited)
+
+	if err := watcher.wait(context.Background(), exited); err != errExitedBeforeReady {
+		t.Errorf("Expected errExitedBeforeReady, got %v", err)
+	}
+}
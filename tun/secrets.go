@@ -0,0 +1,60 @@
+package tun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+/*
+GetSecretString gets a secret's value from Secrets Manager. secretId is its name or arn, an arn's
+region is used rather than region. A secret that's a json object can have one of its keys picked
+with secretId#key, e.g. prod/db#password.
+*/
+func GetSecretString(
+	ctx context.Context,
+	region string,
+	creds *credentials.Credentials,
+	overrides AwsOverrides,
+	secretId string,
+) (string, error) {
+	secretId, key, _ := strings.Cut(secretId, "#")
+	if parts := strings.Split(secretId, ":"); len(parts) > 3 && parts[0] == "arn" && parts[3] != "" {
+		region = parts[3]
+	}
+
+	sess, err := newSession(region, creds, overrides)
+	if err != nil {
+		return "", err
+	}
+	output, err := secretsmanager.New(sess).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error getting secret %s: %w", secretId, err)
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("Secret %s is binary, only string secrets can be used", secretId)
+	}
+
+	if key == "" {
+		return *output.SecretString, nil
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(*output.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("Secret %s isn't a json object, so it has no key %s", secretId, key)
+	}
+	value, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no key %s", secretId, key)
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	return fmt.Sprint(value), nil
+}
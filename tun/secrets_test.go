@@ -0,0 +1,64 @@
+package tun_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tunny/tun"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestGetSecretString(t *testing.T) {
+	secrets := map[string]string{
+		"prod/db": `{"username": "app", "password": "hunter2", "port": 5432}`,
+		"plain":   "just-a-token",
+		"arn:aws:secretsmanager:eu-west-1:123:secret:other": "from-an-arn",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "secretsmanager.GetSecretValue" {
+			t.Errorf("Unexpected call %s", target)
+		}
+		var input struct{ SecretId string }
+		json.NewDecoder(r.Body).Decode(&input)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		secret, ok := secrets[input.SecretId]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."}`))
+			return
+		}
+		if strings.HasPrefix(input.SecretId, "arn:") && !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/") {
+			t.Errorf("Expected the arn's region to be used, got %s", r.Header.Get("Authorization"))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Name": input.SecretId, "SecretString": secret})
+	}))
+	defer server.Close()
+
+	creds := credentials.NewStaticCredentials("id", "secret", "")
+	overrides := tun.AwsOverrides{SecretsManagerEndpoint: server.URL}
+	get := func(id string) (string, error) {
+		return tun.GetSecretString(context.Background(), "us-west-2", creds, overrides, id)
+	}
+
+	for id, expected := range map[string]string{
+		"plain":            "just-a-token",
+		"prod/db#password": "hunter2",
+		"prod/db#port":     "5432",
+		"arn:aws:secretsmanager:eu-west-1:123:secret:other": "from-an-arn",
+	} {
+		if value, err := get(id); err != nil || value != expected {
+			t.Errorf("Expected %s to be %q, got %q (%v)", id, expected, value, err)
+		}
+	}
+
+	for _, id := range []string{"missing", "prod/db#nope", "plain#key"} {
+		if value, err := get(id); err == nil {
+			t.Errorf("Expected %s to be an error, got %q", id, value)
+		}
+	}
+}
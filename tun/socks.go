@@ -0,0 +1,149 @@
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The bits of SOCKS5 (RFC 1928) we speak: no auth, CONNECT only
+const (
+	socksVersion          = 0x05
+	socksNoAuth           = 0x00
+	socksNoAcceptable     = 0xff
+	socksConnect          = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksCmdNotSupported  = 0x07
+	socksAtypNotSupported = 0x08
+)
+
+// Serve a SOCKS5 proxy on the listener, every connection is dialed through the ssh client
+func serveSocks(ctx context.Context, client *ssh.Client, listener net.Listener) {
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error accepting socks connection: %s", err)
+			}
+			return
+		}
+
+		go func() {
+			remoteConn, err := socksHandshake(localConn, func(address string) (net.Conn, error) {
+				return client.Dial("tcp", address)
+			})
+			if err != nil {
+				log.Printf("Socks connection failed: %s", err)
+				localConn.Close()
+				return
+			}
+
+			handleSshTunnelConnections(ctx, localConn, remoteConn)
+		}()
+	}
+}
+
+/*
+Go through the SOCKS5 greeting and CONNECT request on conn, dial what was asked for and
+tell the client how it went. Returns the dialed connection on success.
+*/
+func socksHandshake(conn net.Conn, dial func(address string) (net.Conn, error)) (net.Conn, error) {
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	noAuth := false
+	for _, method := range methods {
+		if method == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return nil, fmt.Errorf("client doesn't offer no-auth")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return nil, err
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return nil, fmt.Errorf("unsupported socks command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if request[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAtypNotSupported)
+		return nil, fmt.Errorf("unsupported socks address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	remoteConn, err := dial(address)
+	if err != nil {
+		socksReply(conn, socksGeneralFailure)
+		return nil, fmt.Errorf("error dialing %s: %w", address, err)
+	}
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		remoteConn.Close()
+		return nil, err
+	}
+
+	return remoteConn, nil
+}
+
+// Reply to a request, the bound address isn't something we know so it's always zeros
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
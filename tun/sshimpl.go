@@ -6,8 +6,13 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func bufferingCancelableCopy(
@@ -46,95 +51,224 @@ func bufferingCancelableCopy(
 	}
 }
 
-// Handle forwarding connections to and from an ssh tunnel
+/*
+Handle forwarding connections to and from an ssh tunnel.
+Both connections are closed once either side is done or the context is, a blocked read
+can't see the context so closing is what actually stops the copying.
+*/
 func handleSshTunnelConnections(
 	ctx context.Context,
 	localConn net.Conn,
 	remoteConn net.Conn,
-	// A channel to send errors to
-	errChan chan<- error,
 ) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	localToRemoteDone := make(chan bool)
-	remoteToLocalDone := make(chan bool)
+	go func() {
+		<-connCtx.Done()
+		localConn.Close()
+		remoteConn.Close()
+	}()
+
+	done := make(chan bool, 2)
 
 	// Forward localConn to remoteConn
 	go func() {
-		defer close(errChan)
-		_, err := bufferingCancelableCopy(ctx, remoteConn, localConn)
-		if err != nil {
-			errChan <- err
+		_, err := bufferingCancelableCopy(connCtx, remoteConn, localConn)
+		if err != nil && connCtx.Err() == nil {
+			log.Printf("Error copying to remote: %s", err)
 		}
-		localToRemoteDone <- true
+		done <- true
 	}()
 
 	// Forward remoteConn to localConn
 	go func() {
-		defer close(errChan)
-		_, err := bufferingCancelableCopy(ctx, localConn, remoteConn)
-		if err != nil {
-			errChan <- err
+		_, err := bufferingCancelableCopy(connCtx, localConn, remoteConn)
+		if err != nil && connCtx.Err() == nil {
+			log.Printf("Error copying to local: %s", err)
 		}
-		remoteToLocalDone <- true
+		done <- true
 	}()
 
-	<-localToRemoteDone
-	<-remoteToLocalDone
+	// Either side finishing means the connection is over
+	<-done
+}
 
+// One local port forwarded to a remote host and port through ssh
+type SshForward struct {
+	LocalPort  string
+	RemoteHost string
+	RemotePort string
 }
-func StartSSHTunnel(
-	ctx context.Context,
-	config *ssh.ClientConfig,
-	sshHost string,
-	localPort string,
-	remoteHost string,
-	remotePort string,
-) (eventualErr <-chan error, startErr error) {
 
-	errChan := make(chan error)
+/*
+Get a host key callback that checks against known_hosts files, ~/.ssh/known_hosts
+when none are given. Hosts that aren't in them are refused.
+*/
+func KnownHostsCallback(knownHostsPaths ...string) (ssh.HostKeyCallback, error) {
+	if len(knownHostsPaths) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsPaths = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
 
-	eventualErr = errChan
+	return knownhosts.New(knownHostsPaths...)
+}
 
-	sshConn, err := ssh.Dial("tcp", sshHost, config)
+// Dial an ssh server over plain tcp
+func DialSSH(ctx context.Context, config *ssh.ClientConfig, sshHost string) (*ssh.Client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", sshHost)
 	if err != nil {
 		return nil, err
 	}
 
-	// Listen on local port
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%s", localPort))
+	return NewSSHClient(conn, sshHost, config)
+}
+
+/*
+Run an ssh client over any connection, e.g. one from DialSSHOverSSM.
+The address is what the host key is checked against.
+*/
+func NewSSHClient(conn net.Conn, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	// Handle incoming connections on reverse forwarded tunnel
-	go func() {
-		defer listener.Close()
-		defer sshConn.Close()
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
 
-		go func() {
-			<-ctx.Done()
+/*
+StartSSHForwards serves every forward, and a socks proxy when socksPort isn't empty,
+over a single ssh client. All the local ports are listening by the time it returns.
+
+The eventual error channel gets an error if the ssh connection dies, and is closed
+once everything is shut down. The client is closed when ctx is done.
+*/
+func StartSSHForwards(
+	ctx context.Context,
+	client *ssh.Client,
+	forwards []SshForward,
+	socksPort string,
+) (eventualErr <-chan error, startErr error) {
+	listeners := make([]net.Listener, 0, len(forwards)+1)
+	closeAll := func() {
+		for _, listener := range listeners {
 			listener.Close()
+		}
+		client.Close()
+	}
+
+	// Listen on every local port up front, so a port that's taken fails the whole start
+	for _, forward := range forwards {
+		listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%s", forward.LocalPort))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	var socksListener net.Listener
+	if socksPort != "" {
+		var err error
+		socksListener, err = net.Listen("tcp", fmt.Sprintf("localhost:%s", socksPort))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, socksListener)
+	}
+
+	errChan := make(chan error, 1)
+	eventualErr = errChan
+
+	runCtx, cancel := context.WithCancel(ctx)
+	accepting := &sync.WaitGroup{}
+
+	for i, forward := range forwards {
+		accepting.Add(1)
+		go func(listener net.Listener, forward SshForward) {
+			defer accepting.Done()
+			acceptForward(runCtx, client, listener, forward)
+		}(listeners[i], forward)
+	}
+	if socksListener != nil {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			serveSocks(runCtx, client, socksListener)
 		}()
+	}
 
-		for {
+	// Wait for the ssh connection to die (or be closed because we're done)
+	connDone := make(chan error, 1)
+	go func() {
+		connDone <- client.Wait()
+	}()
 
-			localConn, err := listener.Accept()
-			if err != nil {
-				log.Printf("Error accepting connection: %s", err)
-				break
+	go func() {
+		defer close(errChan)
+
+		select {
+		case <-ctx.Done():
+		case err := <-connDone:
+			if ctx.Err() == nil {
+				if err == nil {
+					err = fmt.Errorf("ssh connection closed")
+				}
+				errChan <- fmt.Errorf("ssh connection lost: %w", err)
 			}
+		}
+
+		cancel()
+		closeAll()
+		accepting.Wait()
+	}()
 
-			forwardConn, err := sshConn.Dial("tcp", fmt.Sprintf("%s:%s", remoteHost, remotePort))
+	return eventualErr, nil
+}
 
+// Forward every connection accepted on the listener through the ssh client
+func acceptForward(ctx context.Context, client *ssh.Client, listener net.Listener, forward SshForward) {
+	remoteAddress := net.JoinHostPort(forward.RemoteHost, forward.RemotePort)
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error accepting connection: %s", err)
+			}
+			return
+		}
+
+		go func() {
+			forwardConn, err := client.Dial("tcp", remoteAddress)
 			if err != nil {
-				log.Printf("Error dialing remote host: %s", err)
-				continue
+				log.Printf("Error dialing remote host %s: %s", remoteAddress, err)
+				localConn.Close()
+				return
 			}
 
-			go handleSshTunnelConnections(ctx, forwardConn, localConn, errChan)
+			handleSshTunnelConnections(ctx, localConn, forwardConn)
+		}()
+	}
+}
 
-		}
-	}()
+func StartSSHTunnel(
+	ctx context.Context,
+	config *ssh.ClientConfig,
+	sshHost string,
+	localPort string,
+	remoteHost string,
+	remotePort string,
+) (eventualErr <-chan error, startErr error) {
+	sshConn, err := DialSSH(ctx, config, sshHost)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil, nil
+	return StartSSHForwards(ctx, sshConn, []SshForward{{localPort, remoteHost, remotePort}}, "")
 }
@@ -1,11 +1,19 @@
 package tun_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 	"tunny/tun"
@@ -23,7 +31,9 @@ func TestStartSshProxy(t *testing.T) {
 
 	// Read the config
 	readFile, err := os.ReadFile("test_ssh_config.json")
-	if err != nil {
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("Needs a real ssh server described in test_ssh_config.json")
+	} else if err != nil {
 		t.Errorf("Error reading ssh config: %s", err)
 		return
 	}
@@ -118,3 +128,254 @@ func TestStartSshProxy(t *testing.T) {
 	}
 
 }
+
+/*
+Serve ssh on conn in the background, forwarding direct-tcpip channels like sshd does. It's
+stopped and waited for before the test finishes, so it never logs to a test that's completed.
+*/
+func serveFakeSsh(t *testing.T, conn net.Conn, hostKey ssh.Signer) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runFakeSsh(t, conn, hostKey)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+}
+
+func runFakeSsh(t *testing.T, conn net.Conn, hostKey ssh.Signer) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		t.Logf("Fake ssh server handshake failed: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "direct-tcpip" {
+			newChan.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+			continue
+		}
+
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, chanReqs, err := newChan.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chanReqs)
+		go func() {
+			defer channel.Close()
+			defer target.Close()
+			go io.Copy(target, channel)
+			io.Copy(channel, target)
+		}()
+	}
+}
+
+// A tcp server that sends back whatever it gets, prefixed with its name
+func startEchoServer(t *testing.T, name string) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name + ": " + line))
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// A local port nothing is listening on
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+/*
+Two ends of a connection, standing in for an ssm session's stdin and stdout.
+net.Pipe won't do, both ends of an ssh handshake write before they read.
+*/
+func connectedPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	serverSide, ok := <-accepted
+	if !ok {
+		t.Fatalf("Error accepting")
+	}
+
+	return clientSide, serverSide
+}
+
+func echoThrough(conn net.Conn, msg string) (string, error) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte(msg + "\n")); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+// Runs the ssh client over a connection we hand it, the same way it runs over an ssm session
+func TestSSHForwardsOverAnyConnection(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating host key: %s", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Error making host key signer: %s", err)
+	}
+
+	clientSide, serverSide := connectedPair(t)
+	serveFakeSsh(t, serverSide, hostKey)
+
+	client, err := tun.NewSSHClient(clientSide, "i-0123456789abcdef0:22", &ssh.ClientConfig{
+		User:            "ec2-user",
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatalf("Error starting ssh client: %s", err)
+	}
+
+	firstHost, firstPort, _ := net.SplitHostPort(startEchoServer(t, "first"))
+	secondHost, secondPort, _ := net.SplitHostPort(startEchoServer(t, "second"))
+	forwards := []tun.SshForward{
+		{LocalPort: freePort(t), RemoteHost: firstHost, RemotePort: firstPort},
+		{LocalPort: freePort(t), RemoteHost: secondHost, RemotePort: secondPort},
+	}
+	socksPort := freePort(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventualErr, err := tun.StartSSHForwards(ctx, client, forwards, socksPort)
+	if err != nil {
+		t.Fatalf("Error starting forwards: %s", err)
+	}
+
+	for i, name := range []string{"first", "second"} {
+		conn, err := net.Dial("tcp", "localhost:"+forwards[i].LocalPort)
+		if err != nil {
+			t.Fatalf("Error dialing forward %d: %s", i, err)
+		}
+		reply, err := echoThrough(conn, "hello")
+		if err != nil {
+			t.Fatalf("Error talking through forward %d: %s", i, err)
+		}
+		if reply != name+": hello\n" {
+			t.Errorf("Forward %d: expected a reply from %s, got %q", i, name, reply)
+		}
+	}
+
+	// And the second echo server again, through the socks proxy this time
+	conn, err := net.Dial("tcp", "localhost:"+socksPort)
+	if err != nil {
+		t.Fatalf("Error dialing socks proxy: %s", err)
+	}
+	port, _ := strconv.Atoi(secondPort)
+	request := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, byte(len(secondHost))}
+	request = append(request, []byte(secondHost)...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Error writing socks request: %s", err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Error reading socks reply: %s", err)
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 || reply[3] != 0x00 {
+		t.Fatalf("Socks proxy refused the connection: %v", reply)
+	}
+	socksReply, err := echoThrough(conn, "through socks")
+	if err != nil {
+		t.Fatalf("Error talking through socks: %s", err)
+	}
+	if socksReply != "second: through socks\n" {
+		t.Errorf("Expected a reply from second through socks, got %q", socksReply)
+	}
+
+	cancel()
+	select {
+	case err, ok := <-eventualErr:
+		if ok && err != nil {
+			t.Errorf("Expected a clean shutdown, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Forwards didn't shut down")
+	}
+}
+
+func TestSSHHostKeyMismatch(t *testing.T) {
+	_, serverPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(serverPrivate)
+	otherKey, _ := ssh.NewSignerFromKey(otherPrivate)
+
+	clientSide, serverSide := connectedPair(t)
+	serveFakeSsh(t, serverSide, hostKey)
+
+	_, err := tun.NewSSHClient(clientSide, "i-0123456789abcdef0:22", &ssh.ClientConfig{
+		User:            "ec2-user",
+		HostKeyCallback: ssh.FixedHostKey(otherKey.PublicKey()),
+	})
+	if err == nil {
+		t.Errorf("Expected the handshake to fail with the wrong host key")
+	}
+}
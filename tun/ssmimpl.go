@@ -1,174 +1,67 @@
 package tun
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"log"
-	"os/exec"
-	"runtime"
-	"strconv"
-	"sync"
+	"net"
+	"regexp"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 )
 
-func NewEc2() (*Ec2Interactor, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2"),
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	svc := ec2.New(sess)
-	return &Ec2Interactor{svc, make([]*ec2.Instance, 0, 20)}, nil
-}
+// How long the plugin gets to start listening when nothing else is said
+const defaultSsmStartupTimeout = 30 * time.Second
 
-type Ec2Interactor struct {
-	Ec2Svc *ec2.EC2
+// The plugin prints this once the local port is listening
+var ssmReadyPattern = regexp.MustCompile(`Waiting for connections`)
 
-	// The ec2 instances we've looked up
-	instances []*ec2.Instance
-}
-
-// refresh all ec2 instances for a region
-func fetchEC2Instances(ctx context.Context, region string) ([]*ec2.Instance, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})
-	if err != nil {
-		return nil, err
-	}
+// Optional settings for an ssm session
+type SsmOptions struct {
+	// The credentials handed to the aws cli, it falls back to its own chain when nil
+	Credentials *credentials.Credentials
 
-	input := &ec2.DescribeInstancesInput{}
+	// How long the plugin gets to start listening before the session is given up on
+	StartupTimeout time.Duration
 
-	ek2 := ec2.New(sess)
+	// Called once the local port is accepting connections
+	OnReady func()
 
-	result, err := ek2.DescribeInstancesWithContext(ctx, input)
-	if err != nil {
-		return nil, err
-	}
-	var instances []*ec2.Instance
-	for _, reservation := range result.Reservations {
-		instances = append(instances, reservation.Instances...)
-	}
+	// Called with every line the cli and plugin print, as it's printed
+	OnOutput func(stream OutputStream, line string)
 
-	return instances, nil
-}
+	// Connect to the local port this often once it's ready, so the session doesn't time out idle.
+	// 0 turns it off.
+	KeepaliveInterval time.Duration
 
-func (e *Ec2Interactor) GetAnInstanceForBeanstalkEnv(beanstalkName string) (*ec2.Instance, error) {
-	for _, instance := range e.instances {
-		for _, tag := range instance.Tags {
-			if *tag.Key == "elasticbeanstalk:environment-name" {
-				if *tag.Value == beanstalkName {
-					return instance, nil
-				}
-			}
-		}
-	}
+	// The ssm endpoint, the aws cli and the plugin to use, the environment's or the real ones otherwise
+	Overrides AwsOverrides
 
-	return nil, fmt.Errorf("no instance for %s found", beanstalkName)
+	// The region to start the session in, the cli's own default when empty
+	Region string
 }
 
-// Go try and refresh all the regions
-func (e *Ec2Interactor) RefreshAllRegions() []error {
-	input := &ec2.DescribeRegionsInput{}
-	// log.Println("Refreshing regions, getting regions first")
-	regions, err := e.Ec2Svc.DescribeRegions(input)
+/*
+The command line and environment for an `aws ssm start-session` with the given arguments,
+with the credentials, region and overrides from opts.
+*/
+func ssmSessionCommand(opts *SsmOptions, args ...string) ([]string, []string, error) {
+	credEnv, err := credentialsEnv(opts.Credentials)
 	if err != nil {
-		return []error{err}
-	}
-
-	waitgroup := &sync.WaitGroup{}
-	resultChan := make(chan []*ec2.Instance, 3)
-	errChan := make(chan error, 3)
-
-	// range over the regions
-	for _, reg := range regions.Regions {
-		waitgroup.Add(1)
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second*45)
-		// log.Print("Starting refresh for region ", *reg.RegionName)
-		// Go start a goroutine to refresh the instances for each region
-		go func(region *ec2.Region) {
-			defer waitgroup.Done()
-			defer cancel()
-			// Refresh the instances for each region
-			result, err := fetchEC2Instances(timeoutCtx, *region.RegionName)
-			if err != nil {
-				if err == context.DeadlineExceeded {
-					errChan <- fmt.Errorf("refreshEC2Instances for region %s timed out", *region.RegionName)
-				} else {
-					errChan <- err
-				}
-				return
-			}
-
-			// log.Printf("Got %d results for region %s", len(result), *region.RegionName)
-			resultChan <- result
-		}(reg)
-	}
-
-	// Wait for all the goroutines to finish
-	go func() {
-		// log.Print("Waiting for all refreshes to finish")
-		waitgroup.Wait()
-		close(resultChan)
-		close(errChan)
-	}()
-
-	// As results come in, append them to the instances list
-	for result := range resultChan {
-		// log.Printf("Got %d results", len(result))
-		e.instances = append(e.instances, result...)
-		// log.Printf("Total instances: %d", len(e.instances))
-	}
-
-	// As errors come in, append them to the errors list
-	var errors []error = nil
-	for err := range errChan {
-		if errors == nil {
-			errors = make([]error, 0)
-		}
-		errors = append(errors, err)
-	}
-
-	log.Printf("Got %d instances", len(e.instances))
-	return errors
-
-}
-
-func superKill(pid int) error {
-	var cmd *exec.Cmd
-
-	stdErrBuff := &bytes.Buffer{}
-	switch runtime.GOOS {
-	case "windows":
-		// Taskkill is used to terminate tasks by process id or image name.
-		// The `/T` option is used to terminate all child processes along with the parent process, commonly known as a tree kill.
-		cmd = exec.Command("taskkill", "/PID", strconv.Itoa(pid), "/T", "/F")
-
-	case "darwin", "linux":
-		// Pgrep finds processes by a parent pid, and we're passing that list to pkill to terminate them.
-		// Then, we kill the parent process.
-		cmd = exec.Command("/bin/sh", "-c", "pkill -TERM -P "+strconv.Itoa(pid)+"; kill -TERM "+strconv.Itoa(pid))
-
-	default:
-		return fmt.Errorf("unsupported platform")
+		return nil, nil, fmt.Errorf("error getting credentials for the ssm session: %w", err)
 	}
 
-	cmd.Stderr = stdErrBuff
-
-	execErr := cmd.Run()
-
-	if execErr != nil {
-		return fmt.Errorf("error killing process (stderr below): %s\n%s", execErr, stdErrBuff.String())
+	overrides := opts.Overrides.Or(AwsOverridesFromEnv())
+	if opts.Region != "" {
+		args = append([]string{"--region", opts.Region}, args...)
 	}
+	cmdArgs := overrides.cliArgs(endpoints.SsmServiceID, append([]string{"ssm", "start-session"}, args...)...)
 
-	return nil
+	var env []string
+	env = append(env, credEnv...)
+	env = append(env, overrides.cliEnv()...)
+	return cmdArgs, env, nil
 }
 
 /*
@@ -180,7 +73,11 @@ func StartSSMProxy(
 	localport string,
 	remote_host string,
 	remote_port string,
+	opts *SsmOptions,
 ) (ocmdErr <-chan error, startErr error) {
+	if opts == nil {
+		opts = &SsmOptions{}
+	}
 
 	documentStr := fmt.Sprintf(
 		"host=%s,portNumber=%s,localPortNumber=%s",
@@ -189,66 +86,35 @@ func StartSSMProxy(
 		localport,
 	)
 
-	args := []string{
-		"aws",
-		"ssm",
-		"start-session",
+	args, env, err := ssmSessionCommand(opts,
 		"--target",
 		instanceid,
 		"--document-name",
 		"AWS-StartPortForwardingSessionToRemoteHost",
 		"--parameters",
 		documentStr,
-	}
-
-	log.Printf("Starting command: \"%s\"\n", args)
-
-	// Set up the command
-	cmd := exec.CommandContext(
-		ctx,
-		args[0],
-		args[1:]...,
 	)
-
-	doKill := make(chan bool)
-
-	cmdErr := make(chan error)
-	ocmdErr = cmdErr
-	go func(ctx context.Context, cmd *exec.Cmd) {
-		var kerr error
-		select {
-		case <-ctx.Done():
-			log.Printf("Context done, killing process")
-			kerr = superKill(cmd.Process.Pid)
-		case <-doKill:
-			log.Printf("Killing process")
-			kerr = superKill(cmd.Process.Pid)
-		}
-		if kerr != nil {
-			log.Printf("> Error killing process: %s", kerr)
-		}
-
-	}(ctx, cmd)
-
-	errBits := &bytes.Buffer{}
-	cmd.Stderr = errBits
-
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		startErr = err
+	if err != nil {
+		return nil, err
 	}
 
-	// This goroutine will wait for the command to finish, and then close the cmdErr channel
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			log.Printf("Command finished with error: %v", err)
-			log.Printf("Stderr: %s", errBits.String())
-			// Capture the stderr and wrap it along with the original error
-			cmdErr <- fmt.Errorf("%v: %s", err, errBits.String())
-		}
-		doKill <- true
-		close(cmdErr)
-	}()
-
-	return
+	startupTimeout := opts.StartupTimeout
+	if startupTimeout <= 0 {
+		startupTimeout = defaultSsmStartupTimeout
+	}
+	localAddress := net.JoinHostPort("localhost", localport)
+
+	return StartCommandTunnel(ctx, CommandTunnel{
+		Args: args,
+		Env:  env,
+		Readiness: Readiness{
+			OutputPattern: ssmReadyPattern,
+			ProbeAddress:  localAddress,
+			Timeout:       startupTimeout,
+		},
+		OnReady:           opts.OnReady,
+		OnOutput:          opts.OnOutput,
+		KeepaliveAddress:  localAddress,
+		KeepaliveInterval: opts.KeepaliveInterval,
+	})
 }
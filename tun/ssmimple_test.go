@@ -2,15 +2,21 @@ package tun_test
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"testing"
 	"time"
 	"tunny/tun"
 )
 
 func TestStartWithBadParamsAndCleaned(t *testing.T) {
+	if _, err := exec.LookPath("aws"); err != nil {
+		t.Skip("Needs the aws cli, TestDiscoveryAndSessionAgainstFakes runs without it")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -19,7 +25,8 @@ func TestStartWithBadParamsAndCleaned(t *testing.T) {
 		"i-12345678901234567",
 		"8081",
 		"httpbin.org",
-		"80")
+		"80",
+		nil)
 
 	if err != nil {
 		t.Errorf("Error starting proxy: %s", err)
@@ -44,7 +51,9 @@ func TestStartWithBadParamsAndCleaned(t *testing.T) {
 func TestStartEbSSMProxyToEnvVar(t *testing.T) {
 
 	envValueBytes, err := os.ReadFile("test_env_name.txt")
-	if err != nil {
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("Needs a real beanstalk environment named in test_env_name.txt")
+	} else if err != nil {
 		t.Errorf("Error opening test_env_name.txt: %s", err)
 		return
 	}
@@ -53,22 +62,7 @@ func TestStartEbSSMProxyToEnvVar(t *testing.T) {
 
 	t.Logf("AWS_EB_NAME is %s", envValue)
 
-	ec2, err := tun.NewEc2()
-	if err != nil {
-		t.Errorf("Error creating ec2: %s", err)
-		return
-	}
-
-	errs := ec2.RefreshAllRegions()
-	if len(errs) > 0 {
-		for _, err := range errs {
-			t.Errorf("Error refreshing ec2: %s", err)
-		}
-		return
-	}
-
-	// get the instance for the eb env
-	inst, err := ec2.GetAnInstanceForBeanstalkEnv(envValue)
+	env, err := tun.ResolveBeanstalkEnv(context.Background(), tun.DefaultRegion(), nil, tun.AwsOverrides{}, "", envValue)
 	if err != nil {
 		t.Errorf("Error getting instance for beanstalk: %s", err)
 		return
@@ -78,10 +72,11 @@ func TestStartEbSSMProxyToEnvVar(t *testing.T) {
 	defer cancel()
 
 	eventualErr, err := tun.StartSSMProxy(ctx,
-		*inst.InstanceId,
+		env.InstanceId,
 		"8080",
 		"httpbin.org",
-		"80")
+		"80",
+		nil)
 
 	if err != nil {
 		t.Errorf("Error starting proxy: %s", err)
@@ -0,0 +1,179 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Stands in for an address on a connection that's really a process's stdin and stdout
+type processAddr string
+
+func (a processAddr) Network() string { return "ssm" }
+func (a processAddr) String() string  { return string(a) }
+
+/*
+processConn is a net.Conn over the stdin and stdout of a running ssm session, the same
+thing ssh's ProxyCommand does. Closing it stops the session.
+Deadlines aren't supported, the ssh client doesn't need them.
+*/
+type processConn struct {
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	proc   *groupProcess
+	stop   context.CancelFunc
+	target string
+
+	// What the session printed on stderr, for when it goes away
+	errBits *outputTail
+
+	closeOnce sync.Once
+}
+
+func (c *processConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if err != nil {
+		err = c.explain(err)
+	}
+	return n, err
+}
+
+func (c *processConn) Write(b []byte) (int, error) {
+	n, err := c.stdin.Write(b)
+	if err != nil {
+		err = c.explain(err)
+	}
+	return n, err
+}
+
+/*
+When the stream breaks because the session failed, say why with what the session printed,
+e.g. so expired credentials can be told apart from a network problem.
+*/
+func (c *processConn) explain(err error) error {
+	select {
+	case <-c.proc.Done():
+	case <-time.After(c.proc.grace):
+		return err
+	}
+
+	if procErr := c.proc.Err(); procErr != nil {
+		return fmt.Errorf("ssm session to %s ended: %v: %s", c.target, procErr, c.errBits.String())
+	}
+	return err
+}
+
+func (c *processConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.stop()
+		c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *processConn) LocalAddr() net.Addr                { return processAddr("localhost") }
+func (c *processConn) RemoteAddr() net.Addr               { return processAddr(c.target) }
+func (c *processConn) SetDeadline(t time.Time) error      { return nil }
+func (c *processConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *processConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Closed once the session process has exited
+func (c *processConn) Done() <-chan struct{} {
+	return c.proc.Done()
+}
+
+/*
+DialSSHOverSSM opens an AWS-StartSSHSession stream to the port (usually 22) of the instance
+and hands it back as a connection, ready for NewSSHClient. Nothing needs to be listening
+on the instance's port from the outside, only the ssm agent is involved.
+
+Only the credentials, overrides, region and output callback of opts are used.
+*/
+func DialSSHOverSSM(
+	ctx context.Context,
+	instanceid string,
+	port string,
+	opts *SsmOptions,
+) (net.Conn, error) {
+	if opts == nil {
+		opts = &SsmOptions{}
+	}
+
+	args, env, err := ssmSessionCommand(opts,
+		"--target",
+		instanceid,
+		"--document-name",
+		"AWS-StartSSHSession",
+		"--parameters",
+		fmt.Sprintf("portNumber=%s", port),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Starting command: \"%s\"\n", args)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Our own pipe rather than StdoutPipe, which mustn't be read from once Wait may be called
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout = stdoutWriter
+
+	// stdout is the ssh stream, so only stderr is the session talking to us
+	errBits := newOutputTail(50)
+	stderr := &lineWriter{onLine: func(line string) {
+		errBits.add(line)
+		if opts.OnOutput != nil {
+			opts.OnOutput(Stderr, line)
+		}
+	}}
+	cmd.Stderr = stderr
+
+	procCtx, stopProc := context.WithCancel(ctx)
+	proc, err := startGroupProcess(procCtx, cmd, defaultGracePeriod)
+	// The session has its own copy of the writing end, ours would keep reads from ever ending
+	stdoutWriter.Close()
+	if err != nil {
+		stopProc()
+		stdin.Close()
+		stdout.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-proc.Done()
+		stderr.Flush()
+		if err := proc.Err(); err != nil && procCtx.Err() == nil {
+			log.Printf("SSH session to %s finished with error: %v", instanceid, err)
+			log.Printf("Stderr: %s", errBits.String())
+		}
+	}()
+
+	return &processConn{
+		stdin:  stdin,
+		stdout: stdout,
+		proc:   proc,
+		stop:   stopProc,
+		target: instanceid,
+
+		errBits: errBits,
+	}, nil
+}
@@ -0,0 +1,95 @@
+package tun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// The device code the cli prints, e.g. ABCD-EFGH
+var ssoUserCodeRegex = regexp.MustCompile(`^[A-Z0-9]{4}-[A-Z0-9]{4}$`)
+
+// A running SSO device login, the user has to visit the url and enter the code
+type SsoLogin struct {
+	VerificationUrl string
+	UserCode        string
+
+	// Gets the result of the login once the user is done (or it fails)
+	Done <-chan error
+}
+
+/*
+StartSsoLogin runs `aws sso login --no-browser` and returns as soon as it has printed the
+verification url and code, the login itself finishes later on the Done channel.
+*/
+func StartSsoLogin(ctx context.Context) (*SsoLogin, error) {
+	args := []string{"aws", "sso", "login", "--no-browser"}
+	log.Printf("Starting command: \"%s\"\n", args)
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	errBits := &bytes.Buffer{}
+	cmd.Stderr = errBits
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	login := &SsoLogin{}
+	found := make(chan bool, 1)
+	done := make(chan error, 1)
+	login.Done = done
+
+	go func() {
+		output := &strings.Builder{}
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			output.WriteString(line + "\n")
+
+			if login.VerificationUrl == "" && strings.HasPrefix(line, "https://") {
+				login.VerificationUrl = line
+				// Newer cli versions put the code right in the url
+				if parsed, err := url.Parse(line); err == nil && parsed.Query().Get("user_code") != "" {
+					login.UserCode = parsed.Query().Get("user_code")
+				}
+			} else if login.UserCode == "" && ssoUserCodeRegex.MatchString(line) {
+				login.UserCode = line
+			}
+
+			if login.VerificationUrl != "" && login.UserCode != "" {
+				select {
+				case found <- true:
+				default:
+				}
+			}
+		}
+
+		if err := cmd.Wait(); err != nil {
+			done <- fmt.Errorf("%v: %s%s", err, output.String(), errBits.String())
+		} else {
+			done <- nil
+		}
+		close(found)
+	}()
+
+	if _, ok := <-found; !ok {
+		// It finished without ever giving us something to show
+		err := <-done
+		if err == nil {
+			err = fmt.Errorf("sso login finished without printing a verification url")
+		}
+		return nil, err
+	}
+
+	return login, nil
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Puts an aws on the path that prints output and then exits with the status
+func writeFakeSsoCli(t *testing.T, output string, status string) {
+	dir := t.TempDir()
+	contents := "#!/bin/sh\n" +
+		"printf '" + output + "'\n" +
+		"[ \"$*\" = \"sso login --no-browser\" ] || { echo \"unexpected arguments $*\" >&2; exit 2; }\n" +
+		"sleep 0.2\n" +
+		"exit " + status + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "aws"), []byte(contents), 0755); err != nil {
+		t.Fatalf("Error writing fake aws cli: %s", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func waitForLogin(t *testing.T, login *SsoLogin) error {
+	select {
+	case err := <-login.Done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the login to finish")
+		return nil
+	}
+}
+
+func TestStartSsoLogin(t *testing.T) {
+	writeFakeSsoCli(t, "Browser will not be automatically opened.\\n"+
+		"Please visit the following URL:\\n\\nhttps://device.sso.us-west-2.amazonaws.com/\\n\\n"+
+		"Then enter the code:\\n\\nABCD-EFGH\\n", "0")
+
+	login, err := StartSsoLogin(context.Background())
+	if err != nil {
+		t.Fatalf("Error starting the login: %s", err)
+	}
+	if login.VerificationUrl != "https://device.sso.us-west-2.amazonaws.com/" || login.UserCode != "ABCD-EFGH" {
+		t.Errorf("Expected the url and code, got %+v", login)
+	}
+	if err := waitForLogin(t, login); err != nil {
+		t.Errorf("Expected the login to succeed, got %s", err)
+	}
+}
+
+func TestStartSsoLoginCodeInUrl(t *testing.T) {
+	writeFakeSsoCli(t, "Open the following URL:\\n\\nhttps://oidc.us-west-2.amazonaws.com/device?user_code=WXYZ-1234\\n", "1")
+
+	login, err := StartSsoLogin(context.Background())
+	if err != nil {
+		t.Fatalf("Error starting the login: %s", err)
+	}
+	if login.UserCode != "WXYZ-1234" {
+		t.Errorf("Expected the code from the url, got %+v", login)
+	}
+	if err := waitForLogin(t, login); err == nil {
+		t.Errorf("Expected the failed login to be an error")
+	}
+}
+
+func TestStartSsoLoginWithoutUrl(t *testing.T) {
+	writeFakeSsoCli(t, "Missing the sso_start_url for the profile\\n", "255")
+
+	_, err := StartSsoLogin(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "sso_start_url") {
+		t.Errorf("Expected the cli's output in the error, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package tun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+/*
+Every process tunny starts is written down in a file of its own in ProcessStateDir, so that if
+it crashes or is killed the processes (and what they started, like session-manager-plugin) can
+be found and cleaned up by the next tunny, see CleanupProcesses.
+*/
+
+// A process tunny started
+type TrackedProcess struct {
+	Pid int `json:"pid"`
+	// When it started (in clock ticks since boot), so a pid that's been reused isn't mistaken for it
+	StartTime uint64 `json:"start_time"`
+	// The target it was started for, empty when it wasn't for one
+	Target string `json:"target,omitempty"`
+	// The program, without its arguments as they can have secrets in them
+	Name string `json:"name"`
+}
+
+func (p TrackedProcess) String() string {
+	if p.Target == "" {
+		return fmt.Sprintf("%s (pid %d)", p.Name, p.Pid)
+	}
+	return fmt.Sprintf("%s (pid %d) for %s", p.Name, p.Pid, p.Target)
+}
+
+// What a tunny has running, the contents of its file
+type trackedProcesses struct {
+	TunnyPid       int              `json:"tunny_pid"`
+	TunnyStartTime uint64           `json:"tunny_start_time"`
+	Processes      []TrackedProcess `json:"processes"`
+}
+
+/*
+Where each running tunny writes down its processes: $XDG_RUNTIME_DIR/tunny, or a tunny
+directory of the user's in the temp dir. It's cleared on reboot, as the processes are.
+*/
+func ProcessStateDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tunny")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tunny-%d", os.Getuid()))
+}
+
+type targetKey struct{}
+
+// WithTarget marks the processes started with ctx as being for the target, for cleaning up
+func WithTarget(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+func targetOf(ctx context.Context) string {
+	target, _ := ctx.Value(targetKey{}).(string)
+	return target
+}
+
+// This tunny's processes, written out whenever one starts or exits
+type processTracker struct {
+	lock      sync.Mutex
+	processes []TrackedProcess
+}
+
+var _tracker = &processTracker{}
+
+func (t *processTracker) add(ctx context.Context, cmd *exec.Cmd) {
+	startTime, err := processStartTime(cmd.Process.Pid)
+	if errors.Is(err, errTrackingUnsupported) {
+		return
+	} else if err != nil {
+		// Without it the process can't be told apart from a later one with its pid
+		log.Printf("> Not tracking process %d: %s", cmd.Process.Pid, err)
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.processes = append(t.processes, TrackedProcess{
+		Pid:       cmd.Process.Pid,
+		StartTime: startTime,
+		Target:    targetOf(ctx),
+		Name:      filepath.Base(cmd.Path),
+	})
+	t.write()
+}
+
+// The process and its group are gone
+func (t *processTracker) remove(pid int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, process := range t.processes {
+		if process.Pid == pid {
+			t.processes = append(t.processes[:i], t.processes[i+1:]...)
+			t.write()
+			return
+		}
+	}
+}
+
+// Write the file out, or remove it when nothing's running. Failing is logged, it's not worth stopping tunnels over.
+func (t *processTracker) write() {
+	filename := filepath.Join(ProcessStateDir(), strconv.Itoa(os.Getpid())+".json")
+	if len(t.processes) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("> Error removing %s: %s", filename, err)
+		}
+		return
+	}
+
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		log.Printf("> Error writing %s: %s", filename, err)
+		return
+	}
+	contents, err := json.MarshalIndent(trackedProcesses{TunnyPid: os.Getpid(), TunnyStartTime: startTime, Processes: t.processes}, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(filename), 0700)
+	}
+	if err == nil {
+		err = WriteFileAtomically(filename, contents, 0600)
+	}
+	if err != nil {
+		log.Printf("> Error writing %s: %s", filename, err)
+	}
+}
+
+// What CleanupProcesses did about a process an earlier tunny left behind
+type ProcessCleanup struct {
+	Process TrackedProcess
+	// The pids killed, the process's and those in its group, none when they'd all exited
+	Killed []int
+	Err    error
+}
+
+/*
+CleanupProcesses kills the processes that tunnys that are no longer running left behind, along
+with what they started (everything in their process group). A process is only killed when its
+start time shows it's the one that was started, a pid that's been reused is left alone. The files
+of tunnys that are still running aren't touched.
+*/
+func CleanupProcesses() ([]ProcessCleanup, error) {
+	files, err := filepath.Glob(filepath.Join(ProcessStateDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	cleanups := []ProcessCleanup{}
+	for _, filename := range files {
+		tracked, err := readTrackedProcesses(filename)
+		if err != nil {
+			return cleanups, err
+		}
+		if tracked.TunnyPid == os.Getpid() || isRunning(tracked.TunnyPid, tracked.TunnyStartTime) {
+			continue
+		}
+
+		failed := false
+		for _, process := range tracked.Processes {
+			killed, err := reapGroup(process)
+			cleanups = append(cleanups, ProcessCleanup{Process: process, Killed: killed, Err: err})
+			failed = failed || err != nil
+		}
+		// Kept to try again when something couldn't be killed
+		if !failed {
+			if err := os.Remove(filename); err != nil {
+				return cleanups, err
+			}
+		}
+	}
+	return cleanups, nil
+}
+
+func readTrackedProcesses(filename string) (trackedProcesses, error) {
+	var tracked trackedProcesses
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return tracked, err
+	}
+	if err := json.Unmarshal(contents, &tracked); err != nil {
+		return tracked, fmt.Errorf("%s: %w", filename, err)
+	}
+	return tracked, nil
+}
+
+// WriteFileAtomically writes to a temporary file next to filename first, so it's never left half written
+func WriteFileAtomically(filename string, contents []byte, perm os.FileMode) error {
+	temp := filename + ".tmp"
+	if err := os.WriteFile(temp, contents, perm); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// What's needed from /proc/<pid>/stat to tell a process apart from a later one with its pid
+type processStat struct {
+	state     string
+	group     int
+	startTime uint64
+}
+
+func readProcessStat(pid int) (processStat, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return processStat{}, err
+	}
+	// The fields from the state on come after the parenthesised command name, the start time is the 22nd
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 20 {
+		return processStat{}, fmt.Errorf("can't read /proc/%d/stat", pid)
+	}
+	group, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return processStat{}, err
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return processStat{}, err
+	}
+	return processStat{state: fields[0], group: group, startTime: startTime}, nil
+}
+
+func processStartTime(pid int) (uint64, error) {
+	stat, err := readProcessStat(pid)
+	return stat.startTime, err
+}
+
+// Whether the process that started at startTime is still running, a zombie isn't
+func isRunning(pid int, startTime uint64) bool {
+	stat, err := readProcessStat(pid)
+	return err == nil && stat.startTime == startTime && stat.state != "Z"
+}
+
+/*
+The processes still running in the group the tracked process led. The group id can only have
+been reused once the leader's pid has been, and then the leader's start time is different.
+*/
+func groupMembers(process TrackedProcess) (map[int]uint64, error) {
+	if stat, err := readProcessStat(process.Pid); err == nil && stat.startTime != process.StartTime {
+		return nil, nil
+	}
+
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[int]uint64)
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		stat, err := readProcessStat(pid)
+		if err != nil || stat.group != process.Pid || stat.state == "Z" || stat.startTime < process.StartTime {
+			continue
+		}
+		members[pid] = stat.startTime
+	}
+	return members, nil
+}
+
+// SIGTERM what's left of the process's group, then SIGKILL what's still there after the grace period
+func reapGroup(process TrackedProcess) ([]int, error) {
+	members, err := groupMembers(process)
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	signal := func(sig syscall.Signal) (running int, err error) {
+		for pid, startTime := range members {
+			if !isRunning(pid, startTime) {
+				continue
+			}
+			running++
+			if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return running, fmt.Errorf("error killing %d: %w", pid, err)
+			}
+		}
+		return running, nil
+	}
+
+	if _, err := signal(syscall.SIGTERM); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(defaultGracePeriod)
+	for time.Now().Before(deadline) {
+		running := 0
+		for pid, startTime := range members {
+			if isRunning(pid, startTime) {
+				running++
+			}
+		}
+		if running == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := signal(syscall.SIGKILL); err != nil {
+		return nil, err
+	}
+
+	killed := make([]int, 0, len(members))
+	for pid := range members {
+		killed = append(killed, pid)
+	}
+	return killed, nil
+}
+
+// Never returned here, /proc has the start times
+var errTrackingUnsupported = errors.New("tracking processes isn't supported here")
@@ -0,0 +1,145 @@
+package tun
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeTrackedProcesses(t *testing.T, name string, tracked trackedProcesses) string {
+	filename := filepath.Join(ProcessStateDir(), name+".json")
+	contents, err := json.Marshal(tracked)
+	if err != nil {
+		t.Fatalf("Error writing tracked processes: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		t.Fatalf("Error writing tracked processes: %s", err)
+	}
+	if err := os.WriteFile(filename, contents, 0600); err != nil {
+		t.Fatalf("Error writing tracked processes: %s", err)
+	}
+	return filename
+}
+
+func TestGroupProcessIsTracked(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	filename := filepath.Join(ProcessStateDir(), strconv.Itoa(os.Getpid())+".json")
+
+	ctx, cancel := context.WithCancel(WithTarget(context.Background(), "db"))
+	defer cancel()
+	proc, err := startGroupProcess(ctx, exec.Command("sleep", "100"), 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error starting sleep: %s", err)
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Expected the process to be written down: %s", err)
+	}
+	var tracked trackedProcesses
+	if err := json.Unmarshal(contents, &tracked); err != nil {
+		t.Fatalf("Error reading %s: %s", filename, err)
+	}
+	if len(tracked.Processes) != 1 {
+		t.Fatalf("Expected one process, got %+v", tracked)
+	}
+	process := tracked.Processes[0]
+	if process.Pid != proc.cmd.Process.Pid || process.Target != "db" || process.Name != "sleep" || !isRunning(process.Pid, process.StartTime) {
+		t.Errorf("Expected sleep for db with its start time, got %+v", process)
+	}
+	if tracked.TunnyPid != os.Getpid() || !isRunning(tracked.TunnyPid, tracked.TunnyStartTime) {
+		t.Errorf("Expected the test as the tunny, got %+v", tracked)
+	}
+
+	cancel()
+	<-proc.Done()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Expected %s to be removed once nothing's running", filename)
+}
+
+func TestCleanupProcesses(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	// What a crashed tunny left: a fake plugin with a stubborn child, in their own group
+	script, childPidFile := writeFakePlugin(t, "", "wait")
+	leftover := exec.Command(script)
+	setProcessGroup(leftover)
+	if err := leftover.Start(); err != nil {
+		t.Fatalf("Error starting fake plugin: %s", err)
+	}
+	go leftover.Wait()
+	childPid := readChildPid(t, childPidFile)
+	leftoverStart, err := processStartTime(leftover.Process.Pid)
+	if err != nil {
+		t.Fatalf("Error getting the start time: %s", err)
+	}
+
+	// And a pid that's since been reused by something else
+	reused := exec.Command("sleep", "100")
+	setProcessGroup(reused)
+	if err := reused.Start(); err != nil {
+		t.Fatalf("Error starting sleep: %s", err)
+	}
+	defer reused.Process.Kill()
+	reusedStart, _ := processStartTime(reused.Process.Pid)
+
+	crashed := writeTrackedProcesses(t, "crashed", trackedProcesses{
+		// The pid's been reused too, the parent didn't start at 1
+		TunnyPid:       os.Getppid(),
+		TunnyStartTime: 1,
+		Processes: []TrackedProcess{
+			{Pid: leftover.Process.Pid, StartTime: leftoverStart, Target: "db", Name: "fake-plugin"},
+			{Pid: reused.Process.Pid, StartTime: reusedStart + 1, Target: "api", Name: "aws"},
+		},
+	})
+
+	// A tunny that's still running is left alone, the test's parent stands in for it
+	parentStart, err := processStartTime(os.Getppid())
+	if err != nil {
+		t.Fatalf("Error getting the start time: %s", err)
+	}
+	running := writeTrackedProcesses(t, "running", trackedProcesses{
+		TunnyPid:       os.Getppid(),
+		TunnyStartTime: parentStart,
+		Processes:      []TrackedProcess{{Pid: reused.Process.Pid, StartTime: reusedStart, Name: "sleep"}},
+	})
+
+	cleanups, err := CleanupProcesses()
+	if err != nil {
+		t.Fatalf("Error cleaning up: %s", err)
+	}
+
+	waitForDeath(t, leftover.Process.Pid, time.Second)
+	waitForDeath(t, childPid, time.Second)
+	if !processAlive(reused.Process.Pid) {
+		t.Errorf("Expected the process with the reused pid to be left alone")
+	}
+	if _, err := os.Stat(running); err != nil {
+		t.Errorf("Expected the running tunny's file to be left: %s", err)
+	}
+	if _, err := os.Stat(crashed); !os.IsNotExist(err) {
+		t.Errorf("Expected the crashed tunny's file to be removed once it's cleaned up")
+	}
+
+	killed := 0
+	for _, cleanup := range cleanups {
+		if cleanup.Err != nil {
+			t.Errorf("Error cleaning up %s: %s", cleanup.Process, cleanup.Err)
+		}
+		killed += len(cleanup.Killed)
+	}
+	if killed != 2 {
+		t.Errorf("Expected the fake plugin and its child to be killed, got %+v", cleanups)
+	}
+}
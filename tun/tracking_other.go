@@ -0,0 +1,20 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+// Processes are only tracked where /proc has their start times
+var errTrackingUnsupported = errors.New("tracking processes isn't supported here")
+
+func processStartTime(pid int) (uint64, error) {
+	return 0, errTrackingUnsupported
+}
+
+func isRunning(pid int, startTime uint64) bool {
+	return false
+}
+
+func reapGroup(process TrackedProcess) ([]int, error) {
+	return nil, errTrackingUnsupported
+}
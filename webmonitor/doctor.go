@@ -0,0 +1,50 @@
+package webmonitor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"tunny/monitor"
+)
+
+// The port the web monitor is served on
+const ListenPort = "8080"
+
+// Where the web monitor is served
+const listenAddress = ":" + ListenPort
+
+// The files the web monitor serves from, relative to where tunny is run
+const publicDir = "public"
+
+// Check what the web monitor needs: its files, and the port it's served on
+func Preflight() []monitor.DoctorCheck {
+	checks := []monitor.DoctorCheck{}
+
+	index := filepath.Join(publicDir, "index.html")
+	_, err := os.Stat(index)
+	checks = append(checks, monitor.DoctorCheck{
+		Name: "web monitor files (" + index + ")",
+		Err:  err,
+		Hint: "Run tunny from the directory that has the public/ folder in it",
+	})
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err == nil {
+		err = listener.Close()
+	} else if conflicts := monitor.FindPortConflicts([]monitor.PortUse{WebMonitorPortUse()}); len(conflicts) > 0 {
+		err = conflicts[0]
+	}
+	checks = append(checks, monitor.DoctorCheck{
+		Name: fmt.Sprintf("web monitor port %s is free", listenAddress),
+		Err:  err,
+		Hint: "Stop whatever is listening on it, another tunny maybe (lsof -i " + listenAddress + ")",
+	})
+
+	return checks
+}
+
+// The web monitor's port, to check it's free along with the targets'
+func WebMonitorPortUse() monitor.PortUse {
+	return monitor.PortUse{User: "the web monitor", Port: ListenPort}
+}
@@ -2,9 +2,64 @@ package webmonitor
 
 import (
 	"encoding/json"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"tunny/monitor"
 )
 
+/*
+Whether the request was made to this machine by address or as localhost. A page that points a
+name of its own at this machine (DNS rebinding) sends that name, so it's turned away.
+*/
+func trustedHost(r *http.Request) bool {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = hostname
+	}
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+// Whether the request came from this machine, the dashboard can be looked at from elsewhere but not driven
+func fromThisMachine(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+Only lets json POSTs from the dashboard itself, on this machine, through to the handler. Other
+sites' pages can't send json without the browser asking first, which is never answered, and
+their Origin gives them away when they try.
+*/
+func dashboardPost(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			writer.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !fromThisMachine(r) || !trustedHost(r) {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if parsed, err := url.Parse(origin); err != nil || parsed.Host != r.Host {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		handler(writer, r)
+	}
+}
+
 func (w *WebMonitor) GetMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
@@ -16,13 +71,17 @@ func (w *WebMonitor) GetMux() *http.ServeMux {
 
 	// Return the index.html file
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handler := gzipHandlerFunc(http.FileServer(http.Dir("public")).ServeHTTP)
+		handler := gzipHandlerFunc(http.FileServer(http.Dir(publicDir)).ServeHTTP)
 
 		handler.ServeHTTP(w, r)
 
 	})
 
 	mux.HandleFunc("/api/state", func(writer http.ResponseWriter, r *http.Request) {
+		if !trustedHost(r) {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
 		writer.Header().Set("Content-Type", "application/json")
 		unclaim := w.claim()
 		bytes, err := json.MarshalIndent(w, "", "  ")
@@ -38,5 +97,59 @@ func (w *WebMonitor) GetMux() *http.ServeMux {
 		writer.Write(bytes)
 	})
 
+	mux.HandleFunc("/api/prompts/answer", dashboardPost(func(writer http.ResponseWriter, r *http.Request) {
+		var answer struct {
+			Id     int    `json:"id"`
+			Answer string `json:"answer"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+
+		if !w.AnswerPrompt(answer.Id, answer.Answer) {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	// Start or stop targets, by {"names": [...]} and/or {"groups": [...]}
+	for path, change := range map[string]func(*monitor.TargetSet, monitor.TargetSelection) ([]string, error){
+		"/api/targets/start": (*monitor.TargetSet).Start,
+		"/api/targets/stop":  (*monitor.TargetSet).Stop,
+	} {
+		change := change
+		mux.HandleFunc(path, dashboardPost(func(writer http.ResponseWriter, r *http.Request) {
+			var selection monitor.TargetSelection
+			if err := json.NewDecoder(r.Body).Decode(&selection); err != nil || selection.Empty() {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte("Expected the names and/or groups of the targets"))
+				return
+			}
+
+			unclaim := w.claim()
+			set := w.targetSet
+			unclaim()
+			if set == nil {
+				writer.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			changed, err := change(set, selection)
+			if err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusOK)
+			json.NewEncoder(writer).Encode(changed)
+		}))
+	}
+
 	return mux
 }
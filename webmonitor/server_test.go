@@ -0,0 +1,50 @@
+package webmonitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardPost(t *testing.T) {
+	handler := dashboardPost(func(writer http.ResponseWriter, r *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		remote      string
+		host        string
+		contentType string
+		origin      string
+		expected    int
+	}{
+		{"from the dashboard", http.MethodPost, "127.0.0.1:50000", "localhost:8080", "application/json", "http://localhost:8080", http.StatusOK},
+		{"by address, without an origin", http.MethodPost, "[::1]:50000", "192.168.1.5:8080", "application/json; charset=utf-8", "", http.StatusOK},
+		{"from another machine", http.MethodPost, "192.168.1.9:50000", "192.168.1.5:8080", "application/json", "", http.StatusForbidden},
+		{"a get", http.MethodGet, "127.0.0.1:50000", "localhost:8080", "application/json", "", http.StatusMethodNotAllowed},
+		{"a form from another site", http.MethodPost, "127.0.0.1:50000", "localhost:8080", "application/x-www-form-urlencoded", "https://evil.example", http.StatusUnsupportedMediaType},
+		{"plain text", http.MethodPost, "127.0.0.1:50000", "localhost:8080", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"json from another site", http.MethodPost, "127.0.0.1:50000", "localhost:8080", "application/json", "https://evil.example", http.StatusForbidden},
+		{"a rebound name", http.MethodPost, "127.0.0.1:50000", "evil.example:8080", "application/json", "http://evil.example:8080", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/targets/start", strings.NewReader(`{"names": ["db"]}`))
+			r.RemoteAddr = test.remote
+			r.Host = test.host
+			r.Header.Set("Content-Type", test.contentType)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, r)
+			if recorder.Code != test.expected {
+				t.Errorf("Expected %d, got %d", test.expected, recorder.Code)
+			}
+		})
+	}
+}
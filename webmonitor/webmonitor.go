@@ -11,7 +11,7 @@ import (
 )
 
 type LogItem struct {
-	Level string    `json:"level",omitempty`
+	Level string    `json:"level,omitempty"`
 	Msg   string    `json:"msg"`
 	Time  time.Time `json:"time"`
 }
@@ -27,7 +27,54 @@ type WebMonitor struct {
 
 	GeneralInfo []LogItem `json:"general_info"`
 
+	// How each target is doing
+	Status map[string]*monitor.TargetStatus `json:"status"`
+
+	// The SSO login in progress, if any
+	SsoLogin *SsoLogin `json:"sso_login"`
+
+	// Questions waiting on an answer, from the dashboard or stdin
+	Prompts    []*Prompt `json:"prompts"`
+	nextPrompt int
+
 	cliBackup *monitor.CliMonitor
+
+	// Starts and stops targets for the dashboard, nil until ControlTargets
+	targetSet *monitor.TargetSet
+
+	ctx context.Context
+}
+
+// Where the user needs to go to finish an SSO login
+type SsoLogin struct {
+	VerificationUrl string `json:"verification_url"`
+	UserCode        string `json:"user_code"`
+}
+
+// A question asked on behalf of a target
+type Prompt struct {
+	Id     int    `json:"id"`
+	Target string `json:"target"`
+	Prompt string `json:"prompt"`
+
+	answer chan string
+}
+
+// Only the latest logs are kept for each target, tunnel output can be chatty
+const maxLogsPerTarget = 500
+
+// Add a log item for a target, the monitor must already be claimed
+func (w *WebMonitor) appendLog(targetName string, newItem LogItem) {
+	if val, ok := w.Logs[targetName]; ok {
+		val = append(val, newItem)
+		if len(val) > maxLogsPerTarget {
+			val = val[len(val)-maxLogsPerTarget:]
+		}
+		w.Logs[targetName] = val
+	} else {
+		// Just go make it
+		w.Logs[targetName] = []LogItem{newItem}
+	}
 }
 
 // Claim the webmonitor for writing, returns a function to release the lock.
@@ -44,13 +91,8 @@ func (w *WebMonitor) ReportError(targetName string, _fmt string, args ...any) {
 	w.cliBackup.ReportError(targetName, _fmt, args...)
 	unclaim := w.claim()
 	defer unclaim()
-	newItem := LogItem{Msg: fmt.Sprintf(_fmt, args...), Time: time.Now(), Level: "warn"}
-	if val, ok := w.Logs[targetName]; ok {
-		w.Logs[targetName] = append(val, newItem)
-	} else {
-		// Just go make it
-		w.Logs[targetName] = []LogItem{newItem}
-	}
+	newItem := LogItem{Msg: monitor.Redact(fmt.Sprintf(_fmt, args...)), Time: time.Now(), Level: "error"}
+	w.appendLog(targetName, newItem)
 }
 
 // ReportFatalError implements monitor.MonitoringInteractor.
@@ -58,21 +100,78 @@ func (w *WebMonitor) ReportFatalError(targetName string, _fmt string, args ...an
 	w.cliBackup.ReportFatalError(targetName, _fmt, args...)
 	unclaim := w.claim()
 	defer unclaim()
-	newItem := LogItem{Msg: fmt.Sprintf(_fmt, args...), Time: time.Now(), Level: "fatal"}
-	if val, ok := w.Logs[targetName]; ok {
-		w.Logs[targetName] = append(val, newItem)
+	newItem := LogItem{Msg: monitor.Redact(fmt.Sprintf(_fmt, args...)), Time: time.Now(), Level: "fatal"}
+	w.appendLog(targetName, newItem)
+}
+
+// ReportCredentialsExpired implements monitor.MonitoringInteractor.
+func (w *WebMonitor) ReportCredentialsExpired(targetName string, _fmt string, args ...any) {
+	w.cliBackup.ReportCredentialsExpired(targetName, _fmt, args...)
+	unclaim := w.claim()
+	defer unclaim()
+	newItem := LogItem{Msg: monitor.Redact(fmt.Sprintf(_fmt, args...)), Time: time.Now(), Level: "auth"}
+	w.appendLog(targetName, newItem)
+}
+
+// ReportStatus implements monitor.MonitoringInteractor.
+func (w *WebMonitor) ReportStatus(targetName string, update func(status *monitor.TargetStatus)) {
+	w.cliBackup.ReportStatus(targetName, update)
+	unclaim := w.claim()
+	defer unclaim()
+	status, ok := w.Status[targetName]
+	if !ok {
+		status = &monitor.TargetStatus{}
+		w.Status[targetName] = status
+	}
+	update(status)
+	// Failures can quote the config, which can have secrets in it by now
+	status.LastFailure = monitor.Redact(status.LastFailure)
+}
+
+// ReportSsoLogin implements monitor.MonitoringInteractor.
+func (w *WebMonitor) ReportSsoLogin(verificationUrl string, userCode string) {
+	w.cliBackup.ReportSsoLogin(verificationUrl, userCode)
+	unclaim := w.claim()
+	defer unclaim()
+	if verificationUrl == "" {
+		w.SsoLogin = nil
 	} else {
-		// Just go make it
-		w.Logs[targetName] = []LogItem{newItem}
+		w.SsoLogin = &SsoLogin{VerificationUrl: verificationUrl, UserCode: userCode}
 	}
 }
 
+// ReportTargets implements monitor.MonitoringInteractor.
+// The dashboard shows the new set, removed targets keep their logs but lose their status.
+func (w *WebMonitor) ReportTargets(targets []monitor.TunnelTarget) {
+	w.cliBackup.ReportTargets(targets)
+	unclaim := w.claim()
+	defer unclaim()
+	w.Targets = targets
+
+	keep := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		keep[target.Name] = true
+	}
+	for name := range w.Status {
+		if !keep[name] {
+			delete(w.Status, name)
+		}
+	}
+}
+
+// Let the dashboard start and stop the set's targets
+func (w *WebMonitor) ControlTargets(set *monitor.TargetSet) {
+	unclaim := w.claim()
+	defer unclaim()
+	w.targetSet = set
+}
+
 // ReportGeneralMessage implements monitor.MonitoringInteractor.
 func (w *WebMonitor) ReportGeneralMessage(_fmt string, args ...any) {
 	w.cliBackup.ReportGeneralMessage(_fmt, args...)
 	unclaim := w.claim()
 	defer unclaim()
-	newItem := LogItem{Msg: fmt.Sprintf(_fmt, args...), Time: time.Now(), Level: "info"}
+	newItem := LogItem{Msg: monitor.Redact(fmt.Sprintf(_fmt, args...)), Time: time.Now(), Level: "info"}
 
 	w.GeneralInfo = append(w.GeneralInfo, newItem)
 }
@@ -82,13 +181,67 @@ func (w *WebMonitor) ReportInfo(targetName string, _fmt string, args ...any) {
 	w.cliBackup.ReportInfo(targetName, _fmt, args...)
 	unclaim := w.claim()
 	defer unclaim()
-	newItem := LogItem{Msg: fmt.Sprintf(_fmt, args...), Time: time.Now(), Level: "info"}
-	if val, ok := w.Logs[targetName]; ok {
-		w.Logs[targetName] = append(val, newItem)
-	} else {
-		// Just go make it
-		w.Logs[targetName] = []LogItem{newItem}
+	newItem := LogItem{Msg: monitor.Redact(fmt.Sprintf(_fmt, args...)), Time: time.Now(), Level: "info"}
+	w.appendLog(targetName, newItem)
+}
+
+// AskForInput implements monitor.MonitoringInteractor.
+// The prompt can be answered from the dashboard or with AnswerOldestPrompt.
+func (w *WebMonitor) AskForInput(targetName string, prompt string) (string, error) {
+	unclaim := w.claim()
+	w.nextPrompt++
+	newPrompt := &Prompt{Id: w.nextPrompt, Target: targetName, Prompt: prompt, answer: make(chan string, 1)}
+	w.Prompts = append(w.Prompts, newPrompt)
+	unclaim()
+
+	w.cliBackup.ReportInfo(targetName, "%s (answer in the dashboard, or type it here and press enter)", prompt)
+
+	select {
+	case answer := <-newPrompt.answer:
+		return answer, nil
+	case <-w.ctx.Done():
+		w.removePrompt(newPrompt.Id)
+		return "", w.ctx.Err()
+	}
+}
+
+// Take a prompt out of the waiting list, nil if it wasn't there
+func (w *WebMonitor) removePrompt(id int) *Prompt {
+	unclaim := w.claim()
+	defer unclaim()
+
+	for i, prompt := range w.Prompts {
+		if prompt.Id == id {
+			w.Prompts = append(w.Prompts[:i], w.Prompts[i+1:]...)
+			return prompt
+		}
 	}
+
+	return nil
+}
+
+// Answer the prompt with the given id, returns false if there was no such prompt
+func (w *WebMonitor) AnswerPrompt(id int, answer string) bool {
+	prompt := w.removePrompt(id)
+	if prompt == nil {
+		return false
+	}
+
+	prompt.answer <- answer
+	return true
+}
+
+// Answer whichever prompt has been waiting the longest, returns false if nothing is waiting
+func (w *WebMonitor) AnswerOldestPrompt(answer string) bool {
+	unclaim := w.claim()
+	if len(w.Prompts) == 0 {
+		unclaim()
+		return false
+	}
+	id := w.Prompts[0].Id
+	unclaim()
+
+	return w.AnswerPrompt(id, answer)
 }
 
 func NewWebMonitor(ctx context.Context, targets []monitor.TunnelTarget) (*WebMonitor, error) {
@@ -98,12 +251,17 @@ func NewWebMonitor(ctx context.Context, targets []monitor.TunnelTarget) (*WebMon
 		Logs:    make(map[string][]LogItem),
 
 		GeneralInfo: []LogItem{},
+		Status:      make(map[string]*monitor.TargetStatus),
+		Prompts:     []*Prompt{},
+
+		cliBackup: &monitor.CliMonitor{},
+		ctx:       ctx,
 	}
 
 	mux := mon.GetMux()
 
 	server := &http.Server{
-		Addr:    ":8080",
+		Addr:    listenAddress,
 		Handler: mux,
 	}
 